@@ -116,10 +116,12 @@ export function getConnectProviders(id) {
   return request('GET', `/v1/connect/${encodeURIComponent(id)}/providers`);
 }
 
-export function approveConnect(id, providers, scope) {
+export function approveConnect(id, providers, scope, tools, mcpServers) {
   const body = {};
   if (providers && providers.length > 0) body.providers = providers;
   if (scope) body.scope = scope;
+  if (tools) body.tools = tools;
+  if (mcpServers && mcpServers.length > 0) body.mcp_servers = mcpServers;
   return request('POST', `/v1/connect/${encodeURIComponent(id)}/approve`, {
     body: Object.keys(body).length > 0 ? body : undefined,
   });
@@ -128,3 +130,17 @@ export function approveConnect(id, providers, scope) {
 export function denyConnect(id) {
   return request('POST', `/v1/connect/${encodeURIComponent(id)}/deny`);
 }
+
+// ── Tool approvals ──────────────────────────────────────────
+
+export function getToolApprovals() {
+  return request('GET', '/v1/approvals');
+}
+
+export function approveToolCall(id) {
+  return request('POST', `/v1/approvals/${encodeURIComponent(id)}/approve`);
+}
+
+export function denyToolCall(id) {
+  return request('POST', `/v1/approvals/${encodeURIComponent(id)}/deny`);
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"plugmyai/internal/config"
+	"plugmyai/internal/provider"
+	"plugmyai/internal/provider/replay"
+	"plugmyai/internal/store"
+)
+
+// runCassette implements the `cassette` subcommand: it turns request history
+// into a cassette for the replay provider, so real traffic can become test
+// fixtures. Entries are added to the output file if it already exists.
+func runCassette(configDir string, args []string) {
+	fs := flag.NewFlagSet("cassette", flag.ExitOnError)
+	out := fs.String("out", "", "cassette file to write (required)")
+	app := fs.String("app", "", "only entries from apps whose name contains this")
+	model := fs.String("model", "", "only entries for this model")
+	ids := fs.String("ids", "", "comma-separated history entry IDs (overrides other filters)")
+	limit := fs.Int("limit", 100, "maximum number of entries")
+	fs.Parse(args)
+
+	if *out == "" {
+		log.Fatal("cassette: -out is required")
+	}
+
+	cfg, err := config.Load(configDir)
+	if err != nil {
+		log.Fatalf("cassette: loading config: %v", err)
+	}
+	st, err := store.New(cfg.DataDir)
+	if err != nil {
+		log.Fatalf("cassette: opening store: %v", err)
+	}
+	defer st.Close()
+
+	var entries []store.HistoryEntry
+	if *ids != "" {
+		for _, id := range strings.Split(*ids, ",") {
+			e, err := st.GetHistoryEntry(strings.TrimSpace(id))
+			if err != nil || e == nil {
+				log.Fatalf("cassette: history entry %s not found", id)
+			}
+			entries = append(entries, *e)
+		}
+	} else {
+		entries, err = historyEntries(st, *app, *model, *limit)
+		if err != nil {
+			log.Fatalf("cassette: listing history: %v", err)
+		}
+	}
+
+	cassette, err := replay.LoadCassette(*out)
+	if err != nil {
+		log.Fatalf("cassette: %v", err)
+	}
+
+	added := 0
+	for _, e := range entries {
+		in, ok := historyInteraction(e)
+		if !ok {
+			continue
+		}
+		cassette.Add(in)
+		added++
+	}
+
+	if err := cassette.Save(*out); err != nil {
+		log.Fatalf("cassette: %v", err)
+	}
+	fmt.Printf("Wrote %d interactions to %s (%d total)\n", added, *out, len(cassette.Interactions))
+}
+
+// historyEntries pages through successful history entries matching the filters.
+func historyEntries(st *store.Store, app, model string, limit int) ([]store.HistoryEntry, error) {
+	var out []store.HistoryEntry
+	for offset := 0; len(out) < limit; offset += 100 {
+		page, total, err := st.ListHistoryFiltered(store.HistoryFilter{Limit: 100, Offset: offset, AppName: app})
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range page {
+			if e.Status != "success" || (model != "" && e.Model != model) {
+				continue
+			}
+			out = append(out, e)
+			if len(out) == limit {
+				break
+			}
+		}
+		if offset+100 >= total {
+			break
+		}
+	}
+	return out, nil
+}
+
+// historyInteraction converts a history entry. History keeps only the full
+// response text, so it is replayed as a single chunk.
+func historyInteraction(e store.HistoryEntry) (replay.Interaction, bool) {
+	var messages []provider.Message
+	if err := json.Unmarshal(e.Messages, &messages); err != nil || len(messages) == 0 {
+		return replay.Interaction{}, false
+	}
+	var resp struct {
+		Content string `json:"content"`
+	}
+	if err := json.Unmarshal(e.Response, &resp); err != nil {
+		return replay.Interaction{}, false
+	}
+
+	// Estimated counts are left out: replay would pass them off as reported
+	var usage *provider.Usage
+	if (e.TokensIn > 0 || e.TokensOut > 0) && !e.Estimated {
+		usage = &provider.Usage{
+			PromptTokens:     e.TokensIn,
+			CompletionTokens: e.TokensOut,
+			TotalTokens:      e.TokensIn + e.TokensOut,
+		}
+	}
+	in := replay.TextInteraction(e.Model, messages, resp.Content, usage, time.Duration(e.DurationMS)*time.Millisecond)
+	in.RecordedAt = e.CreatedAt
+	if e.FinishReason != "" {
+		in.Chunks[len(in.Chunks)-1].FinishReason = e.FinishReason
+	}
+	return in, true
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+)
+
+// runApprovalHook implements the `approval-hook` subcommand, installed by the
+// daemon as a Claude Code PreToolUse hook. It forwards the tool call on stdin
+// to the daemon, blocks until the user decides, and prints the decision in
+// Claude Code's hook output format. Any failure is reported as a deny.
+func runApprovalHook(args []string) {
+	fs := flag.NewFlagSet("approval-hook", flag.ExitOnError)
+	url := fs.String("url", "", "daemon approval endpoint")
+	token := fs.String("token", "", "run token issued by the daemon")
+	fs.Parse(args)
+
+	decision, reason := requestApproval(*url, *token, os.Stdin)
+
+	out, _ := json.Marshal(map[string]any{
+		"hookSpecificOutput": map[string]any{
+			"hookEventName":            "PreToolUse",
+			"permissionDecision":       decision,
+			"permissionDecisionReason": reason,
+		},
+	})
+	fmt.Println(string(out))
+}
+
+func requestApproval(url, token string, stdin io.Reader) (decision, reason string) {
+	payload, err := io.ReadAll(stdin)
+	if err != nil {
+		return "deny", "approval hook: reading tool call: " + err.Error()
+	}
+
+	req, err := http.NewRequest("POST", url, bytes.NewReader(payload))
+	if err != nil {
+		return "deny", "approval hook: " + err.Error()
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "deny", "approval hook: daemon unreachable: " + err.Error()
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "deny", fmt.Sprintf("approval hook: daemon returned %d", resp.StatusCode)
+	}
+
+	var result struct {
+		Decision string `json:"decision"`
+		Reason   string `json:"reason"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "deny", "approval hook: invalid daemon response"
+	}
+	if result.Decision != "allow" {
+		return "deny", result.Reason
+	}
+	return "allow", result.Reason
+}
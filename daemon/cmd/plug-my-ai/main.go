@@ -10,7 +10,9 @@ import (
 
 	"plugmyai/internal/config"
 	"plugmyai/internal/dashboard"
+	"plugmyai/internal/mcp"
 	"plugmyai/internal/provider"
+	"plugmyai/internal/secret"
 	"plugmyai/internal/server"
 	"plugmyai/internal/store"
 	"plugmyai/internal/tray"
@@ -19,7 +21,12 @@ import (
 	// Add new providers here as blank imports.
 	_ "plugmyai/internal/provider/claude"
 	_ "plugmyai/internal/provider/codex"
+	_ "plugmyai/internal/provider/mock"
 	_ "plugmyai/internal/provider/openaicompat"
+	_ "plugmyai/internal/provider/replay"
+
+	// Sandbox runners for CLI providers, registered the same way.
+	_ "plugmyai/internal/sandbox/bwrap"
 )
 
 func main() {
@@ -28,10 +35,28 @@ func main() {
 	noTray := flag.Bool("no-tray", false, "disable system tray icon")
 	flag.Parse()
 
-	// Handle init subcommand
-	if flag.NArg() > 0 && flag.Arg(0) == "init" {
-		runInit(*configDir)
-		return
+	// Mask resolved secrets in everything logged
+	log.SetOutput(secret.RedactingWriter(os.Stderr))
+
+	// Handle subcommands
+	if flag.NArg() > 0 {
+		switch flag.Arg(0) {
+		case "init":
+			runInit(*configDir)
+			return
+		case "approval-hook":
+			runApprovalHook(flag.Args()[1:])
+			return
+		case "mcp":
+			runMCP(*configDir, flag.Args()[1:])
+			return
+		case "cassette":
+			runCassette(*configDir, flag.Args()[1:])
+			return
+		case "secret":
+			runSecret(*configDir, flag.Args()[1:])
+			return
+		}
 	}
 
 	// Load config
@@ -56,8 +81,10 @@ func main() {
 	defer st.Close()
 
 	// Initialize providers
+	secrets := secret.NewResolver(cfg.DataDir)
 	registry := provider.NewRegistry()
-	setupProviders(cfg, registry)
+	setupProviders(cfg, secrets, registry)
+	mcpServers := resolveMCPServers(cfg, secrets)
 
 	// Log available providers
 	for _, p := range registry.All() {
@@ -75,7 +102,7 @@ func main() {
 	}
 
 	// Create server
-	srv := server.New(cfg, st, registry)
+	srv := server.New(cfg, st, registry, mcpServers)
 
 	// Signal handling for graceful shutdown
 	sigCh := make(chan os.Signal, 1)
@@ -111,12 +138,17 @@ func main() {
 	}
 }
 
-func setupProviders(cfg *config.Config, registry *provider.Registry) {
+func setupProviders(cfg *config.Config, secrets *secret.Resolver, registry *provider.Registry) {
 	for _, pc := range cfg.Providers {
 		if !pc.Enabled {
 			continue
 		}
-		p, err := provider.CreateProvider(pc.Type, pc.Config)
+		raw, err := secrets.ResolveJSON(pc.Config)
+		if err != nil {
+			log.Printf("Failed to create provider %s: resolving secrets: %v", pc.Type, err)
+			continue
+		}
+		p, err := provider.CreateProvider(pc.Type, raw)
 		if err != nil {
 			log.Printf("Failed to create provider %s: %v", pc.Type, err)
 			continue
@@ -125,6 +157,44 @@ func setupProviders(cfg *config.Config, registry *provider.Registry) {
 	}
 }
 
+// resolveMCPServers returns the configured MCP servers with secret
+// references in their env and headers resolved. cfg keeps the references,
+// so saving it never writes a credential. A server whose reference can't be
+// resolved is skipped.
+func resolveMCPServers(cfg *config.Config, secrets *secret.Resolver) map[string]mcp.ServerConfig {
+	servers := make(map[string]mcp.ServerConfig, len(cfg.MCPServers))
+	for name, sc := range cfg.MCPServers {
+		env, err := resolveValues(secrets, sc.Env)
+		if err == nil {
+			sc.Env = env
+			sc.Headers, err = resolveValues(secrets, sc.Headers)
+		}
+		if err != nil {
+			log.Printf("Skipping MCP server %s: resolving secrets: %v", name, err)
+			continue
+		}
+		servers[name] = sc
+	}
+	return servers
+}
+
+// resolveValues resolves the secret references among a map's values into a
+// new map.
+func resolveValues(secrets *secret.Resolver, values map[string]string) (map[string]string, error) {
+	if values == nil {
+		return nil, nil
+	}
+	out := make(map[string]string, len(values))
+	for k, v := range values {
+		resolved, err := secrets.Resolve(v)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", k, err)
+		}
+		out[k] = resolved
+	}
+	return out, nil
+}
+
 func runInit(configDir string) {
 	cfg, err := config.Load(configDir)
 	if err != nil {
@@ -134,7 +204,7 @@ func runInit(configDir string) {
 	fmt.Println("plug-my-ai initialized!")
 	fmt.Printf("Config: %s/config.json\n", cfg.DataDir)
 	fmt.Printf("Port: %d\n", cfg.Port)
-	fmt.Printf("Admin token: %s\n", cfg.AdminToken)
+	fmt.Printf("Admin token: %s\n", cfg.ResolvedAdminToken())
 	fmt.Println()
 	fmt.Println("Start the daemon:")
 	fmt.Println("  plug-my-ai")
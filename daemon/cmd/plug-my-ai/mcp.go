@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	"plugmyai/internal/config"
+	"plugmyai/internal/mcp"
+)
+
+// runMCP implements the `mcp` subcommand: an MCP server on stdio for agents
+// that launch their tools as processes. It is a thin bridge — every JSON-RPC
+// message read from stdin is POSTed to the running daemon's /v1/mcp endpoint
+// with the app token, so scoping and history logging happen in the daemon.
+func runMCP(configDir string, args []string) {
+	fs := flag.NewFlagSet("mcp", flag.ExitOnError)
+	token := fs.String("token", os.Getenv("PLUGMYAI_TOKEN"), "app token (defaults to $PLUGMYAI_TOKEN)")
+	url := fs.String("url", "", "daemon MCP endpoint (defaults to the configured port)")
+	fs.Parse(args)
+
+	// stdout carries the protocol; log only writes to stderr.
+
+	if *token == "" {
+		log.Fatal("mcp: an app token is required (-token or $PLUGMYAI_TOKEN)")
+	}
+	if *url == "" {
+		cfg, err := config.Load(configDir)
+		if err != nil {
+			log.Fatalf("mcp: loading config: %v", err)
+		}
+		*url = fmt.Sprintf("http://localhost:%d/v1/mcp", cfg.Port)
+	}
+
+	bridgeMCP(*url, *token, os.Stdin, os.Stdout)
+}
+
+// bridgeMCP forwards newline-delimited JSON-RPC messages from in to the daemon
+// and writes its responses to out. Messages are handled concurrently so a long
+// chat call doesn't hold up pings or other requests.
+func bridgeMCP(url, token string, in io.Reader, out io.Writer) {
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	write := func(data []byte) {
+		mu.Lock()
+		defer mu.Unlock()
+		out.Write(append(bytes.TrimSpace(data), '\n'))
+	}
+
+	scanner := bufio.NewScanner(in)
+	scanner.Buffer(make([]byte, 1024*1024), 10*1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		msg := []byte(line)
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if resp := forwardMCP(url, token, msg); resp != nil {
+				write(resp)
+			}
+		}()
+	}
+	if err := scanner.Err(); err != nil {
+		log.Printf("mcp: reading stdin: %v", err)
+	}
+	wg.Wait()
+}
+
+// forwardMCP POSTs one message to the daemon and returns the response to
+// relay, or nil when there is none. Transport failures are turned into
+// JSON-RPC errors so the client isn't left waiting.
+func forwardMCP(url, token string, msg []byte) []byte {
+	var id struct {
+		ID json.RawMessage `json:"id"`
+	}
+	json.Unmarshal(msg, &id)
+
+	fail := func(format string, args ...any) []byte {
+		if len(id.ID) == 0 {
+			log.Printf("mcp: "+format, args...)
+			return nil
+		}
+		data, _ := json.Marshal(mcp.Response{
+			JSONRPC: "2.0",
+			ID:      id.ID,
+			Error:   &mcp.RPCError{Code: mcp.CodeInternalError, Message: fmt.Sprintf(format, args...)},
+		})
+		return data
+	}
+
+	req, err := http.NewRequest("POST", url, bytes.NewReader(msg))
+	if err != nil {
+		return fail("%v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json, text/event-stream")
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fail("daemon unreachable: %v", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fail("reading daemon response: %v", err)
+	}
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return body
+	case http.StatusAccepted:
+		return nil
+	default:
+		var apiErr struct {
+			Error struct {
+				Message string `json:"message"`
+			} `json:"error"`
+		}
+		json.Unmarshal(body, &apiErr)
+		if apiErr.Error.Message != "" {
+			return fail("daemon returned %d: %s", resp.StatusCode, apiErr.Error.Message)
+		}
+		return fail("daemon returned %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"plugmyai/internal/secret"
+)
+
+// runSecret implements the `secret` subcommand, which manages the encrypted
+// secrets file that config values reference as secret:NAME.
+//
+//	plug-my-ai secret set NAME [VALUE]   (VALUE is read from stdin if omitted)
+//	plug-my-ai secret list
+//	plug-my-ai secret rm NAME
+func runSecret(configDir string, args []string) {
+	usage := "usage: plug-my-ai secret set NAME [VALUE] | list | rm NAME"
+	if len(args) == 0 {
+		log.Fatal(usage)
+	}
+
+	// The data dir is the config dir. Not loading the config lets this set
+	// a secret that admin_token refers to before it resolves.
+	st, err := secret.OpenStore(configDir)
+	if err != nil {
+		log.Fatalf("secret: %v", err)
+	}
+
+	switch {
+	case args[0] == "set" && (len(args) == 2 || len(args) == 3):
+		value := ""
+		if len(args) == 3 {
+			value = args[2]
+		} else {
+			// Reading stdin keeps the value out of shell history
+			fmt.Fprintf(os.Stderr, "Value for %s: ", args[1])
+			line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+			if err != nil && line == "" {
+				log.Fatalf("secret: reading value: %v", err)
+			}
+			value = strings.TrimRight(line, "\r\n")
+		}
+		if value == "" {
+			log.Fatal("secret: value is empty")
+		}
+		if err := st.Set(args[1], value); err != nil {
+			log.Fatalf("secret: %v", err)
+		}
+		fmt.Printf("Stored %s — reference it in config.json as \"secret:%s\"\n", args[1], args[1])
+
+	case args[0] == "list" && len(args) == 1:
+		for _, name := range st.Names() {
+			fmt.Println(name)
+		}
+
+	case args[0] == "rm" && len(args) == 2:
+		ok, err := st.Delete(args[1])
+		if err != nil {
+			log.Fatalf("secret: %v", err)
+		}
+		if !ok {
+			log.Fatalf("secret: %s not found", args[1])
+		}
+		fmt.Printf("Removed %s\n", args[1])
+
+	default:
+		log.Fatal(usage)
+	}
+}
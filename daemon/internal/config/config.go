@@ -7,20 +7,68 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"time"
+
+	"plugmyai/internal/mcp"
+	"plugmyai/internal/secret"
 )
 
 const (
 	DefaultPort    = 21110
 	DefaultDataDir = ".plug-my-ai"
 	ConfigFileName = "config.json"
+
+	DefaultApprovalTimeout = 2 * time.Minute
+	DefaultAgentIterations = 8
+	DefaultPassthroughMB   = 25
+
+	DefaultStructuredRetries = 1
+	DefaultParallelChoices   = 4
+	DefaultBatchConcurrency  = 2
 )
 
 type Config struct {
 	Port          int              `json:"port"`
-	AdminToken    string           `json:"admin_token"`
+	AdminToken    string           `json:"admin_token"` // may be a secret reference (env:, file:, secret:)
 	DataDir       string           `json:"data_dir"`
 	Providers     []ProviderConfig `json:"providers"`
 	SetupComplete bool             `json:"setup_complete"`
+
+	// MCPServers are the MCP servers apps can be granted at pairing time, by name.
+	MCPServers map[string]mcp.ServerConfig `json:"mcp_servers,omitempty"`
+
+	// ApprovalTimeoutS is how long a tool call waits for a human decision
+	// before it is denied. Defaults to DefaultApprovalTimeout.
+	ApprovalTimeoutS int `json:"approval_timeout_s,omitempty"`
+
+	// AgentMaxIterations caps the model turns of the daemon's agent loop
+	// (MCP tools for plain chat models). Defaults to DefaultAgentIterations.
+	AgentMaxIterations int `json:"agent_max_iterations,omitempty"`
+
+	// PassthroughMaxMB caps request bodies (e.g. audio uploads) on the
+	// passthrough endpoints. Defaults to DefaultPassthroughMB.
+	PassthroughMaxMB int `json:"passthrough_max_mb,omitempty"`
+
+	// StrictParams rejects chat requests that set parameters the provider
+	// doesn't support (400), instead of listing them in the
+	// X-PlugMyAI-Ignored-Params response header. Requests can override it
+	// with the X-PlugMyAI-Strict-Params header.
+	StrictParams bool `json:"strict_params,omitempty"`
+
+	// StructuredOutputRetries is how many times a response that doesn't match
+	// the request's response_format is sent back to the model with the
+	// validation errors. Defaults to DefaultStructuredRetries; 0 disables.
+	StructuredOutputRetries *int `json:"structured_output_retries,omitempty"`
+
+	// MaxParallelChoices caps how many of a request's n choices run at
+	// once. Defaults to DefaultParallelChoices.
+	MaxParallelChoices int `json:"max_parallel_choices,omitempty"`
+
+	// BatchConcurrency caps how many batch requests run at once, over all
+	// batches. Defaults to DefaultBatchConcurrency.
+	BatchConcurrency int `json:"batch_concurrency,omitempty"`
+
+	adminToken string // AdminToken with any secret reference resolved
 }
 
 type ProviderConfig struct {
@@ -53,10 +101,79 @@ func Load(configDir string) (*Config, error) {
 	if err := json.Unmarshal(data, &cfg); err != nil {
 		return nil, fmt.Errorf("parsing config: %w", err)
 	}
+	for name, sc := range cfg.MCPServers {
+		if err := sc.Validate(); err != nil {
+			return nil, fmt.Errorf("mcp_servers.%s: %w", name, err)
+		}
+	}
 	cfg.DataDir = configDir
+
+	cfg.adminToken, err = secret.NewResolver(configDir).Resolve(cfg.AdminToken)
+	if err != nil {
+		return nil, fmt.Errorf("admin_token: %w", err)
+	}
 	return &cfg, nil
 }
 
+// ResolvedAdminToken returns the admin token, resolving a secret reference in
+// admin_token. AdminToken itself keeps the reference, so Save never writes
+// the resolved value to disk.
+func (c *Config) ResolvedAdminToken() string {
+	if c.adminToken == "" {
+		return c.AdminToken
+	}
+	return c.adminToken
+}
+
+// ApprovalTimeout returns the tool-call approval timeout.
+func (c *Config) ApprovalTimeout() time.Duration {
+	if c.ApprovalTimeoutS <= 0 {
+		return DefaultApprovalTimeout
+	}
+	return time.Duration(c.ApprovalTimeoutS) * time.Second
+}
+
+// AgentIterations returns the agent loop's turn limit.
+func (c *Config) AgentIterations() int {
+	if c.AgentMaxIterations <= 0 {
+		return DefaultAgentIterations
+	}
+	return c.AgentMaxIterations
+}
+
+// PassthroughMaxBytes returns the request size limit of passthrough endpoints.
+func (c *Config) PassthroughMaxBytes() int64 {
+	if c.PassthroughMaxMB <= 0 {
+		return DefaultPassthroughMB << 20
+	}
+	return int64(c.PassthroughMaxMB) << 20
+}
+
+// StructuredRetries returns how many times to re-prompt for a response
+// matching response_format.
+func (c *Config) StructuredRetries() int {
+	if c.StructuredOutputRetries == nil || *c.StructuredOutputRetries < 0 {
+		return DefaultStructuredRetries
+	}
+	return *c.StructuredOutputRetries
+}
+
+// ParallelChoices returns how many choices of one request may run at once.
+func (c *Config) ParallelChoices() int {
+	if c.MaxParallelChoices <= 0 {
+		return DefaultParallelChoices
+	}
+	return c.MaxParallelChoices
+}
+
+// BatchRequests returns how many batch requests may run at once.
+func (c *Config) BatchRequests() int {
+	if c.BatchConcurrency <= 0 {
+		return DefaultBatchConcurrency
+	}
+	return c.BatchConcurrency
+}
+
 func (c *Config) Save() error {
 	if err := os.MkdirAll(c.DataDir, 0700); err != nil {
 		return fmt.Errorf("creating config dir: %w", err)
@@ -0,0 +1,454 @@
+// Package jsonschema validates JSON values against the subset of JSON Schema
+// used for structured model outputs: types, properties and required,
+// additionalProperties, items, enum and const, string/number/array bounds,
+// pattern, allOf/anyOf/oneOf/not, and local $refs (#/$defs/..., #/definitions/...).
+// Unknown keywords are ignored, as the spec asks.
+package jsonschema
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Schema is a compiled schema. It is safe for concurrent use.
+type Schema struct {
+	root any
+
+	mu       sync.Mutex
+	patterns map[string]*regexp.Regexp
+	refs     map[string]bool // $refs already checked
+}
+
+// Compile parses a schema. It fails on malformed JSON, bad patterns and
+// $refs that don't resolve.
+func Compile(raw json.RawMessage) (*Schema, error) {
+	var root any
+	if err := json.Unmarshal(raw, &root); err != nil {
+		return nil, fmt.Errorf("parsing schema: %w", err)
+	}
+	s := &Schema{root: root, patterns: map[string]*regexp.Regexp{}, refs: map[string]bool{}}
+	if err := s.check(root, "#"); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Keywords whose values are subschemas, by shape. Everything else holds
+// data (enum, const, default, ...) or is unknown, and is not walked: a
+// property named "pattern" is not a pattern.
+var (
+	schemaKeywords     = []string{"items", "additionalItems", "additionalProperties", "not", "if", "then", "else", "contains", "propertyNames", "unevaluatedItems", "unevaluatedProperties"}
+	schemaListKeywords = []string{"allOf", "anyOf", "oneOf", "prefixItems", "items"}
+	schemaMapKeywords  = []string{"properties", "patternProperties", "dependentSchemas", "$defs", "definitions"}
+)
+
+// check compiles patterns and resolves $refs ahead of validation, walking
+// the schema by keyword position.
+func (s *Schema) check(node any, path string) error {
+	sch, ok := node.(map[string]any)
+	if !ok {
+		return nil // booleans, or garbage that validation ignores
+	}
+
+	if p, ok := sch["pattern"].(string); ok {
+		re, err := regexp.Compile(p)
+		if err != nil {
+			return fmt.Errorf("%s/pattern: %w", path, err)
+		}
+		s.patterns[p] = re
+	}
+	if ref, ok := sch["$ref"].(string); ok && !s.refs[ref] {
+		target, err := s.resolve(ref)
+		if err != nil {
+			return fmt.Errorf("%s/$ref: %w", path, err)
+		}
+		// A ref may point outside the places walked below
+		s.refs[ref] = true
+		if err := s.check(target, ref); err != nil {
+			return err
+		}
+	}
+
+	for _, k := range schemaKeywords {
+		if err := s.check(sch[k], path+"/"+k); err != nil {
+			return err
+		}
+	}
+	for _, k := range schemaListKeywords {
+		list, _ := sch[k].([]any)
+		for i, sub := range list {
+			if err := s.check(sub, path+"/"+k+"/"+strconv.Itoa(i)); err != nil {
+				return err
+			}
+		}
+	}
+	for _, k := range schemaMapKeywords {
+		subs, _ := sch[k].(map[string]any)
+		for name, sub := range subs {
+			if err := s.check(sub, path+"/"+k+"/"+name); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// pattern returns the compiled pattern p, compiling it if Compile didn't
+// reach it. It returns nil if p doesn't compile.
+func (s *Schema) pattern(p string) *regexp.Regexp {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	re, ok := s.patterns[p]
+	if !ok {
+		re, _ = regexp.Compile(p)
+		s.patterns[p] = re
+	}
+	return re
+}
+
+func (s *Schema) resolve(ref string) (any, error) {
+	if ref == "#" {
+		return s.root, nil
+	}
+	if !strings.HasPrefix(ref, "#/") {
+		return nil, fmt.Errorf("only local references are supported: %s", ref)
+	}
+	node := s.root
+	for _, tok := range strings.Split(ref[2:], "/") {
+		tok = strings.ReplaceAll(strings.ReplaceAll(tok, "~1", "/"), "~0", "~")
+		m, ok := node.(map[string]any)
+		if !ok {
+			return nil, fmt.Errorf("unresolvable reference %s", ref)
+		}
+		if node, ok = m[tok]; !ok {
+			return nil, fmt.Errorf("unresolvable reference %s", ref)
+		}
+	}
+	return node, nil
+}
+
+// Error lists everything wrong with a value.
+type Error struct {
+	Problems []Problem
+}
+
+// Problem is one validation failure. Path is a JSON pointer into the value.
+type Problem struct {
+	Path    string `json:"path"`
+	Message string `json:"message"`
+}
+
+func (e *Error) Error() string {
+	parts := make([]string, len(e.Problems))
+	for i, p := range e.Problems {
+		parts[i] = p.String()
+	}
+	return strings.Join(parts, "; ")
+}
+
+func (p Problem) String() string {
+	if p.Path == "" {
+		return p.Message
+	}
+	return p.Path + ": " + p.Message
+}
+
+// maxProblems keeps reports readable (they are fed back to models).
+const maxProblems = 20
+
+// Validate checks a decoded JSON value (as produced by encoding/json into an
+// any). It returns nil or an *Error.
+func (s *Schema) Validate(v any) error {
+	var problems []Problem
+	s.validate(s.root, v, "", &problems, 0)
+	if len(problems) == 0 {
+		return nil
+	}
+	if len(problems) > maxProblems {
+		problems = problems[:maxProblems]
+	}
+	return &Error{Problems: problems}
+}
+
+// ValidateJSON decodes data and validates it.
+func (s *Schema) ValidateJSON(data []byte) error {
+	var v any
+	if err := json.Unmarshal(data, &v); err != nil {
+		return &Error{Problems: []Problem{{Message: "not valid JSON: " + err.Error()}}}
+	}
+	return s.Validate(v)
+}
+
+// maxDepth stops runaway recursion through self-referencing schemas.
+const maxDepth = 64
+
+func (s *Schema) validate(node, v any, path string, problems *[]Problem, depth int) {
+	add := func(format string, args ...any) {
+		*problems = append(*problems, Problem{Path: path, Message: fmt.Sprintf(format, args...)})
+	}
+	if depth > maxDepth {
+		add("schema nesting too deep")
+		return
+	}
+
+	switch n := node.(type) {
+	case bool:
+		if !n {
+			add("no value is allowed here")
+		}
+		return
+	case map[string]any:
+	default:
+		return
+	}
+	sch := node.(map[string]any)
+
+	if ref, ok := sch["$ref"].(string); ok {
+		target, _ := s.resolve(ref) // checked by Compile
+		s.validate(target, v, path, problems, depth+1)
+	}
+
+	if t, ok := sch["type"]; ok && !matchesType(t, v) {
+		add("expected %s, got %s", describeType(t), typeOf(v))
+		return // further keywords would only add noise
+	}
+
+	if enum, ok := sch["enum"].([]any); ok {
+		found := false
+		for _, e := range enum {
+			if equal(e, v) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			add("must be one of %s", compact(enum))
+		}
+	}
+	if c, ok := sch["const"]; ok && !equal(c, v) {
+		add("must be %s", compact(c))
+	}
+
+	switch val := v.(type) {
+	case string:
+		n := len([]rune(val))
+		if min, ok := number(sch["minLength"]); ok && float64(n) < min {
+			add("must be at least %v characters", min)
+		}
+		if max, ok := number(sch["maxLength"]); ok && float64(n) > max {
+			add("must be at most %v characters", max)
+		}
+		if p, ok := sch["pattern"].(string); ok {
+			if re := s.pattern(p); re == nil {
+				add("schema pattern %s is invalid", p)
+			} else if !re.MatchString(val) {
+				add("must match pattern %s", p)
+			}
+		}
+	case float64:
+		if min, ok := number(sch["minimum"]); ok && val < min {
+			add("must be >= %v", min)
+		}
+		if max, ok := number(sch["maximum"]); ok && val > max {
+			add("must be <= %v", max)
+		}
+		if min, ok := number(sch["exclusiveMinimum"]); ok && val <= min {
+			add("must be > %v", min)
+		}
+		if max, ok := number(sch["exclusiveMaximum"]); ok && val >= max {
+			add("must be < %v", max)
+		}
+		if m, ok := number(sch["multipleOf"]); ok && m > 0 {
+			if q := val / m; math.Abs(q-math.Round(q)) > 1e-9 {
+				add("must be a multiple of %v", m)
+			}
+		}
+	case []any:
+		if min, ok := number(sch["minItems"]); ok && float64(len(val)) < min {
+			add("must have at least %v items", min)
+		}
+		if max, ok := number(sch["maxItems"]); ok && float64(len(val)) > max {
+			add("must have at most %v items", max)
+		}
+		if unique, _ := sch["uniqueItems"].(bool); unique {
+			for i := range val {
+				for j := i + 1; j < len(val); j++ {
+					if equal(val[i], val[j]) {
+						add("items %d and %d are equal", i, j)
+					}
+				}
+			}
+		}
+		prefix, _ := sch["prefixItems"].([]any)
+		for i, item := range val {
+			itemPath := path + "/" + strconv.Itoa(i)
+			if i < len(prefix) {
+				s.validate(prefix[i], item, itemPath, problems, depth+1)
+			} else if items, ok := sch["items"]; ok {
+				s.validate(items, item, itemPath, problems, depth+1)
+			}
+		}
+	case map[string]any:
+		props, _ := sch["properties"].(map[string]any)
+		if required, ok := sch["required"].([]any); ok {
+			for _, r := range required {
+				if name, ok := r.(string); ok {
+					if _, present := val[name]; !present {
+						add("missing required property %q", name)
+					}
+				}
+			}
+		}
+		if min, ok := number(sch["minProperties"]); ok && float64(len(val)) < min {
+			add("must have at least %v properties", min)
+		}
+		if max, ok := number(sch["maxProperties"]); ok && float64(len(val)) > max {
+			add("must have at most %v properties", max)
+		}
+
+		keys := make([]string, 0, len(val))
+		for k := range val {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			propPath := path + "/" + strings.ReplaceAll(strings.ReplaceAll(k, "~", "~0"), "/", "~1")
+			if ps, ok := props[k]; ok {
+				s.validate(ps, val[k], propPath, problems, depth+1)
+				continue
+			}
+			switch extra := sch["additionalProperties"].(type) {
+			case bool:
+				if !extra {
+					*problems = append(*problems, Problem{Path: propPath, Message: "property is not allowed"})
+				}
+			case map[string]any:
+				s.validate(extra, val[k], propPath, problems, depth+1)
+			}
+		}
+	}
+
+	if all, ok := sch["allOf"].([]any); ok {
+		for _, sub := range all {
+			s.validate(sub, v, path, problems, depth+1)
+		}
+	}
+	if anyOf, ok := sch["anyOf"].([]any); ok && s.matching(anyOf, v, depth) == 0 {
+		add("must match at least one of the anyOf schemas")
+	}
+	if one, ok := sch["oneOf"].([]any); ok {
+		if n := s.matching(one, v, depth); n != 1 {
+			add("must match exactly one of the oneOf schemas (matched %d)", n)
+		}
+	}
+	if not, ok := sch["not"]; ok && s.matching([]any{not}, v, depth) == 1 {
+		add("must not match the not schema")
+	}
+}
+
+// matching counts the schemas v is valid against.
+func (s *Schema) matching(schemas []any, v any, depth int) int {
+	n := 0
+	for _, sub := range schemas {
+		var p []Problem
+		s.validate(sub, v, "", &p, depth+1)
+		if len(p) == 0 {
+			n++
+		}
+	}
+	return n
+}
+
+func matchesType(t, v any) bool {
+	switch t := t.(type) {
+	case string:
+		return isType(t, v)
+	case []any:
+		for _, e := range t {
+			if name, ok := e.(string); ok && isType(name, v) {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+func isType(name string, v any) bool {
+	switch name {
+	case "null":
+		return v == nil
+	case "boolean":
+		_, ok := v.(bool)
+		return ok
+	case "string":
+		_, ok := v.(string)
+		return ok
+	case "number":
+		_, ok := v.(float64)
+		return ok
+	case "integer":
+		f, ok := v.(float64)
+		return ok && f == math.Trunc(f)
+	case "array":
+		_, ok := v.([]any)
+		return ok
+	case "object":
+		_, ok := v.(map[string]any)
+		return ok
+	}
+	return true
+}
+
+func typeOf(v any) string {
+	switch v := v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case string:
+		return "string"
+	case float64:
+		if v == math.Trunc(v) {
+			return "integer"
+		}
+		return "number"
+	case []any:
+		return "array"
+	case map[string]any:
+		return "object"
+	}
+	return fmt.Sprintf("%T", v)
+}
+
+func describeType(t any) string {
+	if list, ok := t.([]any); ok {
+		names := make([]string, len(list))
+		for i, e := range list {
+			names[i] = fmt.Sprint(e)
+		}
+		return strings.Join(names, " or ")
+	}
+	return fmt.Sprint(t)
+}
+
+func number(v any) (float64, bool) {
+	f, ok := v.(float64)
+	return f, ok
+}
+
+func equal(a, b any) bool {
+	return reflect.DeepEqual(a, b)
+}
+
+func compact(v any) string {
+	data, _ := json.Marshal(v)
+	return string(data)
+}
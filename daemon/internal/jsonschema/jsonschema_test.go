@@ -0,0 +1,177 @@
+package jsonschema
+
+import (
+	"strings"
+	"testing"
+)
+
+func mustCompile(t *testing.T, schema string) *Schema {
+	t.Helper()
+	s, err := Compile([]byte(schema))
+	if err != nil {
+		t.Fatalf("Compile(%s): %v", schema, err)
+	}
+	return s
+}
+
+func TestCompileErrors(t *testing.T) {
+	tests := []struct {
+		schema string
+		err    string
+	}{
+		{`{"type":`, "parsing schema"},
+		{`{"pattern": "("}`, "#/pattern"},
+		{`{"properties": {"name": {"pattern": "[a-"}}}`, "#/properties/name/pattern"},
+		{`{"items": [{"pattern": "("}]}`, "#/items/0/pattern"},
+		{`{"$ref": "#/$defs/missing"}`, "unresolvable reference"},
+		{`{"$ref": "https://example.com/schema.json"}`, "only local references"},
+		{`{"anyOf": [{"$ref": "#/definitions/x"}], "definitions": {"x": {"pattern": "("}}}`, "#/definitions/x/pattern"},
+	}
+	for _, tt := range tests {
+		_, err := Compile([]byte(tt.schema))
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("Compile(%s) = %v, want an error containing %q", tt.schema, err, tt.err)
+		}
+	}
+}
+
+// Data keywords and property names are not schemas: nothing in them is
+// compiled, whatever it looks like.
+func TestCompileSkipsData(t *testing.T) {
+	for _, schema := range []string{
+		`{"enum": [{"pattern": "("}]}`,
+		`{"const": {"pattern": "("}}`,
+		`{"default": {"pattern": "("}, "examples": [{"pattern": "("}]}`,
+		`{"properties": {"pattern": {"type": "string"}, "enum": {"type": "string"}}}`,
+		`{"x-vendor": {"pattern": "("}}`,
+	} {
+		if _, err := Compile([]byte(schema)); err != nil {
+			t.Errorf("Compile(%s): %v", schema, err)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		schema string
+		value  string
+		errs   []string // problems, in order; none means valid
+	}{
+		{
+			name:   "property named like a keyword",
+			schema: `{"properties": {"enum": {"type": "string", "pattern": "^a"}}}`,
+			value:  `{"enum": "b"}`,
+			errs:   []string{"/enum: must match pattern ^a"},
+		},
+		{
+			name:   "property named like a keyword, valid",
+			schema: `{"properties": {"enum": {"type": "string", "pattern": "^a"}}}`,
+			value:  `{"enum": "abc"}`,
+		},
+		{
+			name:   "types",
+			schema: `{"type": "object", "properties": {"n": {"type": "integer"}, "s": {"type": ["string", "null"]}}}`,
+			value:  `{"n": 1.5, "s": null}`,
+			errs:   []string{"/n: expected integer, got number"},
+		},
+		{
+			name:   "required and additionalProperties",
+			schema: `{"type": "object", "properties": {"a": {}}, "required": ["a", "b"], "additionalProperties": false}`,
+			value:  `{"a": 1, "c": 2}`,
+			errs:   []string{`missing required property "b"`, "/c: property is not allowed"},
+		},
+		{
+			name:   "enum and const",
+			schema: `{"properties": {"color": {"enum": ["red", "green"]}, "v": {"const": 2}}}`,
+			value:  `{"color": "blue", "v": 3}`,
+			errs:   []string{`/color: must be one of ["red","green"]`, "/v: must be 2"},
+		},
+		{
+			name:   "bounds",
+			schema: `{"properties": {"s": {"minLength": 3}, "n": {"maximum": 10, "multipleOf": 2}, "l": {"maxItems": 1, "uniqueItems": true}}}`,
+			value:  `{"s": "hé", "n": 11, "l": [1, 1]}`,
+			errs: []string{
+				"/l: must have at most 1 items",
+				"/l: items 0 and 1 are equal",
+				"/n: must be <= 10",
+				"/n: must be a multiple of 2",
+				"/s: must be at least 3 characters",
+			},
+		},
+		{
+			name:   "items and prefixItems",
+			schema: `{"prefixItems": [{"type": "string"}], "items": {"type": "number"}}`,
+			value:  `["a", 1, "b"]`,
+			errs:   []string{"/2: expected number, got string"},
+		},
+		{
+			name:   "pattern reached through a $ref",
+			schema: `{"$defs": {"id": {"type": "string", "pattern": "^[0-9]+$"}}, "items": {"$ref": "#/$defs/id"}}`,
+			value:  `["12", "x"]`,
+			errs:   []string{"/1: must match pattern ^[0-9]+$"},
+		},
+		{
+			name:   "$ref outside the definitions",
+			schema: `{"x-shapes": {"code": {"pattern": "^[A-Z]{2}$"}}, "properties": {"country": {"$ref": "#/x-shapes/code"}}}`,
+			value:  `{"country": "usa"}`,
+			errs:   []string{"/country: must match pattern ^[A-Z]{2}$"},
+		},
+		{
+			name:   "recursive $ref",
+			schema: `{"type": "object", "properties": {"name": {"type": "string"}, "children": {"type": "array", "items": {"$ref": "#"}}}}`,
+			value:  `{"name": "a", "children": [{"name": "b", "children": [{"name": 3}]}]}`,
+			errs:   []string{"/children/0/children/0/name: expected string, got integer"},
+		},
+		{
+			name:   "combinators",
+			schema: `{"properties": {"a": {"anyOf": [{"type": "string"}, {"type": "null"}]}, "o": {"oneOf": [{"type": "number"}, {"type": "integer"}]}, "n": {"not": {"type": "string"}}}}`,
+			value:  `{"a": 1, "o": 2, "n": "x"}`,
+			errs: []string{
+				"/a: must match at least one of the anyOf schemas",
+				"/n: must not match the not schema",
+				"/o: must match exactly one of the oneOf schemas (matched 2)",
+			},
+		},
+		{
+			name:   "false schema",
+			schema: `{"properties": {"never": false}}`,
+			value:  `{"never": 1}`,
+			errs:   []string{"/never: no value is allowed here"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := mustCompile(t, tt.schema).ValidateJSON([]byte(tt.value))
+			var got []string
+			if err != nil {
+				verr, ok := err.(*Error)
+				if !ok {
+					t.Fatalf("got %T, want *Error", err)
+				}
+				for _, p := range verr.Problems {
+					got = append(got, p.String())
+				}
+			}
+			if strings.Join(got, "\n") != strings.Join(tt.errs, "\n") {
+				t.Errorf("problems:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(tt.errs, "\n"))
+			}
+		})
+	}
+}
+
+func TestValidateJSONMalformed(t *testing.T) {
+	err := mustCompile(t, `{}`).ValidateJSON([]byte(`{"a":`))
+	if err == nil || !strings.Contains(err.Error(), "not valid JSON") {
+		t.Errorf("got %v, want a not valid JSON problem", err)
+	}
+}
+
+func TestMaxProblems(t *testing.T) {
+	s := mustCompile(t, `{"items": {"type": "string"}}`)
+	err := s.ValidateJSON([]byte(`[` + strings.Repeat(`1,`, 50) + `1]`))
+	if verr, ok := err.(*Error); !ok || len(verr.Problems) != maxProblems {
+		t.Errorf("got %v, want %d problems", err, maxProblems)
+	}
+}
@@ -0,0 +1,148 @@
+package mcp
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"sync/atomic"
+)
+
+// Client is a connection to one MCP server, used by the daemon's agent loop
+// to list and call the server's tools.
+type Client struct {
+	name   string
+	conn   conn
+	nextID atomic.Int64
+}
+
+// conn carries JSON-RPC messages to a server over one transport.
+type conn interface {
+	// call sends a request and waits for its response.
+	call(ctx context.Context, req *Request) (*message, error)
+	// notify sends a notification.
+	notify(ctx context.Context, req *Request) error
+	close() error
+}
+
+// message is any JSON-RPC message received from a server: a response to one
+// of our requests, or a request/notification of its own.
+type message struct {
+	ID     json.RawMessage `json:"id,omitempty"`
+	Method string          `json:"method,omitempty"`
+	Result json.RawMessage `json:"result,omitempty"`
+	Error  *RPCError       `json:"error,omitempty"`
+}
+
+// Dial connects to the server described by cfg and performs the MCP
+// initialize handshake. env is the base environment for stdio servers;
+// cfg.Env is added on top. The caller must Close the client.
+func Dial(ctx context.Context, name string, cfg ServerConfig, env []string) (*Client, error) {
+	var c conn
+	var err error
+	switch cfg.Transport() {
+	case "stdio":
+		c, err = dialStdio(cfg, env)
+	case "http":
+		c, err = dialHTTP(cfg)
+	default:
+		return nil, fmt.Errorf("mcp %s: transport %q is not supported by the daemon", name, cfg.Transport())
+	}
+	if err != nil {
+		return nil, fmt.Errorf("mcp %s: %w", name, err)
+	}
+
+	client := &Client{name: name, conn: c}
+	if err := client.initialize(ctx); err != nil {
+		c.close()
+		return nil, fmt.Errorf("mcp %s: initialize: %w", name, err)
+	}
+	return client, nil
+}
+
+// Name returns the server's name from config.
+func (c *Client) Name() string { return c.name }
+
+func (c *Client) initialize(ctx context.Context) error {
+	var result struct {
+		ProtocolVersion string `json:"protocolVersion"`
+	}
+	err := c.request(ctx, "initialize", map[string]any{
+		"protocolVersion": ProtocolVersion,
+		"capabilities":    map[string]any{},
+		"clientInfo":      map[string]any{"name": "plug-my-ai", "version": "0.1.0"},
+	}, &result)
+	if err != nil {
+		return err
+	}
+	if h, ok := c.conn.(*httpConn); ok {
+		h.setProtocolVersion(result.ProtocolVersion)
+	}
+	return c.conn.notify(ctx, &Request{JSONRPC: "2.0", Method: "notifications/initialized"})
+}
+
+// ListTools returns all tools offered by the server, following pagination.
+func (c *Client) ListTools(ctx context.Context) ([]Tool, error) {
+	var tools []Tool
+	cursor := ""
+	for {
+		params := map[string]any{}
+		if cursor != "" {
+			params["cursor"] = cursor
+		}
+		var page struct {
+			Tools      []Tool `json:"tools"`
+			NextCursor string `json:"nextCursor"`
+		}
+		if err := c.request(ctx, "tools/list", params, &page); err != nil {
+			return nil, fmt.Errorf("mcp %s: tools/list: %w", c.name, err)
+		}
+		tools = append(tools, page.Tools...)
+		if page.NextCursor == "" {
+			return tools, nil
+		}
+		cursor = page.NextCursor
+	}
+}
+
+// CallTool runs a tool. A tool that fails reports it in the result
+// (IsError); the error return is for protocol and transport failures.
+func (c *Client) CallTool(ctx context.Context, tool string, args json.RawMessage) (*CallToolResult, error) {
+	if len(args) == 0 {
+		args = json.RawMessage("{}")
+	}
+	var result CallToolResult
+	if err := c.request(ctx, "tools/call", CallToolParams{Name: tool, Arguments: args}, &result); err != nil {
+		return nil, fmt.Errorf("mcp %s: tools/call %s: %w", c.name, tool, err)
+	}
+	return &result, nil
+}
+
+// Close shuts the connection down (and the server process, for stdio).
+func (c *Client) Close() error {
+	return c.conn.close()
+}
+
+func (c *Client) request(ctx context.Context, method string, params, result any) error {
+	raw, err := json.Marshal(params)
+	if err != nil {
+		return err
+	}
+	id := c.nextID.Add(1)
+	resp, err := c.conn.call(ctx, &Request{
+		JSONRPC: "2.0",
+		ID:      json.RawMessage(strconv.FormatInt(id, 10)),
+		Method:  method,
+		Params:  raw,
+	})
+	if err != nil {
+		return err
+	}
+	if resp.Error != nil {
+		return resp.Error
+	}
+	if result == nil || len(resp.Result) == 0 {
+		return nil
+	}
+	return json.Unmarshal(resp.Result, result)
+}
@@ -0,0 +1,42 @@
+// Package mcp holds Model Context Protocol types shared by the daemon's
+// config, its providers and the server: server definitions and the JSON-RPC
+// messages of the protocol itself.
+package mcp
+
+import "fmt"
+
+// ServerConfig describes how to reach an MCP server. The JSON layout matches
+// Claude Code's --mcp-config entries, so definitions can be passed through as-is.
+type ServerConfig struct {
+	Type    string            `json:"type,omitempty"`    // "stdio" (default), "http" or "sse"
+	Command string            `json:"command,omitempty"` // stdio: executable to spawn
+	Args    []string          `json:"args,omitempty"`    // stdio: arguments
+	Env     map[string]string `json:"env,omitempty"`     // stdio: extra environment
+	URL     string            `json:"url,omitempty"`     // http/sse: endpoint
+	Headers map[string]string `json:"headers,omitempty"` // http/sse: request headers
+}
+
+// Transport returns the server's transport, defaulting to "stdio".
+func (c ServerConfig) Transport() string {
+	if c.Type == "" {
+		return "stdio"
+	}
+	return c.Type
+}
+
+// Validate checks the fields required by the server's transport.
+func (c ServerConfig) Validate() error {
+	switch c.Transport() {
+	case "stdio":
+		if c.Command == "" {
+			return fmt.Errorf("stdio server needs a command")
+		}
+	case "http", "sse":
+		if c.URL == "" {
+			return fmt.Errorf("%s server needs a url", c.Type)
+		}
+	default:
+		return fmt.Errorf("unknown transport %q", c.Type)
+	}
+	return nil
+}
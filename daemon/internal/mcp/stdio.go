@@ -0,0 +1,164 @@
+package mcp
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os/exec"
+	"sync"
+	"time"
+)
+
+// stdioConn talks to a server process over newline-delimited JSON on its
+// stdin/stdout.
+type stdioConn struct {
+	cmd   *exec.Cmd
+	stdin io.WriteCloser
+
+	writeMu sync.Mutex
+	mu      sync.Mutex
+	waiting map[string]chan *message // request ID → response
+	err     error                    // set once the server's stdout closes
+	done    chan struct{}
+}
+
+func dialStdio(cfg ServerConfig, env []string) (*stdioConn, error) {
+	cmd := exec.Command(cfg.Command, cfg.Args...)
+	cmd.Env = env
+	for k, v := range cfg.Env {
+		cmd.Env = append(cmd.Env, k+"="+v)
+	}
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("starting %s: %w", cfg.Command, err)
+	}
+
+	c := &stdioConn{
+		cmd:     cmd,
+		stdin:   stdin,
+		waiting: map[string]chan *message{},
+		done:    make(chan struct{}),
+	}
+	go c.readLoop(stdout)
+	return c, nil
+}
+
+func (c *stdioConn) readLoop(stdout io.Reader) {
+	scanner := bufio.NewScanner(stdout)
+	scanner.Buffer(make([]byte, 1024*1024), 16*1024*1024)
+
+	for scanner.Scan() {
+		var msg message
+		if err := json.Unmarshal(scanner.Bytes(), &msg); err != nil {
+			continue
+		}
+		if msg.Method != "" {
+			// A request or notification from the server
+			if len(msg.ID) > 0 {
+				c.replyToServer(&msg)
+			}
+			continue
+		}
+
+		c.mu.Lock()
+		ch, ok := c.waiting[string(msg.ID)]
+		delete(c.waiting, string(msg.ID))
+		c.mu.Unlock()
+		if ok {
+			ch <- &msg
+		}
+	}
+
+	c.mu.Lock()
+	c.err = fmt.Errorf("server exited")
+	if err := scanner.Err(); err != nil {
+		c.err = fmt.Errorf("reading server output: %w", err)
+	}
+	c.mu.Unlock()
+	close(c.done)
+}
+
+// replyToServer answers requests the server sends us. The daemon offers no
+// client capabilities, so only ping succeeds.
+func (c *stdioConn) replyToServer(msg *message) {
+	resp := Response{JSONRPC: "2.0", ID: msg.ID}
+	if msg.Method == "ping" {
+		resp.Result = map[string]any{}
+	} else {
+		resp.Error = &RPCError{Code: CodeMethodNotFound, Message: "method not found: " + msg.Method}
+	}
+	c.write(resp)
+}
+
+func (c *stdioConn) write(v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	_, err = c.stdin.Write(append(data, '\n'))
+	return err
+}
+
+func (c *stdioConn) call(ctx context.Context, req *Request) (*message, error) {
+	ch := make(chan *message, 1)
+	c.mu.Lock()
+	if c.err != nil {
+		err := c.err
+		c.mu.Unlock()
+		return nil, err
+	}
+	c.waiting[string(req.ID)] = ch
+	c.mu.Unlock()
+
+	forget := func() {
+		c.mu.Lock()
+		delete(c.waiting, string(req.ID))
+		c.mu.Unlock()
+	}
+
+	if err := c.write(req); err != nil {
+		forget()
+		return nil, err
+	}
+
+	select {
+	case msg := <-ch:
+		return msg, nil
+	case <-c.done:
+		forget()
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		return nil, c.err
+	case <-ctx.Done():
+		forget()
+		return nil, ctx.Err()
+	}
+}
+
+func (c *stdioConn) notify(ctx context.Context, req *Request) error {
+	return c.write(req)
+}
+
+// close ends the session by closing stdin, as the spec asks, and kills the
+// process if it hasn't exited shortly after.
+func (c *stdioConn) close() error {
+	c.stdin.Close()
+	select {
+	case <-c.done:
+	case <-time.After(2 * time.Second):
+		c.cmd.Process.Kill()
+	}
+	return c.cmd.Wait()
+}
@@ -5,9 +5,14 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"os"
 	"os/exec"
+	"path/filepath"
+	"sort"
 	"strings"
+	"time"
 
+	"plugmyai/internal/mcp"
 	"plugmyai/internal/provider"
 )
 
@@ -15,6 +20,9 @@ import (
 type Config struct {
 	CLIPath string `json:"cli_path,omitempty"` // defaults to "claude" in PATH
 	Model   string `json:"model,omitempty"`    // defaults to whatever claude uses
+	// Env lists extra environment variable names passed to the CLI on top of
+	// provider.DefaultEnvAllowlist (e.g. "ANTHROPIC_API_KEY").
+	Env []string `json:"env,omitempty"`
 }
 
 func init() {
@@ -29,7 +37,9 @@ func Factory(rawConfig json.RawMessage) (provider.Provider, error) {
 			return nil, fmt.Errorf("parsing claude-code config: %w", err)
 		}
 	}
-	return New(cfg.CLIPath, cfg.Model), nil
+	p := New(cfg.CLIPath, cfg.Model)
+	p.env = cfg.Env
+	return p, nil
 }
 
 // Provider routes requests through the Claude Code CLI.
@@ -37,6 +47,7 @@ func Factory(rawConfig json.RawMessage) (provider.Provider, error) {
 type Provider struct {
 	cliPath string
 	model   string
+	env     []string // extra env var names allowed through to the CLI
 }
 
 // cliMessage represents a line of NDJSON output from `claude --output-format stream-json --verbose`.
@@ -44,26 +55,35 @@ type Provider struct {
 // Key message types from the CLI:
 //   - "assistant": full response in message.content[].text
 //   - "content_block_delta": incremental text in delta.text (may appear for longer responses)
-//   - "result": final summary with result text + usage stats
+//   - "result": final summary with result text + usage stats; subtype
+//     "error_max_turns" when the CLI's turn limit cut the run short
 //   - "error": error description in content
 //   - "system": hooks/init info (ignored)
 type cliMessage struct {
 	Type    string `json:"type"`
 	Content string `json:"content"` // used by error messages
 	Result  string `json:"result"`  // full text on type=result
+	Subtype string `json:"subtype"` // on type=result: "success", "error_max_turns", ...
+
+	// Why the model stopped, on assistant messages (message.stop_reason) and
+	// on result messages of recent CLIs: end_turn, max_tokens, refusal, ...
+	StopReason string `json:"stop_reason"`
 
 	// assistant message envelope
 	Message *struct {
 		Content []struct {
-			Type string `json:"type"`
-			Text string `json:"text"`
+			Type     string `json:"type"`
+			Text     string `json:"text"`
+			Thinking string `json:"thinking"` // type=thinking
 		} `json:"content"`
+		StopReason string `json:"stop_reason"`
 	} `json:"message,omitempty"`
 
 	// content_block_delta incremental text
 	Delta *struct {
-		Type string `json:"type"`
-		Text string `json:"text"`
+		Type     string `json:"type"`
+		Text     string `json:"text"`
+		Thinking string `json:"thinking"` // type=thinking_delta
 	} `json:"delta,omitempty"`
 
 	// Usage (top-level on result messages)
@@ -102,6 +122,23 @@ func (p *Provider) Models() []provider.Model {
 	return models
 }
 
+// UsesWorkspace reports that the CLI is an agent working in req.Workspace.
+func (p *Provider) UsesWorkspace() bool { return true }
+
+// SupportedParams lists the request parameters the CLI honours.
+func (p *Provider) SupportedParams() []string {
+	return []string{provider.ParamReasoningEffort}
+}
+
+// thinkingBudgets maps reasoning_effort onto Claude Code's extended thinking
+// budget (MAX_THINKING_TOKENS).
+var thinkingBudgets = map[string]int{
+	"minimal": 1024,
+	"low":     4000,
+	"medium":  10000,
+	"high":    31999,
+}
+
 func (p *Provider) Complete(ctx context.Context, req *provider.ChatCompletionRequest) (<-chan provider.ChatCompletionChunk, error) {
 	prompt := buildPrompt(req.Messages)
 
@@ -113,19 +150,80 @@ func (p *Provider) Complete(ctx context.Context, req *provider.ChatCompletionReq
 	if p.model != "" {
 		args = append(args, "--model", p.model)
 	}
-	// Chat scope: disable all tools (LLM-only, no filesystem/shell access)
-	if req.Scope == "" || req.Scope == "chat" {
-		args = append(args, "--allowedTools", "")
+	// Tools of granted MCP servers stay usable even when other tools are restricted
+	var mcpTools []string
+	for name := range req.MCPServers {
+		mcpTools = append(mcpTools, "mcp__"+name)
+	}
+	sort.Strings(mcpTools)
+
+	switch {
+	case req.Tools != nil:
+		// Per-app tool policy overrides the coarse scope
+		allow := append(append([]string{}, req.Tools.Allow...), mcpTools...)
+		args = append(args, "--allowedTools", strings.Join(allow, ","))
+		if len(req.Tools.Deny) > 0 {
+			args = append(args, "--disallowedTools", strings.Join(req.Tools.Deny, ","))
+		}
+	case req.Scope == "" || req.Scope == "chat":
+		// Chat scope: disable all tools (LLM-only, no filesystem/shell access)
+		args = append(args, "--allowedTools", strings.Join(mcpTools, ","))
+	}
+
+	cliPath, err := exec.LookPath(p.cliPath)
+	if err != nil {
+		return nil, fmt.Errorf("claude CLI not found: %w", err)
+	}
+	readOnly := provider.InstallPaths(cliPath)
+	if req.Approval != nil {
+		// Route matching tool calls through the daemon's approval hook
+		args = append(args, "--settings", hookSettings(req.Approval))
+		readOnly = append(readOnly, filepath.Dir(req.Approval.Executable))
+	}
+
+	// Granted MCP servers only: a per-run config file plus --strict-mcp-config
+	// so the user's global MCP servers are not loaded.
+	mcpConfig := ""
+	if req.MCPServers != nil {
+		mcpConfig, err = writeMCPConfig(req.MCPServers)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, "--mcp-config", mcpConfig, "--strict-mcp-config")
+		readOnly = append(readOnly, mcpConfig)
+	}
+	cleanup := func() {
+		if mcpConfig != "" {
+			os.Remove(mcpConfig)
+		}
 	}
 
-	cmd := exec.CommandContext(ctx, p.cliPath, args...)
+	env := provider.CLIEnv(p.env)
+	if budget, ok := thinkingBudgets[req.ReasoningEffort]; ok {
+		env = append(env, fmt.Sprintf("MAX_THINKING_TOKENS=%d", budget))
+	}
+
+	cmd, err := provider.Command(ctx, provider.CommandSpec{
+		Path:     cliPath,
+		Args:     args,
+		Dir:      req.Workspace,
+		Env:      env,
+		ReadOnly: readOnly,
+		Writable: stateDirs(),
+	}, req.Sandbox)
+	if err != nil {
+		cleanup()
+		return nil, err
+	}
 
 	stdout, err := cmd.StdoutPipe()
 	if err != nil {
+		cleanup()
 		return nil, fmt.Errorf("creating stdout pipe: %w", err)
 	}
 
 	if err := cmd.Start(); err != nil {
+		cleanup()
 		return nil, fmt.Errorf("starting claude CLI: %w", err)
 	}
 
@@ -133,11 +231,15 @@ func (p *Provider) Complete(ctx context.Context, req *provider.ChatCompletionReq
 
 	go func() {
 		defer close(ch)
+		defer cleanup()
 		defer cmd.Wait()
 
 		scanner := bufio.NewScanner(stdout)
 		scanner.Buffer(make([]byte, 1024*1024), 1024*1024) // 1MB buffer for long lines
 
+		sawDone, sawError := false, false
+		stopReason := "" // of the last assistant message, for CLIs that leave it off the result
+
 		for scanner.Scan() {
 			line := strings.TrimSpace(scanner.Text())
 			if line == "" {
@@ -149,9 +251,20 @@ func (p *Provider) Complete(ctx context.Context, req *provider.ChatCompletionReq
 				// Skip unparseable lines
 				continue
 			}
+			if msg.Message != nil && msg.Message.StopReason != "" {
+				stopReason = msg.Message.StopReason
+			}
+			if msg.Type == "result" && msg.StopReason == "" {
+				msg.StopReason = stopReason
+			}
 
 			chunk := parseMessage(msg)
 			if chunk != nil {
+				if chunk.Done && sawDone {
+					continue // exactly one Done per stream
+				}
+				sawDone = sawDone || chunk.Done
+				sawError = sawError || chunk.Error != nil
 				select {
 				case ch <- *chunk:
 				case <-ctx.Done():
@@ -165,6 +278,13 @@ func (p *Provider) Complete(ctx context.Context, req *provider.ChatCompletionReq
 			case ch <- provider.ChatCompletionChunk{Error: err}:
 			case <-ctx.Done():
 			}
+			return
+		}
+		if !sawDone && !sawError && ctx.Err() == nil {
+			select {
+			case ch <- provider.ChatCompletionChunk{Error: fmt.Errorf("claude CLI exited without a result")}:
+			case <-ctx.Done():
+			}
 		}
 	}()
 
@@ -175,30 +295,34 @@ func parseMessage(msg cliMessage) *provider.ChatCompletionChunk {
 	switch msg.Type {
 	case "assistant":
 		// Content is nested: message.content[].text
+		// Thinking blocks are the model's reasoning, kept apart from the text
 		if msg.Message != nil {
-			var text string
+			var text, thinking string
 			for _, block := range msg.Message.Content {
-				if block.Type == "text" {
+				switch block.Type {
+				case "text":
 					text += block.Text
+				case "thinking":
+					thinking += block.Thinking
 				}
 			}
-			if text != "" {
-				return &provider.ChatCompletionChunk{Content: text}
+			if text != "" || thinking != "" {
+				return &provider.ChatCompletionChunk{Content: text, Reasoning: thinking}
 			}
 		}
 		return nil
 
 	case "content_block_delta":
 		// Incremental text in delta.text (may appear for longer responses)
-		if msg.Delta != nil && msg.Delta.Text != "" {
-			return &provider.ChatCompletionChunk{Content: msg.Delta.Text}
+		if msg.Delta != nil && (msg.Delta.Text != "" || msg.Delta.Thinking != "") {
+			return &provider.ChatCompletionChunk{Content: msg.Delta.Text, Reasoning: msg.Delta.Thinking}
 		}
 		return nil
 
 	case "result":
 		chunk := &provider.ChatCompletionChunk{
 			Done:         true,
-			FinishReason: "stop",
+			FinishReason: finishReason(msg.StopReason, msg.Subtype),
 		}
 		if msg.Usage != nil {
 			chunk.Usage = &provider.Usage{
@@ -220,6 +344,67 @@ func parseMessage(msg cliMessage) *provider.ChatCompletionChunk {
 	}
 }
 
+// finishReason maps the CLI's stop reason and result subtype to OpenAI's
+// finish_reason.
+func finishReason(stopReason, subtype string) string {
+	if subtype == "error_max_turns" {
+		return "length"
+	}
+	switch stopReason {
+	case "max_tokens", "model_context_window_exceeded":
+		return "length"
+	case "refusal":
+		return "content_filter"
+	default:
+		return "stop"
+	}
+}
+
+// hookSettings returns a --settings JSON string that installs the approval
+// hook as a PreToolUse command hook for the tools that need approval.
+func hookSettings(h *provider.ApprovalHook) string {
+	// Give the hook a little longer than the daemon's own approval timeout
+	// so the daemon's deny decision is the one that lands.
+	timeout := int((h.Timeout + 10*time.Second).Seconds())
+
+	settings := map[string]any{
+		"hooks": map[string]any{
+			"PreToolUse": []map[string]any{
+				{
+					"matcher": h.Matcher(),
+					"hooks": []map[string]any{
+						{"type": "command", "command": h.ShellCommand(), "timeout": timeout},
+					},
+				},
+			},
+		},
+	}
+	data, _ := json.Marshal(settings)
+	return string(data)
+}
+
+// writeMCPConfig writes servers to a temporary --mcp-config file and returns
+// its path. The file may hold credentials (headers, env), so it is 0600 and
+// removed when the run ends.
+func writeMCPConfig(servers map[string]mcp.ServerConfig) (string, error) {
+	data, err := json.Marshal(map[string]any{"mcpServers": servers})
+	if err != nil {
+		return "", fmt.Errorf("marshaling MCP config: %w", err)
+	}
+
+	f, err := os.CreateTemp("", "plugmyai-mcp-*.json")
+	if err != nil {
+		return "", fmt.Errorf("creating MCP config: %w", err)
+	}
+	defer f.Close()
+
+	if _, err := f.Write(data); err != nil {
+		os.Remove(f.Name())
+		return "", fmt.Errorf("writing MCP config: %w", err)
+	}
+	return f.Name(), nil
+}
+
 // buildPrompt converts OpenAI-style messages into a single prompt string for the CLI.
 func buildPrompt(messages []provider.Message) string {
 	if len(messages) == 1 {
@@ -241,3 +426,16 @@ func buildPrompt(messages []provider.Message) string {
 	}
 	return strings.Join(parts, "\n\n")
 }
+
+// stateDirs returns the Claude CLI's session and credential state, which must
+// stay writable when the CLI runs sandboxed.
+func stateDirs() []string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return nil
+	}
+	return []string{
+		filepath.Join(home, ".claude"),
+		filepath.Join(home, ".claude.json"),
+	}
+}
@@ -0,0 +1,70 @@
+package claude
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"plugmyai/internal/provider"
+	"plugmyai/internal/provider/providertest"
+)
+
+func TestConformance(t *testing.T) {
+	pidFile := filepath.Join(t.TempDir(), "cli.pid")
+
+	ok := []string{
+		`{"type":"system","subtype":"init","session_id":"s1"}`,
+		`{"type":"assistant","message":{"content":[{"type":"thinking","thinking":"Greeting."},{"type":"text","text":"Hello!"}],"stop_reason":"end_turn"}}`,
+		`{"type":"result","subtype":"success","result":"Hello!","usage":{"input_tokens":9,"output_tokens":3}}`,
+	}
+	slow := []string{
+		`{"type":"content_block_delta","delta":{"type":"text_delta","text":"one "}}`,
+		`{"type":"content_block_delta","delta":{"type":"text_delta","text":"two "}}`,
+		`{"type":"content_block_delta","delta":{"type":"text_delta","text":"three"}}`,
+		`{"type":"result","subtype":"success","result":"one two three"}`,
+	}
+	failing := []string{
+		`{"type":"error","content":"not logged in"}`,
+	}
+	cli := providertest.FakeCLI(t, "claude", `case "$*" in
+*SLOW*)
+`+providertest.NDJSON(slow, 2*time.Second, pidFile)+`;;
+*FAIL*)
+`+providertest.NDJSON(failing, 0, "")+`;;
+*)
+`+providertest.NDJSON(ok, 0, "")+`;;
+esac
+`)
+
+	providertest.Run(t, New(cli, "sonnet"), providertest.Options{
+		Request:        request("Say hello"),
+		SlowRequest:    request("SLOW count to three"),
+		PIDFile:        pidFile,
+		FailingRequest: request("FAIL please"),
+	})
+}
+
+func TestFinishReason(t *testing.T) {
+	tests := []struct {
+		stopReason, subtype, want string
+	}{
+		{"end_turn", "success", "stop"},
+		{"", "success", "stop"},
+		{"max_tokens", "success", "length"},
+		{"model_context_window_exceeded", "", "length"},
+		{"refusal", "success", "content_filter"},
+		{"end_turn", "error_max_turns", "length"},
+	}
+	for _, tt := range tests {
+		if got := finishReason(tt.stopReason, tt.subtype); got != tt.want {
+			t.Errorf("finishReason(%q, %q) = %q, want %q", tt.stopReason, tt.subtype, got, tt.want)
+		}
+	}
+}
+
+func request(prompt string) *provider.ChatCompletionRequest {
+	return &provider.ChatCompletionRequest{
+		Model:    "claude-code",
+		Messages: []provider.Message{{Role: "user", Content: prompt}},
+	}
+}
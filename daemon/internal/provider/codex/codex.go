@@ -5,8 +5,13 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"log"
+	"os"
 	"os/exec"
+	"path/filepath"
 	"strings"
+	"sync"
+	"time"
 
 	"plugmyai/internal/provider"
 )
@@ -15,6 +20,9 @@ import (
 type Config struct {
 	CLIPath string `json:"cli_path,omitempty"` // defaults to "codex" in PATH
 	Model   string `json:"model,omitempty"`
+	// Env lists extra environment variable names passed to the CLI on top of
+	// provider.DefaultEnvAllowlist (e.g. "OPENAI_API_KEY").
+	Env []string `json:"env,omitempty"`
 }
 
 func init() {
@@ -29,27 +37,22 @@ func Factory(rawConfig json.RawMessage) (provider.Provider, error) {
 			return nil, fmt.Errorf("parsing codex config: %w", err)
 		}
 	}
-	return New(cfg.CLIPath, cfg.Model), nil
+	p := New(cfg.CLIPath, cfg.Model)
+	p.env = cfg.Env
+	return p, nil
 }
 
 // Provider routes requests through the Codex CLI.
 type Provider struct {
 	cliPath string
 	model   string
-}
+	env     []string // extra env var names allowed through to the CLI
+
+	versionOnce sync.Once
+	versionMu   sync.Mutex
+	version     string // `codex --version`, detected once the CLI is found
 
-// cliEvent represents a line of NDJSON output from `codex exec --json`.
-type cliEvent struct {
-	Type string `json:"type"`
-	// For response.output_text.delta
-	Delta string `json:"delta,omitempty"`
-	// For response.completed
-	Usage *struct {
-		InputTokens  int `json:"input_tokens"`
-		OutputTokens int `json:"output_tokens"`
-	} `json:"usage,omitempty"`
-	// For error events
-	Message string `json:"message,omitempty"`
+	warned sync.Map // event types already reported as unrecognised
 }
 
 func New(cliPath, model string) *Provider {
@@ -64,7 +67,11 @@ func (p *Provider) Name() string { return "Codex" }
 
 func (p *Provider) Available() bool {
 	path, err := exec.LookPath(p.cliPath)
-	return err == nil && path != ""
+	if err != nil || path == "" {
+		return false
+	}
+	p.versionOnce.Do(func() { go p.detectVersion() })
+	return true
 }
 
 func (p *Provider) Models() []provider.Model {
@@ -81,6 +88,14 @@ func (p *Provider) Models() []provider.Model {
 	return models
 }
 
+// UsesWorkspace reports that codex exec runs as an agent in req.Workspace.
+func (p *Provider) UsesWorkspace() bool { return true }
+
+// SupportedParams lists the request parameters the CLI honours.
+func (p *Provider) SupportedParams() []string {
+	return []string{provider.ParamReasoningEffort}
+}
+
 func (p *Provider) Complete(ctx context.Context, req *provider.ChatCompletionRequest) (<-chan provider.ChatCompletionChunk, error) {
 	prompt := buildPrompt(req.Messages)
 
@@ -88,12 +103,45 @@ func (p *Provider) Complete(ctx context.Context, req *provider.ChatCompletionReq
 	if p.model != "" {
 		args = append(args, "--model", p.model)
 	}
-	// Full scope: grant full auto-approval for tools; chat scope: use default (suggest mode)
-	if req.Scope == "full" {
+	if req.ReasoningEffort != "" {
+		args = append(args, "-c", "model_reasoning_effort="+req.ReasoningEffort)
+	}
+	switch {
+	case req.Approval != nil:
+		// Codex exec has no approval hook; without a human checkpoint, keep it read-only
+		args = append(args, "--sandbox", "read-only")
+	case req.Tools != nil:
+		// Codex has no per-tool switches; map the policy onto its sandbox modes.
+		// Any write-capable tool → workspace-write with auto-approval, else read-only.
+		if req.Tools.AllowsAny(provider.WriteTools) {
+			args = append(args, "--full-auto")
+		} else {
+			args = append(args, "--sandbox", "read-only")
+		}
+	case req.Scope == "full":
+		// Full scope: grant full auto-approval for tools; chat scope: use default (suggest mode)
 		args = append(args, "--full-auto")
 	}
+	// Per-app workspaces are plain directories, not git checkouts
+	if req.Workspace != "" {
+		args = append(args, "--skip-git-repo-check")
+	}
 
-	cmd := exec.CommandContext(ctx, p.cliPath, args...)
+	cliPath, err := exec.LookPath(p.cliPath)
+	if err != nil {
+		return nil, fmt.Errorf("codex CLI not found: %w", err)
+	}
+	cmd, err := provider.Command(ctx, provider.CommandSpec{
+		Path:     cliPath,
+		Args:     args,
+		Dir:      req.Workspace,
+		Env:      provider.CLIEnv(p.env),
+		ReadOnly: provider.InstallPaths(cliPath),
+		Writable: stateDirs(),
+	}, req.Sandbox)
+	if err != nil {
+		return nil, err
+	}
 
 	stdout, err := cmd.StdoutPipe()
 	if err != nil {
@@ -104,6 +152,7 @@ func (p *Provider) Complete(ctx context.Context, req *provider.ChatCompletionReq
 		return nil, fmt.Errorf("starting codex CLI: %w", err)
 	}
 
+	version := p.cliVersion()
 	ch := make(chan provider.ChatCompletionChunk, 32)
 
 	go func() {
@@ -113,6 +162,7 @@ func (p *Provider) Complete(ctx context.Context, req *provider.ChatCompletionReq
 		scanner := bufio.NewScanner(stdout)
 		scanner.Buffer(make([]byte, 1024*1024), 1024*1024)
 
+		sawDone, sawError := false, false
 		for scanner.Scan() {
 			line := strings.TrimSpace(scanner.Text())
 			if line == "" {
@@ -124,8 +174,18 @@ func (p *Provider) Complete(ctx context.Context, req *provider.ChatCompletionReq
 				continue
 			}
 
-			chunk := parseEvent(evt)
+			chunk, known := parseEvent(evt)
+			if !known {
+				p.warnUnrecognised(evt, version)
+			}
 			if chunk != nil {
+				if sawError || (chunk.Done && sawDone) {
+					// Exactly one Done or Error per stream: the item schema
+					// reports a failure as both "error" and "turn.failed"
+					continue
+				}
+				sawDone = sawDone || chunk.Done
+				sawError = sawError || chunk.Error != nil
 				select {
 				case ch <- *chunk:
 				case <-ctx.Done():
@@ -134,47 +194,69 @@ func (p *Provider) Complete(ctx context.Context, req *provider.ChatCompletionReq
 			}
 		}
 
-		if err := scanner.Err(); err != nil {
+		if err := scanner.Err(); err != nil && !sawDone && !sawError {
 			select {
 			case ch <- provider.ChatCompletionChunk{Error: err}:
 			case <-ctx.Done():
 			}
+			return
+		}
+		if !sawDone && !sawError && ctx.Err() == nil {
+			log.Printf("codex: CLI %s exited without a completion event — its --json output may use an unsupported schema", version)
+			select {
+			case ch <- provider.ChatCompletionChunk{Error: fmt.Errorf("codex CLI exited without completing the response")}:
+			case <-ctx.Done():
+			}
 		}
 	}()
 
 	return ch, nil
 }
 
-func parseEvent(evt cliEvent) *provider.ChatCompletionChunk {
-	switch evt.Type {
-	case "response.output_text.delta":
-		if evt.Delta != "" {
-			return &provider.ChatCompletionChunk{Content: evt.Delta}
-		}
-		return nil
+// detectVersion runs `codex --version` and stores the result. It runs in
+// the background once Available first finds the CLI, so no request waits
+// on it.
+func (p *Provider) detectVersion() {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
 
-	case "response.completed":
-		chunk := &provider.ChatCompletionChunk{
-			Done:         true,
-			FinishReason: "stop",
-		}
-		if evt.Usage != nil {
-			chunk.Usage = &provider.Usage{
-				PromptTokens:     evt.Usage.InputTokens,
-				CompletionTokens: evt.Usage.OutputTokens,
-				TotalTokens:      evt.Usage.InputTokens + evt.Usage.OutputTokens,
-			}
-		}
-		return chunk
+	version := "unknown"
+	cmd := exec.CommandContext(ctx, p.cliPath, "--version")
+	cmd.Env = provider.CLIEnv(p.env)
+	if out, err := cmd.Output(); err != nil {
+		log.Printf("codex: could not detect CLI version: %v", err)
+	} else {
+		version = parseVersion(string(out))
+		log.Printf("codex: CLI version %s, expecting %s events", version, schemaFor(version))
+	}
 
-	case "error":
-		return &provider.ChatCompletionChunk{
-			Error: fmt.Errorf("codex CLI error: %s", evt.Message),
-		}
+	p.versionMu.Lock()
+	p.version = version
+	p.versionMu.Unlock()
+}
 
-	default:
-		return nil
+// cliVersion returns the installed CLI's version string, or "unknown" until
+// it has been detected.
+func (p *Provider) cliVersion() string {
+	p.versionMu.Lock()
+	defer p.versionMu.Unlock()
+	if p.version == "" {
+		return "unknown"
 	}
+	return p.version
+}
+
+// warnUnrecognised logs each unknown event type once, so a CLI upgrade that
+// changes the --json layout shows up in the logs instead of as empty replies.
+func (p *Provider) warnUnrecognised(evt cliEvent, version string) {
+	key := evt.Type
+	if evt.Item != nil {
+		key += "/" + evt.Item.kind()
+	}
+	if _, seen := p.warned.LoadOrStore(key, true); seen {
+		return
+	}
+	log.Printf("codex: unrecognised event %q from CLI %s (expected %s events) — output from it is dropped", key, version, schemaFor(version))
 }
 
 // buildPrompt converts OpenAI-style messages into a single prompt string for the CLI.
@@ -198,3 +280,16 @@ func buildPrompt(messages []provider.Message) string {
 	}
 	return strings.Join(parts, "\n\n")
 }
+
+// stateDirs returns the Codex CLI's session and credential state, which must
+// stay writable when the CLI runs sandboxed.
+func stateDirs() []string {
+	if dir := os.Getenv("CODEX_HOME"); dir != "" {
+		return []string{dir}
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return nil
+	}
+	return []string{filepath.Join(home, ".codex")}
+}
@@ -0,0 +1,99 @@
+package codex
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"plugmyai/internal/provider"
+	"plugmyai/internal/provider/providertest"
+)
+
+func TestConformance(t *testing.T) {
+	pidFile := filepath.Join(t.TempDir(), "cli.pid")
+
+	ok := []string{
+		`{"type":"thread.started","thread_id":"t1"}`,
+		`{"type":"turn.started"}`,
+		`{"type":"item.completed","item":{"id":"item_0","type":"reasoning","text":"Greeting."}}`,
+		`{"type":"item.completed","item":{"id":"item_1","type":"agent_message","text":"Hello!"}}`,
+		`{"type":"turn.completed","usage":{"input_tokens":9,"cached_input_tokens":0,"output_tokens":3}}`,
+	}
+	slow := []string{
+		`{"type":"thread.started","thread_id":"t2"}`,
+		`{"type":"item.completed","item":{"id":"item_0","type":"agent_message","text":"one"}}`,
+		`{"type":"item.completed","item":{"id":"item_1","type":"agent_message","text":" two"}}`,
+		`{"type":"turn.completed","usage":{"input_tokens":9,"cached_input_tokens":0,"output_tokens":2}}`,
+	}
+	failing := []string{
+		`{"type":"thread.started","thread_id":"t3"}`,
+		`{"type":"error","message":"stream disconnected before completion"}`,
+		`{"type":"turn.failed","error":{"message":"stream disconnected before completion"}}`,
+	}
+	cli := providertest.FakeCLI(t, "codex", `if [ "$1" = --version ]; then
+echo "codex-cli 0.46.0"
+exit 0
+fi
+case "$*" in
+*SLOW*)
+`+providertest.NDJSON(slow, 500*time.Millisecond, pidFile)+`;;
+*FAIL*)
+`+providertest.NDJSON(failing, 0, "")+`;;
+*)
+`+providertest.NDJSON(ok, 0, "")+`;;
+esac
+`)
+
+	providertest.Run(t, New(cli, "gpt-5-codex"), providertest.Options{
+		Request:        request("Say hello"),
+		SlowRequest:    request("SLOW count to two"),
+		PIDFile:        pidFile,
+		FailingRequest: request("FAIL please"),
+	})
+}
+
+// The CLI version is detected in the background once Available finds the
+// CLI; a request never waits on `codex --version`.
+func TestVersionDetection(t *testing.T) {
+	ok := []string{
+		`{"type":"item.completed","item":{"id":"item_0","type":"agent_message","text":"hi"}}`,
+		`{"type":"turn.completed","usage":{"input_tokens":1,"cached_input_tokens":0,"output_tokens":1}}`,
+	}
+	cli := providertest.FakeCLI(t, "codex", `if [ "$1" = --version ]; then
+sleep 1
+echo "codex-cli 0.46.0"
+exit 0
+fi
+`+providertest.NDJSON(ok, 0, ""))
+	p := New(cli, "")
+
+	start := time.Now()
+	if !p.Available() {
+		t.Fatal("fake CLI not available")
+	}
+	stream, err := p.Complete(context.Background(), request("Say hi"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, closed := providertest.Drain(stream, providertest.DefaultTimeout); !closed {
+		t.Fatal("stream not closed")
+	}
+	if d := time.Since(start); d > 500*time.Millisecond {
+		t.Errorf("request took %v: it waited on --version", d)
+	}
+
+	for p.cliVersion() != "0.46.0" {
+		if time.Since(start) > 5*time.Second {
+			t.Fatalf("version = %q, want 0.46.0", p.cliVersion())
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func request(prompt string) *provider.ChatCompletionRequest {
+	return &provider.ChatCompletionRequest{
+		Model:    "codex",
+		Messages: []provider.Message{{Role: "user", Content: prompt}},
+	}
+}
@@ -0,0 +1,213 @@
+package codex
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+
+	"plugmyai/internal/provider"
+)
+
+// The Codex CLI has shipped two `codex exec --json` layouts:
+//
+// Legacy (response-based) — Responses API style streaming:
+//   - "response.output_text.delta": incremental text in delta
+//   - "response.reasoning_summary_text.delta": incremental reasoning summary in delta
+//   - "response.completed": end of turn, usage at top level
+//   - "response.incomplete": end of a turn cut short, with incomplete_details.reason
+//   - "error": message at top level
+//
+// Items (thread/turn/item-based) — newer releases:
+//   - "thread.started", "turn.started", "item.started", "item.updated": progress (ignored)
+//   - "item.completed": a finished item; agent_message items carry the reply text
+//   - "turn.completed": end of turn, usage at top level (input/cached_input/output tokens)
+//   - "turn.failed": error.message
+//   - "error": message at top level
+//
+// Both are understood regardless of the detected version; the version only
+// decides which layout is expected when reporting unrecognised events.
+const (
+	schemaLegacy = "legacy response.*"
+	schemaItems  = "thread/turn/item"
+)
+
+// itemsSchemaSince is the first CLI release emitting item-based events.
+var itemsSchemaSince = [3]int{0, 44, 0}
+
+// cliEvent represents a line of NDJSON output from `codex exec --json`.
+type cliEvent struct {
+	Type string `json:"type"`
+	// For response.output_text.delta
+	Delta string `json:"delta,omitempty"`
+	// For response.completed and turn.completed
+	Usage *struct {
+		InputTokens       int `json:"input_tokens"`
+		CachedInputTokens int `json:"cached_input_tokens"`
+		OutputTokens      int `json:"output_tokens"`
+	} `json:"usage,omitempty"`
+	// For error events
+	Message string `json:"message,omitempty"`
+	// For item.* events
+	Item *cliItem `json:"item,omitempty"`
+	// For turn.failed
+	Error *struct {
+		Message string `json:"message"`
+	} `json:"error,omitempty"`
+	// For response.incomplete, at top level or in the response envelope
+	IncompleteDetails *incompleteDetails `json:"incomplete_details,omitempty"`
+	Response          *struct {
+		IncompleteDetails *incompleteDetails `json:"incomplete_details,omitempty"`
+	} `json:"response,omitempty"`
+}
+
+type incompleteDetails struct {
+	Reason string `json:"reason"` // "max_output_tokens", "content_filter"
+}
+
+// cliItem is the payload of item.* events. Early item-based releases used
+// item_type ("assistant_message"); later ones use type ("agent_message").
+type cliItem struct {
+	ID       string `json:"id"`
+	Type     string `json:"type"`
+	ItemType string `json:"item_type"`
+	Text     string `json:"text"`
+	Message  string `json:"message"` // error items
+}
+
+func (it *cliItem) kind() string {
+	if it.Type != "" {
+		return it.Type
+	}
+	return it.ItemType
+}
+
+// parseEvent converts a CLI event into a chunk. known is false for event
+// layouts this parser does not understand (as opposed to events it
+// deliberately ignores), so the caller can warn about them.
+func parseEvent(evt cliEvent) (chunk *provider.ChatCompletionChunk, known bool) {
+	switch evt.Type {
+	// --- Legacy schema ---
+	case "response.output_text.delta":
+		if evt.Delta != "" {
+			return &provider.ChatCompletionChunk{Content: evt.Delta}, true
+		}
+		return nil, true
+
+	case "response.reasoning_summary_text.delta":
+		if evt.Delta != "" {
+			return &provider.ChatCompletionChunk{Reasoning: evt.Delta}, true
+		}
+		return nil, true
+
+	case "response.completed":
+		return doneChunk(evt), true
+
+	case "response.incomplete":
+		chunk := doneChunk(evt)
+		details := evt.IncompleteDetails
+		if details == nil && evt.Response != nil {
+			details = evt.Response.IncompleteDetails
+		}
+		chunk.FinishReason = "length"
+		if details != nil && details.Reason == "content_filter" {
+			chunk.FinishReason = "content_filter"
+		}
+		return chunk, true
+
+	// --- Item schema ---
+	case "thread.started", "turn.started", "item.started", "item.updated":
+		return nil, true
+
+	case "item.completed":
+		if evt.Item == nil {
+			return nil, false
+		}
+		switch evt.Item.kind() {
+		case "agent_message", "assistant_message":
+			if evt.Item.Text != "" {
+				return &provider.ChatCompletionChunk{Content: evt.Item.Text}, true
+			}
+			return nil, true
+		case "error":
+			return &provider.ChatCompletionChunk{
+				Error: fmt.Errorf("codex CLI error: %s", evt.Item.Message),
+			}, true
+		case "reasoning":
+			if evt.Item.Text != "" {
+				return &provider.ChatCompletionChunk{Reasoning: evt.Item.Text}, true
+			}
+			return nil, true
+		case "command_execution", "file_change", "mcp_tool_call", "web_search", "todo_list":
+			// Agent activity, not part of the reply
+			return nil, true
+		default:
+			return nil, false
+		}
+
+	case "turn.completed":
+		return doneChunk(evt), true
+
+	case "turn.failed":
+		msg := "turn failed"
+		if evt.Error != nil && evt.Error.Message != "" {
+			msg = evt.Error.Message
+		}
+		return &provider.ChatCompletionChunk{
+			Error: fmt.Errorf("codex CLI error: %s", msg),
+		}, true
+
+	// --- Both ---
+	case "error":
+		return &provider.ChatCompletionChunk{
+			Error: fmt.Errorf("codex CLI error: %s", evt.Message),
+		}, true
+
+	default:
+		return nil, false
+	}
+}
+
+func doneChunk(evt cliEvent) *provider.ChatCompletionChunk {
+	chunk := &provider.ChatCompletionChunk{
+		Done:         true,
+		FinishReason: "stop",
+	}
+	if evt.Usage != nil {
+		chunk.Usage = &provider.Usage{
+			PromptTokens:     evt.Usage.InputTokens,
+			CompletionTokens: evt.Usage.OutputTokens,
+			TotalTokens:      evt.Usage.InputTokens + evt.Usage.OutputTokens,
+		}
+	}
+	return chunk
+}
+
+var versionRe = regexp.MustCompile(`(\d+)\.(\d+)\.(\d+)`)
+
+// parseVersion extracts "X.Y.Z" from `codex --version` output
+// (e.g. "codex-cli 0.46.0"). Returns "unknown" if there is none.
+func parseVersion(out string) string {
+	if m := versionRe.FindString(out); m != "" {
+		return m
+	}
+	return "unknown"
+}
+
+// schemaFor returns the event layout a CLI version is expected to emit.
+// Unknown versions are assumed to be recent.
+func schemaFor(version string) string {
+	m := versionRe.FindStringSubmatch(version)
+	if m == nil {
+		return schemaItems
+	}
+	for i := 0; i < 3; i++ {
+		n, _ := strconv.Atoi(m[i+1])
+		if n != itemsSchemaSince[i] {
+			if n > itemsSchemaSince[i] {
+				return schemaItems
+			}
+			return schemaLegacy
+		}
+	}
+	return schemaItems
+}
@@ -0,0 +1,180 @@
+package codex
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// fixtureResult is what parseEvent made of a fixture's events.
+type fixtureResult struct {
+	content, reasoning string
+	finishReason       string
+	promptTokens       int
+	completionTokens   int
+	errors             []string
+	dones              int
+	unknown            []string
+}
+
+// replayFixture feeds a testdata JSONL file through parseEvent line by
+// line, the way Complete reads the CLI's output.
+func replayFixture(t *testing.T, name string) fixtureResult {
+	t.Helper()
+	f, err := os.Open(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var res fixtureResult
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var evt cliEvent
+		if err := json.Unmarshal(scanner.Bytes(), &evt); err != nil {
+			t.Fatalf("%s: bad fixture line %q: %v", name, scanner.Text(), err)
+		}
+		chunk, known := parseEvent(evt)
+		if !known {
+			res.unknown = append(res.unknown, evt.Type)
+		}
+		if chunk == nil {
+			continue
+		}
+		res.content += chunk.Content
+		res.reasoning += chunk.Reasoning
+		if chunk.Error != nil {
+			res.errors = append(res.errors, chunk.Error.Error())
+		}
+		if chunk.Done {
+			res.dones++
+			res.finishReason = chunk.FinishReason
+			if chunk.Usage != nil {
+				res.promptTokens = chunk.Usage.PromptTokens
+				res.completionTokens = chunk.Usage.CompletionTokens
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return res
+}
+
+func TestParseEventFixtures(t *testing.T) {
+	tests := []struct {
+		fixture          string
+		content          string
+		reasoning        string
+		finishReason     string
+		promptTokens     int
+		completionTokens int
+		errors           []string
+		unknown          []string
+	}{
+		{
+			fixture:          "legacy.jsonl",
+			content:          "Hello, world",
+			reasoning:        "Thinking about greetings",
+			finishReason:     "stop",
+			promptTokens:     12,
+			completionTokens: 3,
+		},
+		{
+			fixture:          "legacy_incomplete.jsonl",
+			content:          "Once upon",
+			finishReason:     "length",
+			promptTokens:     8,
+			completionTokens: 2,
+		},
+		{
+			fixture: "legacy_error.jsonl",
+			content: "Par",
+			errors:  []string{"codex CLI error: rate limit exceeded"},
+		},
+		{
+			fixture:          "items.jsonl",
+			content:          "The repo has a README.",
+			reasoning:        "**Listing files**",
+			finishReason:     "stop",
+			promptTokens:     24763,
+			completionTokens: 122,
+		},
+		{
+			fixture:          "items_legacy_item_type.jsonl",
+			content:          "Hi there",
+			finishReason:     "stop",
+			promptTokens:     5,
+			completionTokens: 2,
+		},
+		{
+			fixture: "items_failed.jsonl",
+			errors: []string{
+				"codex CLI error: stream disconnected before completion",
+				"codex CLI error: stream disconnected before completion",
+			},
+		},
+		{
+			fixture:          "unknown.jsonl",
+			finishReason:     "stop",
+			promptTokens:     1,
+			completionTokens: 1,
+			unknown:          []string{"session.configured", "item.completed", "item.completed"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(strings.TrimSuffix(tt.fixture, ".jsonl"), func(t *testing.T) {
+			res := replayFixture(t, tt.fixture)
+			if res.content != tt.content {
+				t.Errorf("content = %q, want %q", res.content, tt.content)
+			}
+			if res.reasoning != tt.reasoning {
+				t.Errorf("reasoning = %q, want %q", res.reasoning, tt.reasoning)
+			}
+			if res.finishReason != tt.finishReason {
+				t.Errorf("finish reason = %q, want %q", res.finishReason, tt.finishReason)
+			}
+			if res.promptTokens != tt.promptTokens || res.completionTokens != tt.completionTokens {
+				t.Errorf("usage = %d/%d, want %d/%d", res.promptTokens, res.completionTokens, tt.promptTokens, tt.completionTokens)
+			}
+			if strings.Join(res.errors, "|") != strings.Join(tt.errors, "|") {
+				t.Errorf("errors = %q, want %q", res.errors, tt.errors)
+			}
+			if strings.Join(res.unknown, "|") != strings.Join(tt.unknown, "|") {
+				t.Errorf("unrecognised events = %q, want %q", res.unknown, tt.unknown)
+			}
+			wantDones := 0
+			if tt.finishReason != "" {
+				wantDones = 1
+			}
+			if res.dones != wantDones {
+				t.Errorf("got %d Done chunks, want %d", res.dones, wantDones)
+			}
+		})
+	}
+}
+
+func TestSchemaFor(t *testing.T) {
+	tests := []struct {
+		out, version, schema string
+	}{
+		{"codex-cli 0.46.0", "0.46.0", schemaItems},
+		{"codex-cli 0.44.0", "0.44.0", schemaItems},
+		{"codex-cli 0.43.9", "0.43.9", schemaLegacy},
+		{"codex 1.0.0\n", "1.0.0", schemaItems},
+		{"codex", "unknown", schemaItems},
+	}
+	for _, tt := range tests {
+		version := parseVersion(tt.out)
+		if version != tt.version {
+			t.Errorf("parseVersion(%q) = %q, want %q", tt.out, version, tt.version)
+		}
+		if schema := schemaFor(version); schema != tt.schema {
+			t.Errorf("schemaFor(%q) = %q, want %q", version, schema, tt.schema)
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package provider
+
+import (
+	"os"
+	"strings"
+)
+
+// DefaultEnvAllowlist lists the environment variables passed through to CLI
+// providers. Anything else in the daemon's environment — API keys, cloud
+// credentials, tokens — is withheld from the subprocess and its tool runs.
+// Entries ending in "*" match any variable with that prefix.
+var DefaultEnvAllowlist = []string{
+	"PATH",
+	"HOME",
+	"USER",
+	"LOGNAME",
+	"SHELL",
+	"TERM",
+	"TMPDIR",
+	"TZ",
+	"LANG",
+	"LC_*",
+	"XDG_CONFIG_HOME",
+	"XDG_DATA_HOME",
+	"XDG_CACHE_HOME",
+	"XDG_RUNTIME_DIR",
+}
+
+// CLIEnv returns the daemon's environment filtered through DefaultEnvAllowlist
+// plus any extra variable names from the provider's config.
+func CLIEnv(extra []string) []string {
+	allow := append(append([]string{}, DefaultEnvAllowlist...), extra...)
+	return FilterEnv(os.Environ(), allow)
+}
+
+// FilterEnv returns the KEY=value entries of environ whose key is allowed.
+func FilterEnv(environ, allow []string) []string {
+	var out []string
+	for _, kv := range environ {
+		key, _, ok := strings.Cut(kv, "=")
+		if !ok {
+			continue
+		}
+		if envAllowed(allow, key) {
+			out = append(out, kv)
+		}
+	}
+	return out
+}
+
+func envAllowed(allow []string, key string) bool {
+	for _, a := range allow {
+		if prefix, ok := strings.CutSuffix(a, "*"); ok {
+			if strings.HasPrefix(key, prefix) {
+				return true
+			}
+		} else if a == key {
+			return true
+		}
+	}
+	return false
+}
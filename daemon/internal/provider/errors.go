@@ -0,0 +1,26 @@
+package provider
+
+import (
+	"fmt"
+	"time"
+)
+
+// StatusError is a provider failure that should reach the client with a
+// specific HTTP status, such as an upstream rate limit (429). Providers return
+// it from Complete; the server responds with Status instead of a generic 500.
+type StatusError struct {
+	Status     int
+	Message    string
+	RetryAfter time.Duration // sent as Retry-After when set
+
+	// Body is an upstream's OpenAI-style JSON error ({"error": ...}),
+	// passed to the client as is instead of a message built from Message.
+	Body []byte
+}
+
+func (e *StatusError) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("provider returned status %d", e.Status)
+	}
+	return e.Message
+}
@@ -0,0 +1,243 @@
+// Package mock is a scriptable provider for developing apps against the
+// daemon: scenarios selected by model name produce fixed, echoed or
+// pattern-matched text with configurable pacing, failures and usage.
+package mock
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"plugmyai/internal/provider"
+)
+
+// Config holds config for the mock provider. Each scenario is exposed as a
+// model with the scenario's name.
+type Config struct {
+	Scenarios map[string]*Scenario `json:"scenarios,omitempty"`
+}
+
+// Scenario scripts the response to a request.
+type Scenario struct {
+	// Response text: the first matching rule wins, then Echo, then Text.
+	Text  string `json:"text,omitempty"`
+	Echo  bool   `json:"echo,omitempty"` // repeat the last user message
+	Rules []Rule `json:"rules,omitempty"`
+
+	// Reasoning is streamed as reasoning before the response text.
+	Reasoning string `json:"reasoning,omitempty"`
+
+	// Pacing
+	TokensPerSecond   float64 `json:"tokens_per_second,omitempty"`    // 0 = as fast as possible
+	FirstTokenDelayMS int     `json:"first_token_delay_ms,omitempty"` // latency before the first chunk
+
+	// Failures
+	Status       int    `json:"status,omitempty"`        // fail the request up front with this HTTP status (e.g. 429)
+	RetryAfterS  int    `json:"retry_after_s,omitempty"` // Retry-After for Status
+	FailAfter    int    `json:"fail_after,omitempty"`    // stream this many chunks, then fail
+	Error        string `json:"error,omitempty"`         // message for Status / FailAfter
+	FinishReason string `json:"finish_reason,omitempty"` // defaults to "stop"
+
+	// Usage reported with the final chunk. nil = word counts of prompt and output.
+	Usage *provider.Usage `json:"usage,omitempty"`
+}
+
+// Rule returns Text when Match (a regular expression) matches the last user
+// message. Text may refer to capture groups as $1, ${name}.
+type Rule struct {
+	Match string `json:"match"`
+	Text  string `json:"text"`
+
+	re *regexp.Regexp
+}
+
+// defaultScenarios are used when the config defines none.
+var defaultScenarios = map[string]*Scenario{
+	"mock-echo":  {Echo: true},
+	"mock-slow":  {Echo: true, TokensPerSecond: 5, FirstTokenDelayMS: 500},
+	"mock-think": {Echo: true, Reasoning: "The user wants their message repeated back, so I will echo it."},
+	"mock-error": {Text: "This stream will fail partway through.", FailAfter: 3, Error: "mock: injected failure"},
+	"mock-429":   {Status: http.StatusTooManyRequests, RetryAfterS: 10, Error: "mock: rate limited"},
+}
+
+func init() {
+	provider.RegisterFactory("mock", Factory)
+}
+
+// Factory creates a mock provider from raw JSON config.
+func Factory(rawConfig json.RawMessage) (provider.Provider, error) {
+	var cfg Config
+	if rawConfig != nil {
+		if err := json.Unmarshal(rawConfig, &cfg); err != nil {
+			return nil, fmt.Errorf("parsing mock config: %w", err)
+		}
+	}
+	if len(cfg.Scenarios) == 0 {
+		cfg.Scenarios = defaultScenarios
+	}
+
+	for name, sc := range cfg.Scenarios {
+		for i := range sc.Rules {
+			re, err := regexp.Compile(sc.Rules[i].Match)
+			if err != nil {
+				return nil, fmt.Errorf("mock scenario %s: rule %d: %w", name, i, err)
+			}
+			sc.Rules[i].re = re
+		}
+	}
+	return &Provider{scenarios: cfg.Scenarios}, nil
+}
+
+// Provider serves scripted responses.
+type Provider struct {
+	scenarios map[string]*Scenario
+}
+
+func (p *Provider) ID() string      { return "mock" }
+func (p *Provider) Name() string    { return "Mock" }
+func (p *Provider) Available() bool { return true }
+
+func (p *Provider) Models() []provider.Model {
+	names := make([]string, 0, len(p.scenarios))
+	for name := range p.scenarios {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	models := make([]provider.Model, len(names))
+	for i, name := range names {
+		models[i] = provider.Model{ID: name, Name: name, Provider: "mock"}
+	}
+	return models
+}
+
+func (p *Provider) Complete(ctx context.Context, req *provider.ChatCompletionRequest) (<-chan provider.ChatCompletionChunk, error) {
+	sc, ok := p.scenarios[req.Model]
+	if !ok {
+		return nil, &provider.StatusError{Status: http.StatusNotFound, Message: "mock: no scenario named " + req.Model}
+	}
+	if sc.Status != 0 {
+		return nil, &provider.StatusError{
+			Status:     sc.Status,
+			Message:    sc.errorMessage(),
+			RetryAfter: time.Duration(sc.RetryAfterS) * time.Second,
+		}
+	}
+
+	prompt := lastUserMessage(req.Messages)
+	tokens := splitTokens(sc.respond(prompt))
+
+	var interval time.Duration
+	if sc.TokensPerSecond > 0 {
+		interval = time.Duration(float64(time.Second) / sc.TokensPerSecond)
+	}
+
+	ch := make(chan provider.ChatCompletionChunk, 32)
+
+	go func() {
+		defer close(ch)
+
+		send := func(chunk provider.ChatCompletionChunk, delay time.Duration) bool {
+			if delay > 0 {
+				select {
+				case <-time.After(delay):
+				case <-ctx.Done():
+					return false
+				}
+			}
+			select {
+			case ch <- chunk:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		}
+
+		delay := time.Duration(sc.FirstTokenDelayMS) * time.Millisecond
+		for _, tok := range splitTokens(sc.Reasoning) {
+			if !send(provider.ChatCompletionChunk{Reasoning: tok}, delay) {
+				return
+			}
+			delay = interval
+		}
+		for i, tok := range tokens {
+			if sc.FailAfter > 0 && i == sc.FailAfter {
+				send(provider.ChatCompletionChunk{Error: fmt.Errorf("%s", sc.errorMessage())}, delay)
+				return
+			}
+			if !send(provider.ChatCompletionChunk{Content: tok}, delay) {
+				return
+			}
+			delay = interval
+		}
+		if sc.FailAfter > 0 && sc.FailAfter >= len(tokens) {
+			// The response is shorter than FailAfter: fail at its end
+			send(provider.ChatCompletionChunk{Error: fmt.Errorf("%s", sc.errorMessage())}, delay)
+			return
+		}
+
+		usage := sc.Usage
+		if usage == nil {
+			in := 0
+			for _, m := range req.Messages {
+				in += len(splitTokens(m.Content))
+			}
+			usage = &provider.Usage{PromptTokens: in, CompletionTokens: len(tokens), TotalTokens: in + len(tokens)}
+		}
+		finish := sc.FinishReason
+		if finish == "" {
+			finish = "stop"
+		}
+		send(provider.ChatCompletionChunk{Done: true, FinishReason: finish, Usage: usage}, 0)
+	}()
+
+	return ch, nil
+}
+
+// respond picks the response text for a prompt.
+func (sc *Scenario) respond(prompt string) string {
+	for _, r := range sc.Rules {
+		if m := r.re.FindStringSubmatchIndex(prompt); m != nil {
+			return string(r.re.ExpandString(nil, r.Text, prompt, m))
+		}
+	}
+	if sc.Echo {
+		return prompt
+	}
+	return sc.Text
+}
+
+func (sc *Scenario) errorMessage() string {
+	if sc.Error != "" {
+		return sc.Error
+	}
+	return "mock: injected failure"
+}
+
+func lastUserMessage(messages []provider.Message) string {
+	for i := len(messages) - 1; i >= 0; i-- {
+		if messages[i].Role == "user" {
+			return messages[i].Content
+		}
+	}
+	return ""
+}
+
+var tokenPattern = regexp.MustCompile(`\s*\S+\s*`)
+
+// splitTokens splits text into word-sized chunks, keeping the whitespace so
+// the chunks concatenate back to the original text.
+func splitTokens(text string) []string {
+	if strings.TrimSpace(text) == "" {
+		if text == "" {
+			return nil
+		}
+		return []string{text}
+	}
+	return tokenPattern.FindAllString(text, -1)
+}
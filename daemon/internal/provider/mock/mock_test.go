@@ -0,0 +1,109 @@
+package mock
+
+import (
+	"context"
+	"testing"
+
+	"plugmyai/internal/provider"
+	"plugmyai/internal/provider/providertest"
+)
+
+func newProvider(t *testing.T, config string) provider.Provider {
+	t.Helper()
+	p, err := Factory([]byte(config))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestConformance(t *testing.T) {
+	p := newProvider(t, `{"scenarios": {
+		"ok":   {"echo": true, "reasoning": "Echo it."},
+		"slow": {"text": "one two three four five six seven eight nine ten", "tokens_per_second": 10},
+		"fail": {"text": "this fails midway", "fail_after": 1}
+	}}`)
+
+	providertest.Run(t, p, providertest.Options{
+		Request:        request("ok", "Say hello"),
+		SlowRequest:    request("slow", "Count"),
+		FailingRequest: request("fail", "Go"),
+	})
+}
+
+func TestDefaultScenarios(t *testing.T) {
+	providertest.Run(t, newProvider(t, "{}"), providertest.Options{
+		Request:        request("mock-think", "Say hello"),
+		SlowRequest:    request("mock-slow", "one two three four five"),
+		FailingRequest: request("mock-error", "Go"),
+	})
+}
+
+func TestComplete(t *testing.T) {
+	p := newProvider(t, `{"scenarios": {
+		"rules": {"text": "fallback", "rules": [{"match": "^my name is (\\w+)", "text": "Hi $1"}]},
+		"short": {"text": "too short", "fail_after": 5, "error": "boom"},
+		"exact": {"text": "two words", "fail_after": 2},
+		"cut":   {"text": "cut off", "finish_reason": "length"}
+	}}`)
+
+	tests := []struct {
+		model, prompt string
+		content       string
+		err           string
+		finish        string
+	}{
+		{model: "rules", prompt: "my name is Ada", content: "Hi Ada", finish: "stop"},
+		{model: "rules", prompt: "hello", content: "fallback", finish: "stop"},
+		{model: "short", prompt: "go", content: "too short", err: "boom"},
+		{model: "exact", prompt: "go", content: "two words", err: "mock: injected failure"},
+		{model: "cut", prompt: "go", content: "cut off", finish: "length"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.model+"/"+tt.prompt, func(t *testing.T) {
+			stream, err := p.Complete(context.Background(), request(tt.model, tt.prompt))
+			if err != nil {
+				t.Fatal(err)
+			}
+			chunks, closed := providertest.Drain(stream, providertest.DefaultTimeout)
+			if !closed {
+				t.Fatal("stream not closed")
+			}
+
+			var content, errMsg, finish string
+			for _, c := range chunks {
+				content += c.Content
+				if c.Error != nil {
+					errMsg = c.Error.Error()
+				}
+				if c.Done {
+					finish = c.FinishReason
+				}
+			}
+			if content != tt.content {
+				t.Errorf("content = %q, want %q", content, tt.content)
+			}
+			if errMsg != tt.err {
+				t.Errorf("error = %q, want %q", errMsg, tt.err)
+			}
+			if finish != tt.finish {
+				t.Errorf("finish reason = %q, want %q", finish, tt.finish)
+			}
+		})
+	}
+}
+
+func TestStatusFailure(t *testing.T) {
+	_, err := newProvider(t, "{}").Complete(context.Background(), request("mock-429", "Go"))
+	se, ok := err.(*provider.StatusError)
+	if !ok || se.Status != 429 || se.RetryAfter.Seconds() != 10 {
+		t.Fatalf("got %v, want a 429 with Retry-After 10s", err)
+	}
+}
+
+func request(model, prompt string) *provider.ChatCompletionRequest {
+	return &provider.ChatCompletionRequest{
+		Model:    model,
+		Messages: []provider.Message{{Role: "user", Content: prompt}},
+	}
+}
@@ -6,9 +6,9 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
-	"io"
 	"net/http"
 	"strings"
+	"sync"
 	"time"
 
 	"plugmyai/internal/provider"
@@ -18,6 +18,31 @@ import (
 type Config struct {
 	BaseURL string `json:"base_url,omitempty"` // defaults to http://localhost:11434/v1
 	APIKey  string `json:"api_key,omitempty"`  // optional
+
+	// Preset fills in defaults for a known service: openai, openrouter,
+	// azure, groq, ollama, lmstudio or vllm.
+	Preset string `json:"preset,omitempty"`
+
+	// ID and Name identify this endpoint; several openai-compat providers
+	// need distinct IDs. Default "openai-compat" or the preset's.
+	ID   string `json:"id,omitempty"`
+	Name string `json:"name,omitempty"`
+
+	Headers       map[string]string `json:"headers,omitempty"`        // extra request headers, e.g. OpenRouter's HTTP-Referer and X-Title
+	QueryParams   map[string]string `json:"query_params,omitempty"`   // added to every request, e.g. Azure's api-version
+	AuthHeader    string            `json:"auth_header,omitempty"`    // header carrying api_key as is; default Authorization: Bearer
+	StaticModels  []string          `json:"static_models,omitempty"`  // served instead of GET /models
+	PathOverrides map[string]string `json:"path_overrides,omitempty"` // API path → path to use instead; {model} is replaced
+
+	// IncludeUsage asks for token usage at the end of each stream
+	// (stream_options.include_usage). Default true; turn it off for
+	// upstreams that reject stream_options.
+	IncludeUsage *bool `json:"include_usage,omitempty"`
+
+	// Resilience against flaky remote gateways
+	MaxRetries       *int `json:"max_retries,omitempty"`        // retries on 429/5xx/connection errors; default 2
+	BreakerThreshold *int `json:"breaker_threshold,omitempty"`  // consecutive failures before the upstream is marked unavailable; default 5, 0 disables
+	BreakerCooldownS int  `json:"breaker_cooldown_s,omitempty"` // how long it stays unavailable; default 30
 }
 
 func init() {
@@ -32,14 +57,57 @@ func Factory(rawConfig json.RawMessage) (provider.Provider, error) {
 			return nil, fmt.Errorf("parsing openai-compat config: %w", err)
 		}
 	}
-	return New(cfg.BaseURL, cfg.APIKey), nil
+	if err := applyPreset(&cfg); err != nil {
+		return nil, err
+	}
+
+	p := New(cfg.BaseURL, cfg.APIKey)
+	if cfg.ID != "" {
+		p.id = cfg.ID
+	}
+	if cfg.Name != "" {
+		p.name = cfg.Name
+	}
+	p.headers = cfg.Headers
+	p.queryParams = cfg.QueryParams
+	p.authHeader = cfg.AuthHeader
+	p.staticModels = cfg.StaticModels
+	p.pathOverrides = cfg.PathOverrides
+	if cfg.IncludeUsage != nil {
+		p.includeUsage = *cfg.IncludeUsage
+	}
+	if cfg.MaxRetries != nil {
+		p.maxRetries = max(*cfg.MaxRetries, 0)
+	}
+	if cfg.BreakerThreshold != nil {
+		p.breaker.threshold = *cfg.BreakerThreshold
+	}
+	if cfg.BreakerCooldownS > 0 {
+		p.breaker.cooldown = time.Duration(cfg.BreakerCooldownS) * time.Second
+	}
+	return p, nil
 }
 
 // Provider routes requests to an OpenAI-compatible HTTP API.
 type Provider struct {
-	baseURL string
-	apiKey  string
-	client  *http.Client
+	id, name string
+	baseURL  string
+	apiKey   string
+	client   *http.Client
+
+	headers       map[string]string
+	queryParams   map[string]string
+	authHeader    string
+	staticModels  []string
+	pathOverrides map[string]string
+	includeUsage  bool
+
+	streamClient *http.Client // no timeout: streams can run long
+	maxRetries   int
+	breaker      breaker
+
+	mu     sync.Mutex
+	models []provider.Model // last fetched from /models, served while the breaker is open
 }
 
 func New(baseURL, apiKey string) *Provider {
@@ -48,24 +116,49 @@ func New(baseURL, apiKey string) *Provider {
 	}
 	baseURL = strings.TrimRight(baseURL, "/")
 	return &Provider{
+		id:      "openai-compat",
+		name:    "OpenAI Compatible",
 		baseURL: baseURL,
 		apiKey:  apiKey,
 		client:  &http.Client{Timeout: 5 * time.Minute},
+
+		includeUsage: true,
+
+		streamClient: &http.Client{},
+		maxRetries:   defaultMaxRetries,
+		breaker:      breaker{threshold: defaultBreakerThreshold, cooldown: defaultBreakerCooldown},
 	}
 }
 
-func (p *Provider) ID() string   { return "openai-compat" }
-func (p *Provider) Name() string { return "OpenAI Compatible" }
+func (p *Provider) ID() string   { return p.id }
+func (p *Provider) Name() string { return p.name }
+
+// BreakerOpen reports whether the circuit breaker is refusing requests.
+// The provider stays routable meanwhile, so they fail with a 503.
+func (p *Provider) BreakerOpen() bool {
+	_, open := p.breaker.check()
+	return open
+}
 
+// Available probes the upstream, and reports false without probing while
+// the circuit breaker is open. Endpoints with static models may have no
+// /models to probe, so only the breaker counts for them.
 func (p *Provider) Available() bool {
+	if _, open := p.breaker.check(); open {
+		return false
+	}
+	if len(p.staticModels) > 0 {
+		return true
+	}
+
 	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
 	defer cancel()
 
-	req, err := http.NewRequestWithContext(ctx, "GET", p.baseURL+"/models", nil)
+	req, err := http.NewRequestWithContext(ctx, "GET", p.url("/models", ""), nil)
 	if err != nil {
 		return false
 	}
-	p.setAuth(req)
+	p.setHeaders(req)
 
 	resp, err := p.client.Do(req)
 	if err != nil {
@@ -83,14 +176,28 @@ type modelsResponse struct {
 }
 
 func (p *Provider) Models() []provider.Model {
+	if len(p.staticModels) > 0 {
+		models := make([]provider.Model, len(p.staticModels))
+		for i, id := range p.staticModels {
+			models[i] = provider.Model{ID: id, Name: id, Provider: p.id}
+		}
+		return models
+	}
+	if p.BreakerOpen() {
+		// Don't probe a failing upstream; keep serving what it last listed
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		return p.models
+	}
+
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
-	req, err := http.NewRequestWithContext(ctx, "GET", p.baseURL+"/models", nil)
+	req, err := http.NewRequestWithContext(ctx, "GET", p.url("/models", ""), nil)
 	if err != nil {
 		return nil
 	}
-	p.setAuth(req)
+	p.setHeaders(req)
 
 	resp, err := p.client.Do(req)
 	if err != nil {
@@ -112,9 +219,12 @@ func (p *Provider) Models() []provider.Model {
 		models = append(models, provider.Model{
 			ID:       m.ID,
 			Name:     m.ID,
-			Provider: "openai-compat",
+			Provider: p.id,
 		})
 	}
+	p.mu.Lock()
+	p.models = models
+	p.mu.Unlock()
 	return models
 }
 
@@ -122,53 +232,97 @@ func (p *Provider) Models() []provider.Model {
 type sseChunk struct {
 	Choices []struct {
 		Delta struct {
-			Content string `json:"content"`
+			Content   string          `json:"content"`
+			ToolCalls []toolCallDelta `json:"tool_calls"`
+
+			// Reasoning models stream their thinking apart from the answer:
+			// reasoning_content (DeepSeek, vLLM, llama.cpp) or reasoning
+			// (OpenRouter, Ollama)
+			ReasoningContent string `json:"reasoning_content"`
+			Reasoning        string `json:"reasoning"`
 		} `json:"delta"`
 		FinishReason *string `json:"finish_reason"`
 	} `json:"choices"`
 	Usage *provider.Usage `json:"usage,omitempty"`
+
+	// Error is set when the upstream fails after the stream has started
+	Error json.RawMessage `json:"error,omitempty"`
+}
+
+// toolCallDelta is a fragment of a streamed tool call. The first fragment
+// for an index carries the ID and name; arguments arrive in pieces.
+type toolCallDelta struct {
+	Index    int    `json:"index"`
+	ID       string `json:"id"`
+	Function struct {
+		Name      string `json:"name"`
+		Arguments string `json:"arguments"`
+	} `json:"function"`
+}
+
+// SupportsTools reports that models behind this API can call functions.
+func (p *Provider) SupportsTools() bool { return true }
+
+// SupportedParams lists the request parameters forwarded upstream. n is not
+// among them: the stream is read as a single choice.
+func (p *Provider) SupportedParams() []string {
+	return []string{
+		provider.ParamTemperature, provider.ParamMaxTokens, provider.ParamTopP, provider.ParamStop,
+		provider.ParamPresencePenalty, provider.ParamFrequencyPenalty, provider.ParamSeed,
+		provider.ParamLogitBias, provider.ParamUser, provider.ParamResponseFormat,
+		provider.ParamReasoningEffort,
+	}
 }
 
 func (p *Provider) Complete(ctx context.Context, req *provider.ChatCompletionRequest) (<-chan provider.ChatCompletionChunk, error) {
 	// Always stream from the upstream API.
 	body := struct {
-		Model       string             `json:"model"`
-		Messages    []provider.Message `json:"messages"`
-		Stream      bool               `json:"stream"`
-		Temperature *float64           `json:"temperature,omitempty"`
-		MaxTokens   *int               `json:"max_tokens,omitempty"`
+		Model            string                    `json:"model"`
+		Messages         []provider.Message        `json:"messages"`
+		Stream           bool                      `json:"stream"`
+		StreamOptions    *provider.StreamOptions   `json:"stream_options,omitempty"`
+		Temperature      *float64                  `json:"temperature,omitempty"`
+		MaxTokens        *int                      `json:"max_tokens,omitempty"`
+		TopP             *float64                  `json:"top_p,omitempty"`
+		Stop             provider.Stop             `json:"stop,omitempty"`
+		PresencePenalty  *float64                  `json:"presence_penalty,omitempty"`
+		FrequencyPenalty *float64                  `json:"frequency_penalty,omitempty"`
+		Seed             *int64                    `json:"seed,omitempty"`
+		LogitBias        map[string]float64        `json:"logit_bias,omitempty"`
+		User             string                    `json:"user,omitempty"`
+		ResponseFormat   *provider.ResponseFormat  `json:"response_format,omitempty"`
+		ReasoningEffort  string                    `json:"reasoning_effort,omitempty"`
+		Tools            []provider.ToolDefinition `json:"tools,omitempty"`
 	}{
-		Model:       req.Model,
-		Messages:    req.Messages,
-		Stream:      true,
-		Temperature: req.Temperature,
-		MaxTokens:   req.MaxTokens,
+		Model:            req.Model,
+		Messages:         req.Messages,
+		Stream:           true,
+		Temperature:      req.Temperature,
+		MaxTokens:        req.MaxTokens,
+		TopP:             req.TopP,
+		Stop:             req.Stop,
+		PresencePenalty:  req.PresencePenalty,
+		FrequencyPenalty: req.FrequencyPenalty,
+		Seed:             req.Seed,
+		LogitBias:        req.LogitBias,
+		User:             req.User,
+		ResponseFormat:   req.ResponseFormat,
+		ReasoningEffort:  req.ReasoningEffort,
+		Tools:            req.AgentTools,
 	}
 
-	bodyBytes, err := json.Marshal(body)
-	if err != nil {
-		return nil, fmt.Errorf("marshaling request: %w", err)
+	if p.includeUsage {
+		body.StreamOptions = &provider.StreamOptions{IncludeUsage: true}
 	}
 
-	httpReq, err := http.NewRequestWithContext(ctx, "POST", p.baseURL+"/chat/completions", bytes.NewReader(bodyBytes))
+	bodyBytes, err := json.Marshal(body)
 	if err != nil {
-		return nil, fmt.Errorf("creating request: %w", err)
+		return nil, fmt.Errorf("marshaling request: %w", err)
 	}
-	httpReq.Header.Set("Content-Type", "application/json")
-	httpReq.Header.Set("Accept", "text/event-stream")
-	p.setAuth(httpReq)
 
-	// Use a client without the default timeout for streaming.
-	streamClient := &http.Client{}
-	resp, err := streamClient.Do(httpReq)
+	resp, err := p.send(ctx, req.Model, bodyBytes)
 	if err != nil {
-		return nil, fmt.Errorf("sending request: %w", err)
-	}
-
-	if resp.StatusCode != http.StatusOK {
-		defer resp.Body.Close()
-		errBody, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
-		return nil, fmt.Errorf("upstream API error %d: %s", resp.StatusCode, string(errBody))
+		return nil, err
 	}
 
 	ch := make(chan provider.ChatCompletionChunk, 32)
@@ -180,6 +334,14 @@ func (p *Provider) Complete(ctx context.Context, req *provider.ChatCompletionReq
 		scanner := bufio.NewScanner(resp.Body)
 		scanner.Buffer(make([]byte, 1024*1024), 1024*1024)
 
+		// Tool calls are streamed in fragments and handed over whole with
+		// Done. Done itself waits for [DONE]: with include_usage, usage comes
+		// in a chunk of its own after the one with finish_reason.
+		var toolCalls []provider.ToolCall
+		var finishReason string
+		var usage *provider.Usage
+		sawDone := false
+
 		for scanner.Scan() {
 			line := scanner.Text()
 
@@ -189,25 +351,37 @@ func (p *Provider) Complete(ctx context.Context, req *provider.ChatCompletionReq
 			data := strings.TrimPrefix(line, "data: ")
 
 			if data == "[DONE]" {
-				select {
-				case ch <- provider.ChatCompletionChunk{Done: true, FinishReason: "stop"}:
-				case <-ctx.Done():
-				}
-				return
+				sawDone = true
+				break
 			}
 
 			var chunk sseChunk
 			if err := json.Unmarshal([]byte(data), &chunk); err != nil {
 				continue
 			}
+			if len(chunk.Error) > 0 {
+				select {
+				case ch <- provider.ChatCompletionChunk{Error: streamedError(chunk.Error)}:
+				case <-ctx.Done():
+				}
+				return
+			}
+			if chunk.Usage != nil {
+				usage = chunk.Usage
+			}
 
-			if len(chunk.Choices) > 0 {
+			if len(chunk.Choices) > 0 && finishReason == "" {
 				choice := chunk.Choices[0]
-				out := provider.ChatCompletionChunk{Content: choice.Delta.Content}
+				toolCalls = mergeToolCalls(toolCalls, choice.Delta.ToolCalls)
 				if choice.FinishReason != nil {
-					out.Done = true
-					out.FinishReason = *choice.FinishReason
-					out.Usage = chunk.Usage
+					finishReason = *choice.FinishReason
+				}
+				out := provider.ChatCompletionChunk{Content: choice.Delta.Content, Reasoning: choice.Delta.ReasoningContent}
+				if out.Reasoning == "" {
+					out.Reasoning = choice.Delta.Reasoning
+				}
+				if out.Content == "" && out.Reasoning == "" {
+					continue
 				}
 				select {
 				case ch <- out:
@@ -217,19 +391,81 @@ func (p *Provider) Complete(ctx context.Context, req *provider.ChatCompletionReq
 			}
 		}
 
+		if sawDone || finishReason != "" {
+			if finishReason == "" {
+				finishReason = "stop"
+				if len(toolCalls) > 0 {
+					finishReason = "tool_calls"
+				}
+			}
+			select {
+			case ch <- provider.ChatCompletionChunk{Done: true, FinishReason: finishReason, Usage: usage, ToolCalls: toolCalls}:
+			case <-ctx.Done():
+			}
+			return
+		}
+
 		if err := scanner.Err(); err != nil {
 			select {
 			case ch <- provider.ChatCompletionChunk{Error: err}:
 			case <-ctx.Done():
 			}
+			return
+		}
+		if ctx.Err() == nil {
+			select {
+			case ch <- provider.ChatCompletionChunk{Error: fmt.Errorf("upstream stream ended without completing the response")}:
+			case <-ctx.Done():
+			}
 		}
 	}()
 
 	return ch, nil
 }
 
-func (p *Provider) setAuth(req *http.Request) {
-	if p.apiKey != "" {
-		req.Header.Set("Authorization", "Bearer "+p.apiKey)
+// mergeToolCalls folds streamed tool call fragments into calls.
+func mergeToolCalls(calls []provider.ToolCall, deltas []toolCallDelta) []provider.ToolCall {
+	for _, d := range deltas {
+		for len(calls) <= d.Index {
+			calls = append(calls, provider.ToolCall{Type: "function"})
+		}
+		c := &calls[d.Index]
+		if d.ID != "" {
+			c.ID = d.ID
+		}
+		c.Function.Name += d.Function.Name
+		c.Function.Arguments += d.Function.Arguments
+	}
+	return calls
+}
+
+// Forward relays another OpenAI endpoint (audio, images, moderations) to
+// the upstream as is, for the server's passthrough routes. Failures count
+// against the circuit breaker like chat completions, but are not retried:
+// uploads can be large and generations are not idempotent.
+func (p *Provider) Forward(ctx context.Context, path, model, contentType string, body []byte) (*http.Response, error) {
+	if wait, open := p.breaker.check(); open {
+		return nil, p.breakerOpen(wait)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", p.url(path, model), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", contentType)
+	p.setHeaders(req)
+
+	resp, err := p.streamClient.Do(req)
+	if err != nil {
+		if ctx.Err() == nil {
+			p.breaker.failure()
+		}
+		return nil, &provider.StatusError{Status: http.StatusBadGateway, Message: "sending request: " + err.Error()}
+	}
+	if resp.StatusCode >= 500 {
+		p.breaker.failure()
+	} else {
+		p.breaker.success()
 	}
+	return resp, nil
 }
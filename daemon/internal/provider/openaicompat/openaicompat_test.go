@@ -0,0 +1,189 @@
+package openaicompat
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"plugmyai/internal/provider"
+	"plugmyai/internal/provider/providertest"
+)
+
+// fakeUpstream serves /models and a streaming /chat/completions whose
+// behaviour depends on the model: "slow" streams until the client goes
+// away, "fail" is rejected, "midstream" replays testdata/midstream_error.sse
+// (a stream that fails after its first tokens), anything else streams a
+// short reply.
+func fakeUpstream(t *testing.T) *httptest.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /models", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"object":"list","data":[{"id":"gpt-test"},{"id":"slow"},{"id":"fail"},{"id":"broken"},{"id":"midstream"}]}`)
+	})
+	mux.HandleFunc("POST /chat/completions", func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			Model string `json:"model"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, "bad body", http.StatusBadRequest)
+			return
+		}
+		if body.Model == "broken" {
+			http.Error(w, "upstream exploded", http.StatusInternalServerError)
+			return
+		}
+		if body.Model == "fail" {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"error":{"message":"model not found","type":"invalid_request_error"}}`)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		if body.Model == "midstream" {
+			data, err := os.ReadFile("testdata/midstream_error.sse")
+			if err != nil {
+				t.Error(err)
+			}
+			w.Write(data)
+			return
+		}
+		flusher := w.(http.Flusher)
+		event := func(data string) {
+			fmt.Fprintf(w, "data: %s\n\n", data)
+			flusher.Flush()
+		}
+
+		if body.Model == "slow" {
+			for i := 0; i < 100; i++ {
+				event(fmt.Sprintf(`{"choices":[{"index":0,"delta":{"content":"%d "},"finish_reason":null}]}`, i))
+				select {
+				case <-time.After(100 * time.Millisecond):
+				case <-r.Context().Done():
+					return
+				}
+			}
+			event(`{"choices":[{"index":0,"delta":{},"finish_reason":"stop"}]}`)
+			event("[DONE]")
+			return
+		}
+
+		event(`{"choices":[{"index":0,"delta":{"role":"assistant","content":""},"finish_reason":null}]}`)
+		event(`{"choices":[{"index":0,"delta":{"reasoning_content":"Greeting."},"finish_reason":null}]}`)
+		event(`{"choices":[{"index":0,"delta":{"content":"Hello"},"finish_reason":null}]}`)
+		event(`{"choices":[{"index":0,"delta":{"content":"!"},"finish_reason":null}]}`)
+		event(`{"choices":[{"index":0,"delta":{},"finish_reason":"stop"}]}`)
+		event(`{"choices":[],"usage":{"prompt_tokens":9,"completion_tokens":3,"total_tokens":12}}`)
+		event("[DONE]")
+	})
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestConformance(t *testing.T) {
+	srv := fakeUpstream(t)
+
+	providertest.Run(t, New(srv.URL, "sk-test"), providertest.Options{
+		Request:        request("gpt-test"),
+		SlowRequest:    request("slow"),
+		FailingRequest: request("fail"),
+	})
+}
+
+func TestCompleteUsage(t *testing.T) {
+	srv := fakeUpstream(t)
+
+	stream, err := New(srv.URL, "").Complete(context.Background(), request("gpt-test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	chunks, closed := providertest.Drain(stream, providertest.DefaultTimeout)
+	if !closed {
+		t.Fatal("stream not closed")
+	}
+
+	var content, reasoning string
+	for _, c := range chunks {
+		content += c.Content
+		reasoning += c.Reasoning
+	}
+	if content != "Hello!" || reasoning != "Greeting." {
+		t.Errorf("content %q, reasoning %q", content, reasoning)
+	}
+	last := chunks[len(chunks)-1]
+	if !last.Done || last.Usage == nil || last.Usage.TotalTokens != 12 {
+		t.Errorf("last chunk = %+v, want Done with the upstream's usage", last)
+	}
+}
+
+// An error event in the middle of a stream ends it with a StatusError
+// carrying the upstream's error as is.
+func TestCompleteMidstreamError(t *testing.T) {
+	srv := fakeUpstream(t)
+
+	stream, err := New(srv.URL, "").Complete(context.Background(), request("midstream"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	chunks, closed := providertest.Drain(stream, providertest.DefaultTimeout)
+	if !closed {
+		t.Fatal("stream not closed")
+	}
+	if len(chunks) != 2 || chunks[0].Content != "Hel" {
+		t.Fatalf("chunks = %+v, want the content then an error", chunks)
+	}
+
+	var se *provider.StatusError
+	if !errors.As(chunks[1].Error, &se) {
+		t.Fatalf("last chunk = %+v, want a StatusError", chunks[1])
+	}
+	want := `{"error":{"message":"The server had an error while processing your request.","type":"server_error","param":null,"code":"server_overloaded"}}`
+	if se.Status != http.StatusBadGateway || string(se.Body) != want {
+		t.Errorf("status %d, body %s", se.Status, se.Body)
+	}
+	if se.Message != "upstream API error: The server had an error while processing your request." {
+		t.Errorf("message %q", se.Message)
+	}
+}
+
+// An open breaker makes the provider unavailable, but requests for its
+// models must still reach it and fail with 503 and Retry-After.
+func TestBreakerOpenStaysRoutable(t *testing.T) {
+	srv := fakeUpstream(t)
+	p, err := Factory([]byte(`{"base_url": "` + srv.URL + `", "max_retries": 0, "breaker_threshold": 1}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	registry := provider.NewRegistry()
+	registry.Register(p)
+	registry.AllModels() // caches the model list
+
+	if _, err := p.Complete(context.Background(), request("broken")); err == nil {
+		t.Fatal("request to a failing upstream succeeded")
+	}
+	if p.Available() {
+		t.Fatal("provider available with its breaker open")
+	}
+
+	if found := registry.FindProvider("gpt-test"); found != p {
+		t.Fatalf("FindProvider = %v, want the provider with the open breaker", found)
+	}
+	_, err = p.Complete(context.Background(), request("gpt-test"))
+	var se *provider.StatusError
+	if !errors.As(err, &se) || se.Status != http.StatusServiceUnavailable || se.RetryAfter <= 0 {
+		t.Fatalf("got %v, want a 503 with Retry-After", err)
+	}
+}
+
+func request(model string) *provider.ChatCompletionRequest {
+	return &provider.ChatCompletionRequest{
+		Model:    model,
+		Messages: []provider.Message{{Role: "user", Content: "Say hello"}},
+	}
+}
@@ -0,0 +1,125 @@
+package openaicompat
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// preset holds the defaults for a well-known OpenAI-compatible service.
+// Config fields override them; headers and query parameters are merged.
+type preset struct {
+	id, name      string
+	baseURL       string
+	authHeader    string
+	queryParams   map[string]string
+	pathOverrides map[string]string
+}
+
+var presets = map[string]preset{
+	"openai":     {id: "openai", name: "OpenAI", baseURL: "https://api.openai.com/v1"},
+	"openrouter": {id: "openrouter", name: "OpenRouter", baseURL: "https://openrouter.ai/api/v1"},
+	"groq":       {id: "groq", name: "Groq", baseURL: "https://api.groq.com/openai/v1"},
+	"ollama":     {id: "ollama", name: "Ollama", baseURL: "http://localhost:11434/v1"},
+	"lmstudio":   {id: "lmstudio", name: "LM Studio", baseURL: "http://localhost:1234/v1"},
+	"vllm":       {id: "vllm", name: "vLLM", baseURL: "http://localhost:8000/v1"},
+
+	// Azure addresses deployments rather than models, and its /models lists
+	// base models, so configs list their deployments in static_models.
+	// base_url is https://<resource>.openai.azure.com/openai.
+	"azure": {
+		id:          "azure-openai",
+		name:        "Azure OpenAI",
+		authHeader:  "api-key",
+		queryParams: map[string]string{"api-version": "2024-10-21"},
+		pathOverrides: map[string]string{
+			"/chat/completions": "/deployments/{model}/chat/completions",
+		},
+	},
+}
+
+// applyPreset fills in cfg's unset fields from its preset.
+func applyPreset(cfg *Config) error {
+	if cfg.Preset == "" {
+		return nil
+	}
+	ps, ok := presets[cfg.Preset]
+	if !ok {
+		names := make([]string, 0, len(presets))
+		for name := range presets {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return fmt.Errorf("unknown openai-compat preset %q (have %s)", cfg.Preset, strings.Join(names, ", "))
+	}
+
+	if cfg.ID == "" {
+		cfg.ID = ps.id
+	}
+	if cfg.Name == "" {
+		cfg.Name = ps.name
+	}
+	if cfg.BaseURL == "" {
+		if ps.baseURL == "" {
+			return fmt.Errorf("openai-compat preset %q needs base_url", cfg.Preset)
+		}
+		cfg.BaseURL = ps.baseURL
+	}
+	if cfg.AuthHeader == "" {
+		cfg.AuthHeader = ps.authHeader
+	}
+	cfg.QueryParams = merge(ps.queryParams, cfg.QueryParams)
+	cfg.PathOverrides = merge(ps.pathOverrides, cfg.PathOverrides)
+	return nil
+}
+
+// merge returns base overlaid with over.
+func merge(base, over map[string]string) map[string]string {
+	if len(base) == 0 {
+		return over
+	}
+	out := make(map[string]string, len(base)+len(over))
+	for k, v := range base {
+		out[k] = v
+	}
+	for k, v := range over {
+		out[k] = v
+	}
+	return out
+}
+
+// url builds the upstream URL for an API path such as "/chat/completions",
+// applying path overrides ({model} is replaced with the model) and query
+// parameters.
+func (p *Provider) url(path, model string) string {
+	if o, ok := p.pathOverrides[path]; ok {
+		path = strings.ReplaceAll(o, "{model}", url.PathEscape(model))
+	}
+	u := p.baseURL + path
+	if len(p.queryParams) > 0 {
+		q := url.Values{}
+		for k, v := range p.queryParams {
+			q.Set(k, v)
+		}
+		u += "?" + q.Encode()
+	}
+	return u
+}
+
+// setHeaders adds authentication and the configured extra headers. The key
+// goes in Authorization as a Bearer token unless another header is
+// configured, in which case it is sent as is (Azure's api-key).
+func (p *Provider) setHeaders(req *http.Request) {
+	if p.apiKey != "" {
+		if p.authHeader == "" || strings.EqualFold(p.authHeader, "Authorization") {
+			req.Header.Set("Authorization", "Bearer "+p.apiKey)
+		} else {
+			req.Header.Set(p.authHeader, p.apiKey)
+		}
+	}
+	for k, v := range p.headers {
+		req.Header.Set(k, v)
+	}
+}
@@ -0,0 +1,237 @@
+package openaicompat
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"plugmyai/internal/provider"
+)
+
+const (
+	defaultMaxRetries       = 2
+	defaultBreakerThreshold = 5
+	defaultBreakerCooldown  = 30 * time.Second
+
+	baseBackoff = 500 * time.Millisecond
+	maxBackoff  = 10 * time.Second
+
+	// maxRetryAfter is the longest upstream Retry-After worth waiting out.
+	// Longer ones are passed on to the client instead.
+	maxRetryAfter = 30 * time.Second
+)
+
+// send posts a chat completion, retrying rate limits, server errors and
+// failed connections with exponential backoff. Retries happen only before
+// the response starts streaming, so the client never sees a partial
+// response twice. Each failed attempt counts against the circuit breaker.
+func (p *Provider) send(ctx context.Context, model string, body []byte) (*http.Response, error) {
+	if wait, open := p.breaker.check(); open {
+		return nil, p.breakerOpen(wait)
+	}
+
+	for attempt := 0; ; attempt++ {
+		resp, err := p.post(ctx, model, body)
+		if err == nil && resp.StatusCode == http.StatusOK {
+			p.breaker.success()
+			return resp, nil
+		}
+
+		var se *provider.StatusError
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			se = &provider.StatusError{Status: http.StatusBadGateway, Message: "sending request: " + err.Error()}
+		} else {
+			se = upstreamError(resp)
+		}
+
+		if !retryable(se.Status) {
+			return nil, se
+		}
+		if se.Status != http.StatusTooManyRequests {
+			p.breaker.failure() // a rate limit means the upstream is up
+		}
+		if _, open := p.breaker.check(); open || attempt >= p.maxRetries || se.RetryAfter > maxRetryAfter {
+			return nil, se
+		}
+
+		wait := backoff(attempt)
+		if se.RetryAfter > wait {
+			wait = se.RetryAfter
+		}
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+func (p *Provider) post(ctx context.Context, model string, body []byte) (*http.Response, error) {
+	httpReq, err := http.NewRequestWithContext(ctx, "POST", p.url("/chat/completions", model), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	httpReq.Header.Set("Accept", "text/event-stream")
+	p.setHeaders(httpReq)
+
+	// Use a client without the default timeout for streaming.
+	return p.streamClient.Do(httpReq)
+}
+
+// retryable reports whether a request that failed with status may succeed
+// if sent again. Connection failures are reported as 502.
+func retryable(status int) bool {
+	switch status {
+	case http.StatusTooManyRequests, http.StatusInternalServerError, http.StatusBadGateway,
+		http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// backoff returns the delay before retry attempt+1: exponential, capped,
+// with jitter so concurrent requests don't retry in lockstep.
+func backoff(attempt int) time.Duration {
+	d := baseBackoff << attempt
+	if d > maxBackoff || d <= 0 {
+		d = maxBackoff
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// parseRetryAfter reads a Retry-After header, in seconds or as an HTTP date.
+func parseRetryAfter(v string) time.Duration {
+	if v == "" {
+		return 0
+	}
+	if s, err := strconv.Atoi(v); err == nil && s > 0 {
+		return time.Duration(s) * time.Second
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		if d := time.Until(t); d > 0 {
+			return d
+		}
+	}
+	return 0
+}
+
+// upstreamError turns a non-200 response into a StatusError carrying the
+// upstream's status and, when it is OpenAI-style JSON, its error body.
+func upstreamError(resp *http.Response) *provider.StatusError {
+	defer resp.Body.Close()
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+
+	se := &provider.StatusError{
+		Status:     resp.StatusCode,
+		Message:    "upstream API error " + strconv.Itoa(resp.StatusCode),
+		RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After")),
+	}
+
+	var body struct {
+		Error json.RawMessage `json:"error"`
+	}
+	if json.Unmarshal(data, &body) == nil && len(body.Error) > 0 {
+		se.Body = data
+		var detail struct {
+			Message string `json:"message"`
+		}
+		var msg string
+		if json.Unmarshal(body.Error, &detail) == nil && detail.Message != "" {
+			se.Message += ": " + detail.Message
+		} else if json.Unmarshal(body.Error, &msg) == nil && msg != "" {
+			se.Message += ": " + msg
+		}
+	} else if text := strings.TrimSpace(string(data)); text != "" {
+		if len(text) > 1024 {
+			text = text[:1024]
+		}
+		se.Message += ": " + text
+	}
+	return se
+}
+
+// streamedError turns an error event sent in place of a chunk
+// (data: {"error": ...}) into a StatusError. The response status was already
+// 200, so it is reported as a bad gateway; the client gets the upstream's
+// error body, with its message, type and code, as is.
+func streamedError(raw json.RawMessage) *provider.StatusError {
+	se := &provider.StatusError{
+		Status:  http.StatusBadGateway,
+		Message: "upstream API error",
+		Body:    []byte(`{"error":` + string(raw) + `}`),
+	}
+	var detail struct {
+		Message string `json:"message"`
+	}
+	var msg string
+	if json.Unmarshal(raw, &detail) == nil && detail.Message != "" {
+		se.Message += ": " + detail.Message
+	} else if json.Unmarshal(raw, &msg) == nil && msg != "" {
+		se.Message += ": " + msg
+	}
+	return se
+}
+
+// breakerOpen is the error for requests refused while the breaker is open.
+func (p *Provider) breakerOpen(wait time.Duration) error {
+	return &provider.StatusError{
+		Status:     http.StatusServiceUnavailable,
+		Message:    "upstream " + p.baseURL + " is failing; not retrying until the circuit breaker closes",
+		RetryAfter: wait,
+	}
+}
+
+// breaker stops sending requests to an upstream after threshold
+// consecutive failures. Once cooldown has passed, requests go through again:
+// the first success closes it, a failure opens it for another cooldown.
+type breaker struct {
+	threshold int // 0 disables the breaker
+	cooldown  time.Duration
+
+	mu        sync.Mutex
+	failures  int
+	openUntil time.Time
+}
+
+// check reports whether the breaker is open, and for how much longer.
+func (b *breaker) check() (time.Duration, bool) {
+	if b.threshold <= 0 {
+		return 0, false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if wait := time.Until(b.openUntil); wait > 0 {
+		return wait, true
+	}
+	return 0, false
+}
+
+func (b *breaker) success() {
+	b.mu.Lock()
+	b.failures = 0
+	b.openUntil = time.Time{}
+	b.mu.Unlock()
+}
+
+func (b *breaker) failure() {
+	if b.threshold <= 0 {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures++
+	if b.failures >= b.threshold {
+		b.openUntil = time.Now().Add(b.cooldown)
+	}
+}
@@ -0,0 +1,116 @@
+package provider
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// Optional request parameters, by their JSON names.
+const (
+	ParamTemperature      = "temperature"
+	ParamMaxTokens        = "max_tokens"
+	ParamTopP             = "top_p"
+	ParamStop             = "stop"
+	ParamPresencePenalty  = "presence_penalty"
+	ParamFrequencyPenalty = "frequency_penalty"
+	ParamSeed             = "seed"
+	ParamN                = "n"
+	ParamLogitBias        = "logit_bias"
+	ParamUser             = "user"
+	ParamResponseFormat   = "response_format"
+	ParamReasoningEffort  = "reasoning_effort"
+)
+
+// ReasoningEfforts are the accepted reasoning_effort values, least first.
+// Providers map them onto their own controls (thinking budgets, CLI flags).
+var ReasoningEfforts = []string{"minimal", "low", "medium", "high"}
+
+// ParamSupporter is implemented by providers that honour optional request
+// parameters. A provider that doesn't implement it honours none of them.
+type ParamSupporter interface {
+	SupportedParams() []string
+}
+
+// Stop is the stop parameter: up to four sequences, sent by clients either
+// as a single string or as an array.
+type Stop []string
+
+func (s *Stop) UnmarshalJSON(data []byte) error {
+	var one string
+	if err := json.Unmarshal(data, &one); err == nil {
+		*s = nil
+		if one != "" {
+			*s = Stop{one}
+		}
+		return nil
+	}
+	var many []string
+	if err := json.Unmarshal(data, &many); err != nil {
+		return fmt.Errorf("stop must be a string or an array of strings")
+	}
+	*s = many
+	return nil
+}
+
+// ResponseFormat is the response_format parameter.
+type ResponseFormat struct {
+	Type       string            `json:"type"` // "text", "json_object" or "json_schema"
+	JSONSchema *JSONSchemaFormat `json:"json_schema,omitempty"`
+}
+
+// JSONSchemaFormat describes the schema of a json_schema response format.
+type JSONSchemaFormat struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description,omitempty"`
+	Schema      json.RawMessage `json:"schema,omitempty"`
+	Strict      *bool           `json:"strict,omitempty"`
+}
+
+// SetParams lists the optional parameters req sets to something other than
+// their defaults, in a fixed order.
+func (req *ChatCompletionRequest) SetParams() []string {
+	var set []string
+	add := func(name string, ok bool) {
+		if ok {
+			set = append(set, name)
+		}
+	}
+	add(ParamTemperature, req.Temperature != nil)
+	add(ParamMaxTokens, req.MaxTokens != nil)
+	add(ParamTopP, req.TopP != nil)
+	add(ParamStop, len(req.Stop) > 0)
+	add(ParamPresencePenalty, req.PresencePenalty != nil)
+	add(ParamFrequencyPenalty, req.FrequencyPenalty != nil)
+	add(ParamSeed, req.Seed != nil)
+	add(ParamN, req.N != nil && *req.N != 1)
+	add(ParamLogitBias, len(req.LogitBias) > 0)
+	add(ParamUser, req.User != "")
+	add(ParamResponseFormat, req.ResponseFormat != nil && req.ResponseFormat.Type != "" && req.ResponseFormat.Type != "text")
+	add(ParamReasoningEffort, req.ReasoningEffort != "")
+	return set
+}
+
+// Supports reports whether p honours the named parameter.
+func Supports(p Provider, name string) bool {
+	ps, ok := p.(ParamSupporter)
+	if !ok {
+		return false
+	}
+	for _, n := range ps.SupportedParams() {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// UnsupportedParams lists the parameters req sets that p does not honour.
+func UnsupportedParams(p Provider, req *ChatCompletionRequest) []string {
+	var unsupported []string
+	for _, name := range req.SetParams() {
+		if !Supports(p, name) {
+			unsupported = append(unsupported, name)
+		}
+	}
+	return unsupported
+}
@@ -4,6 +4,9 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"net/http"
+
+	"plugmyai/internal/mcp"
 )
 
 // Provider is the interface all AI backends must implement.
@@ -26,6 +29,12 @@ type Provider interface {
 	Complete(ctx context.Context, req *ChatCompletionRequest) (<-chan ChatCompletionChunk, error)
 }
 
+// StreamOptions are the options of a streamed completion.
+type StreamOptions struct {
+	// IncludeUsage asks for a final chunk with no choices and the usage.
+	IncludeUsage bool `json:"include_usage"`
+}
+
 type Model struct {
 	ID       string `json:"id"`
 	Name     string `json:"name"`
@@ -38,26 +47,145 @@ type ChatCompletionRequest struct {
 	Stream      bool      `json:"stream"`
 	Temperature *float64  `json:"temperature,omitempty"`
 	MaxTokens   *int      `json:"max_tokens,omitempty"`
-	Scope       string    `json:"-"` // "chat" or "full" — set by server, not from JSON body
+
+	StreamOptions *StreamOptions `json:"stream_options,omitempty"`
+
+	// Further OpenAI sampling parameters. Providers declare which they honour
+	// with ParamSupporter; see UnsupportedParams.
+	TopP             *float64           `json:"top_p,omitempty"`
+	Stop             Stop               `json:"stop,omitempty"`
+	PresencePenalty  *float64           `json:"presence_penalty,omitempty"`
+	FrequencyPenalty *float64           `json:"frequency_penalty,omitempty"`
+	Seed             *int64             `json:"seed,omitempty"`
+	N                *int               `json:"n,omitempty"`
+	LogitBias        map[string]float64 `json:"logit_bias,omitempty"`
+	User             string             `json:"user,omitempty"`
+	ResponseFormat   *ResponseFormat    `json:"response_format,omitempty"`
+	ReasoningEffort  string             `json:"reasoning_effort,omitempty"` // see ReasoningEfforts
+
+	Scope     string         `json:"-"` // "chat" or "full" — set by server, not from JSON body
+	Workspace string         `json:"-"` // working directory for agent CLIs — set by server
+	Sandbox   *SandboxPolicy `json:"-"` // isolation for agent CLIs; nil = none — set by server
+	Tools     *ToolPolicy    `json:"-"` // per-app tool policy; nil = derive from Scope — set by server
+	Approval  *ApprovalHook  `json:"-"` // human approval of tool calls; nil = none — set by server
+
+	// ToolTrace asks the daemon's agent loop to stream tool call events
+	// alongside the answer (see ToolCaller).
+	ToolTrace bool `json:"tool_trace,omitempty"`
+
+	// Background asks the server to run the completion as a job, detached
+	// from the HTTP request, and return its ID at once.
+	Background bool `json:"background,omitempty"`
+
+	// MCPServers are the MCP servers granted to the app, by name. nil means
+	// no restriction (the CLI's own MCP config applies); non-nil, even empty,
+	// means exactly these servers. Set by server.
+	MCPServers map[string]mcp.ServerConfig `json:"-"`
+
+	// AgentTools are function tools to offer the model. Only providers that
+	// implement ToolCaller receive them. Set by the server's agent loop.
+	AgentTools []ToolDefinition `json:"-"`
 }
 
 type Message struct {
-	Role    string `json:"role"`
-	Content string `json:"content"`
+	Role       string     `json:"role"`
+	Content    string     `json:"content"`
+	ToolCalls  []ToolCall `json:"tool_calls,omitempty"`   // assistant: functions the model called
+	ToolCallID string     `json:"tool_call_id,omitempty"` // tool: the call this result answers
+	Name       string     `json:"name,omitempty"`         // tool: the function name
+}
+
+// ToolCall is a function call requested by the model, in OpenAI's format.
+type ToolCall struct {
+	ID       string `json:"id"`
+	Type     string `json:"type"` // always "function"
+	Function struct {
+		Name      string `json:"name"`
+		Arguments string `json:"arguments"` // JSON object, as text
+	} `json:"function"`
+}
+
+// ToolDefinition is a function tool offered to the model, in OpenAI's format.
+type ToolDefinition struct {
+	Type     string `json:"type"` // always "function"
+	Function struct {
+		Name        string         `json:"name"`
+		Description string         `json:"description,omitempty"`
+		Parameters  map[string]any `json:"parameters"`
+	} `json:"function"`
 }
 
 type ChatCompletionChunk struct {
-	Content      string // text delta
-	Done         bool   // true when stream is finished
-	FinishReason string // "stop", "length", etc. (only set when Done)
-	Usage        *Usage // only set when Done
-	Error        error  // non-nil if something went wrong
+	Content      string     // text delta
+	Reasoning    string     // reasoning (thinking) delta, kept apart from the answer
+	Done         bool       // true when stream is finished
+	FinishReason string     // "stop", "length", "tool_calls", etc. (only set when Done)
+	Usage        *Usage     // only set when Done
+	ToolCalls    []ToolCall // complete tool calls (only set when Done, by ToolCallers)
+	Trace        *ToolTrace // agent loop progress — set by the server, never by providers
+	Error        error      // non-nil if something went wrong
+}
+
+// ToolTrace records one tool call made by the daemon's agent loop.
+type ToolTrace struct {
+	Iteration  int             `json:"iteration"`
+	Server     string          `json:"server"`
+	Tool       string          `json:"tool"`
+	Arguments  json.RawMessage `json:"arguments"`
+	Result     string          `json:"result"`
+	IsError    bool            `json:"is_error,omitempty"`
+	DurationMS int64           `json:"duration_ms"`
+}
+
+// ToolCaller is implemented by providers whose models can call functions
+// passed in AgentTools. The server runs its own agent loop for them, since
+// unlike the agent CLIs they cannot execute tools themselves.
+type ToolCaller interface {
+	SupportsTools() bool
+}
+
+// WorkspaceAgent is implemented by providers running an agent that can act
+// on the request's Workspace itself (edit files, run commands) when its
+// scope or tool policy allows.
+type WorkspaceAgent interface {
+	UsesWorkspace() bool
+}
+
+// Forwarder is implemented by providers that can relay OpenAI endpoints
+// other than chat completions (audio, images, moderations) to their
+// upstream. path is the endpoint without the /v1 prefix, e.g.
+// "/audio/speech"; model is the request's model, if any. The caller closes
+// the response body.
+type Forwarder interface {
+	Forward(ctx context.Context, path, model, contentType string, body []byte) (*http.Response, error)
+}
+
+// Breaker is implemented by providers that stop sending requests to a
+// failing upstream for a while. Such a provider reports itself unavailable
+// while its breaker is open but stays routable: its requests should reach
+// Complete, which fails them with a 503 and Retry-After.
+type Breaker interface {
+	BreakerOpen() bool
+}
+
+// Routable reports whether requests may be routed to p: it is available,
+// or only refusing requests while its circuit breaker is open.
+func Routable(p Provider) bool {
+	if p.Available() {
+		return true
+	}
+	b, ok := p.(Breaker)
+	return ok && b.BreakerOpen()
 }
 
 type Usage struct {
 	PromptTokens     int `json:"prompt_tokens"`
 	CompletionTokens int `json:"completion_tokens"`
 	TotalTokens      int `json:"total_tokens"`
+
+	// Estimated marks usage counted by the daemon (internal/tokens) because
+	// the provider didn't report any.
+	Estimated bool `json:"-"`
 }
 
 // Registry holds all configured providers.
@@ -87,6 +215,17 @@ func (r *Registry) Available() []Provider {
 	return out
 }
 
+// Routable returns the providers requests may be routed to (see Routable).
+func (r *Registry) Routable() []Provider {
+	var out []Provider
+	for _, p := range r.providers {
+		if Routable(p) {
+			out = append(out, p)
+		}
+	}
+	return out
+}
+
 func (r *Registry) AllModels() []Model {
 	var models []Model
 	for _, p := range r.providers {
@@ -107,12 +246,10 @@ func (r *Registry) FindByID(id string) Provider {
 	return nil
 }
 
-// FindProvider returns the first available provider that serves the given model.
+// FindProvider returns the first routable provider that serves the given model.
 func (r *Registry) FindProvider(model string) Provider {
-	for _, p := range r.providers {
-		if !p.Available() {
-			continue
-		}
+	routable := r.Routable()
+	for _, p := range routable {
 		for _, m := range p.Models() {
 			if m.ID == model {
 				return p
@@ -120,9 +257,10 @@ func (r *Registry) FindProvider(model string) Provider {
 		}
 	}
 	// Fallback: if model not found, return first available provider
-	avail := r.Available()
-	if len(avail) > 0 {
-		return avail[0]
+	for _, p := range routable {
+		if p.Available() {
+			return p
+		}
 	}
 	return nil
 }
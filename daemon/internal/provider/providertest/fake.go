@@ -0,0 +1,46 @@
+package providertest
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// FakeCLI writes an executable shell script named name into a temporary
+// directory and returns its path, for use as a CLI provider's cli_path.
+func FakeCLI(t *testing.T, name, body string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	script := "#!/bin/sh\n" + body
+	if err := os.WriteFile(path, []byte(script), 0755); err != nil {
+		t.Fatalf("writing fake CLI: %v", err)
+	}
+	return path
+}
+
+// NDJSON returns a script body that prints lines to stdout, pausing delay
+// between them. With pidFile set, the script first writes its PID there
+// (see Options.PIDFile). The script ignores its arguments.
+func NDJSON(lines []string, delay time.Duration, pidFile string) string {
+	var b strings.Builder
+	if pidFile != "" {
+		fmt.Fprintf(&b, "echo $$ > %s\n", shellQuote(pidFile))
+	}
+	for i, line := range lines {
+		if i > 0 && delay > 0 {
+			// sleep must not hold stdout, or killing the script leaves
+			// the pipe open until sleep exits
+			fmt.Fprintf(&b, "sleep %.3f >/dev/null\n", delay.Seconds())
+		}
+		fmt.Fprintf(&b, "printf '%%s\\n' %s\n", shellQuote(line))
+	}
+	return b.String()
+}
+
+// shellQuote wraps s in single quotes for sh.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
@@ -0,0 +1,9 @@
+//go:build !unix
+
+package providertest
+
+// processAlive can't probe processes on this platform, so the subprocess
+// part of the cancellation check always passes.
+func processAlive(pid int) bool {
+	return false
+}
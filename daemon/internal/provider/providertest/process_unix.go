@@ -0,0 +1,10 @@
+//go:build unix
+
+package providertest
+
+import "syscall"
+
+// processAlive reports whether a process with the given PID exists.
+func processAlive(pid int) bool {
+	return syscall.Kill(pid, 0) == nil
+}
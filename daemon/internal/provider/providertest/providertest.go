@@ -0,0 +1,275 @@
+// Package providertest checks that a provider.Provider follows the contract
+// the server relies on. Provider tests call Run with requests that exercise
+// the provider against a fake CLI or server:
+//
+//	func TestConformance(t *testing.T) {
+//		cli := providertest.FakeCLI(t, "claude", providertest.NDJSON(lines, 0, ""))
+//		providertest.Run(t, claude.New(cli, ""), providertest.Options{
+//			Request: &provider.ChatCompletionRequest{Messages: ...},
+//		})
+//	}
+package providertest
+
+import (
+	"context"
+	"errors"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"plugmyai/internal/provider"
+)
+
+// DefaultTimeout bounds each stream the kit reads.
+const DefaultTimeout = 10 * time.Second
+
+// Options selects the checks to run. Only Request is required; the other
+// checks are skipped when their request is nil.
+type Options struct {
+	// Request must complete successfully.
+	Request *provider.ChatCompletionRequest
+
+	// SlowRequest streams long enough to be cancelled after its first chunk.
+	SlowRequest *provider.ChatCompletionRequest
+
+	// PIDFile, if set, is where the fake CLI behind SlowRequest writes its
+	// process ID, so the kit can check cancellation also ends the process.
+	PIDFile string
+
+	// FailingRequest must fail: Complete returns an error, or the stream
+	// carries an Error chunk.
+	FailingRequest *provider.ChatCompletionRequest
+
+	// Timeout bounds each stream. Defaults to DefaultTimeout.
+	Timeout time.Duration
+}
+
+// Run runs the conformance checks as subtests of t.
+func Run(t *testing.T, p provider.Provider, opts Options) {
+	t.Helper()
+	if opts.Timeout <= 0 {
+		opts.Timeout = DefaultTimeout
+	}
+
+	t.Run("Identity", func(t *testing.T) { checkIdentity(t, p) })
+	t.Run("Models", func(t *testing.T) { checkModels(t, p) })
+	t.Run("Complete", func(t *testing.T) {
+		if opts.Request == nil {
+			t.Fatal("Options.Request is required")
+		}
+		checkComplete(t, p, opts.Request, opts.Timeout)
+	})
+	t.Run("Cancel", func(t *testing.T) {
+		if opts.SlowRequest == nil {
+			t.Skip("no SlowRequest")
+		}
+		checkCancel(t, p, opts.SlowRequest, opts.PIDFile, opts.Timeout)
+	})
+	t.Run("Error", func(t *testing.T) {
+		if opts.FailingRequest == nil {
+			t.Skip("no FailingRequest")
+		}
+		checkError(t, p, opts.FailingRequest, opts.Timeout)
+	})
+}
+
+func checkIdentity(t *testing.T, p provider.Provider) {
+	if p.ID() == "" {
+		t.Error("ID() is empty")
+	}
+	if p.Name() == "" {
+		t.Error("Name() is empty")
+	}
+	if p.ID() != p.ID() {
+		t.Error("ID() is not stable")
+	}
+}
+
+// checkModels verifies Models() is stable and well-formed.
+func checkModels(t *testing.T, p provider.Provider) {
+	first, second := p.Models(), p.Models()
+	if !reflect.DeepEqual(first, second) {
+		t.Errorf("Models() changed between calls:\n%v\n%v", first, second)
+	}
+
+	seen := map[string]bool{}
+	for _, m := range first {
+		if m.ID == "" {
+			t.Errorf("model with empty ID: %+v", m)
+		}
+		if m.Provider != p.ID() {
+			t.Errorf("model %s has Provider %q, want %q", m.ID, m.Provider, p.ID())
+		}
+		if seen[m.ID] {
+			t.Errorf("duplicate model ID %s", m.ID)
+		}
+		seen[m.ID] = true
+	}
+}
+
+// checkComplete verifies a successful stream: it closes, carries exactly one
+// Done chunk as its last chunk, and reports sane usage.
+func checkComplete(t *testing.T, p provider.Provider, req *provider.ChatCompletionRequest, timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	stream, err := p.Complete(ctx, clone(req))
+	if err != nil {
+		t.Fatalf("Complete: %v", err)
+	}
+	chunks, closed := Drain(stream, timeout)
+	if !closed {
+		t.Fatalf("stream not closed within %v", timeout)
+	}
+
+	dones := 0
+	for i, c := range chunks {
+		if c.Error != nil {
+			t.Errorf("chunk %d: unexpected error: %v", i, c.Error)
+		}
+		if !c.Done {
+			if c.Usage != nil {
+				t.Errorf("chunk %d: Usage set on a chunk that isn't Done", i)
+			}
+			continue
+		}
+		dones++
+		if i != len(chunks)-1 {
+			t.Errorf("chunk %d: Done chunk followed by %d more", i, len(chunks)-1-i)
+		}
+		if c.FinishReason == "" {
+			t.Errorf("chunk %d: Done chunk has no FinishReason", i)
+		}
+		CheckUsage(t, c.Usage)
+	}
+	if dones != 1 {
+		t.Errorf("got %d Done chunks, want exactly 1", dones)
+	}
+}
+
+// checkCancel cancels a stream after its first chunk and verifies the
+// channel closes and, with a PID file, that the subprocess exits.
+func checkCancel(t *testing.T, p provider.Provider, req *provider.ChatCompletionRequest, pidFile string, timeout time.Duration) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	stream, err := p.Complete(ctx, clone(req))
+	if err != nil {
+		t.Fatalf("Complete: %v", err)
+	}
+
+	select {
+	case _, ok := <-stream:
+		if !ok {
+			t.Fatal("stream closed before its first chunk")
+		}
+	case <-time.After(timeout):
+		t.Fatalf("no chunk within %v", timeout)
+	}
+
+	cancel()
+	if _, closed := Drain(stream, timeout); !closed {
+		t.Fatalf("stream not closed within %v of cancellation", timeout)
+	}
+
+	if pidFile == "" {
+		return
+	}
+	pid, err := readPID(pidFile)
+	if err != nil {
+		t.Fatalf("reading PID file: %v", err)
+	}
+	deadline := time.Now().Add(timeout)
+	for processAlive(pid) {
+		if time.Now().After(deadline) {
+			t.Fatalf("process %d still running %v after cancellation", pid, timeout)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+// checkError verifies a failure is reported and the stream still closes.
+func checkError(t *testing.T, p provider.Provider, req *provider.ChatCompletionRequest, timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	stream, err := p.Complete(ctx, clone(req))
+	if err != nil {
+		return // failing up front is fine
+	}
+	chunks, closed := Drain(stream, timeout)
+	if !closed {
+		t.Fatalf("stream not closed within %v", timeout)
+	}
+
+	for _, c := range chunks {
+		if c.Error != nil {
+			return
+		}
+	}
+	t.Errorf("failing request produced no Error chunk (%d chunks)", len(chunks))
+}
+
+// Drain reads a stream until it closes or timeout passes, reporting whether
+// it closed.
+func Drain(stream <-chan provider.ChatCompletionChunk, timeout time.Duration) ([]provider.ChatCompletionChunk, bool) {
+	var chunks []provider.ChatCompletionChunk
+	deadline := time.After(timeout)
+	for {
+		select {
+		case c, ok := <-stream:
+			if !ok {
+				return chunks, true
+			}
+			chunks = append(chunks, c)
+		case <-deadline:
+			return chunks, false
+		}
+	}
+}
+
+// CheckUsage reports malformed usage: negative counts, or a total that
+// doesn't add up. nil usage is allowed.
+func CheckUsage(t *testing.T, u *provider.Usage) {
+	t.Helper()
+	if u == nil {
+		return
+	}
+	if u.PromptTokens < 0 || u.CompletionTokens < 0 || u.TotalTokens < 0 {
+		t.Errorf("negative usage: %+v", *u)
+	}
+	if u.TotalTokens != 0 && u.TotalTokens != u.PromptTokens+u.CompletionTokens {
+		t.Errorf("usage total %d != prompt %d + completion %d", u.TotalTokens, u.PromptTokens, u.CompletionTokens)
+	}
+}
+
+// clone copies a request so one check can't affect the next.
+func clone(req *provider.ChatCompletionRequest) *provider.ChatCompletionRequest {
+	c := *req
+	c.Messages = append([]provider.Message(nil), req.Messages...)
+	return &c
+}
+
+func readPID(path string) (int, error) {
+	// The fake CLI may not have written it yet when the first chunk arrives
+	var data []byte
+	var err error
+	for i := 0; i < 50; i++ {
+		data, err = os.ReadFile(path)
+		if err == nil && len(strings.TrimSpace(string(data))) > 0 {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if err != nil {
+		return 0, err
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return 0, errors.New("PID file does not hold a process ID")
+	}
+	return pid, nil
+}
@@ -0,0 +1,139 @@
+package replay
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"plugmyai/internal/provider"
+)
+
+// CassetteVersion is the cassette file format version.
+const CassetteVersion = 1
+
+// Cassette is a file of recorded completions, looked up by Key.
+type Cassette struct {
+	Version      int           `json:"version"`
+	Interactions []Interaction `json:"interactions"`
+}
+
+// Interaction is one recorded completion: the request that produced it and
+// the chunks the provider streamed back.
+type Interaction struct {
+	Key        string             `json:"key"`
+	Model      string             `json:"model"`
+	Messages   []provider.Message `json:"messages"`
+	Chunks     []Chunk            `json:"chunks"`
+	RecordedAt time.Time          `json:"recorded_at"`
+}
+
+// Chunk is a recorded provider.ChatCompletionChunk. DelayMS is the time
+// since the previous chunk (or since the request, for the first one).
+type Chunk struct {
+	DelayMS      int64           `json:"delay_ms"`
+	Content      string          `json:"content,omitempty"`
+	Reasoning    string          `json:"reasoning,omitempty"`
+	Done         bool            `json:"done,omitempty"`
+	FinishReason string          `json:"finish_reason,omitempty"`
+	Usage        *provider.Usage `json:"usage,omitempty"`
+	Error        string          `json:"error,omitempty"`
+}
+
+// Key identifies a request in a cassette: a SHA-256 of the model and the
+// normalised messages. Normalising trims surrounding whitespace and line
+// ending differences, so cosmetic changes in test fixtures still match.
+func Key(model string, messages []provider.Message) string {
+	h := sha256.New()
+	h.Write([]byte(strings.TrimSpace(model)))
+	for _, m := range messages {
+		h.Write([]byte{0})
+		h.Write([]byte(strings.ToLower(strings.TrimSpace(m.Role))))
+		h.Write([]byte{0})
+		content := strings.ReplaceAll(m.Content, "\r\n", "\n")
+		h.Write([]byte(strings.TrimSpace(content)))
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// LoadCassette reads a cassette file. A missing file is an empty cassette.
+func LoadCassette(path string) (*Cassette, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return &Cassette{Version: CassetteVersion}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading cassette: %w", err)
+	}
+
+	var c Cassette
+	if err := json.Unmarshal(data, &c); err != nil {
+		return nil, fmt.Errorf("parsing cassette %s: %w", path, err)
+	}
+	if c.Version > CassetteVersion {
+		return nil, fmt.Errorf("cassette %s has unsupported version %d", path, c.Version)
+	}
+	return &c, nil
+}
+
+// Save writes the cassette atomically (temp file + rename).
+func (c *Cassette) Save(path string) error {
+	c.Version = CassetteVersion
+	data, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return fmt.Errorf("marshaling cassette: %w", err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return fmt.Errorf("creating cassette dir: %w", err)
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return fmt.Errorf("writing cassette: %w", err)
+	}
+	return os.Rename(tmp, path)
+}
+
+// Add stores an interaction, replacing any earlier one with the same key.
+func (c *Cassette) Add(in Interaction) {
+	if in.Key == "" {
+		in.Key = Key(in.Model, in.Messages)
+	}
+	for i := range c.Interactions {
+		if c.Interactions[i].Key == in.Key {
+			c.Interactions[i] = in
+			return
+		}
+	}
+	c.Interactions = append(c.Interactions, in)
+}
+
+// Find returns the interaction recorded for key, or nil.
+func (c *Cassette) Find(key string) *Interaction {
+	for i := range c.Interactions {
+		if c.Interactions[i].Key == key {
+			return &c.Interactions[i]
+		}
+	}
+	return nil
+}
+
+// TextInteraction builds an interaction from a finished completion, for
+// sources that only kept the full text (such as request history). The text
+// becomes a single chunk followed by a Done chunk after duration.
+func TextInteraction(model string, messages []provider.Message, content string, usage *provider.Usage, duration time.Duration) Interaction {
+	return Interaction{
+		Key:      Key(model, messages),
+		Model:    model,
+		Messages: messages,
+		Chunks: []Chunk{
+			{Content: content, DelayMS: duration.Milliseconds()},
+			{Done: true, FinishReason: "stop", Usage: usage},
+		},
+		RecordedAt: time.Now().UTC(),
+	}
+}
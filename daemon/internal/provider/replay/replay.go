@@ -0,0 +1,265 @@
+// Package replay serves completions from recorded cassettes, for fast and
+// deterministic tests of apps built on the daemon. In record mode it wraps
+// another provider and records what that provider streams.
+package replay
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"plugmyai/internal/provider"
+)
+
+// Config holds config for the replay provider.
+type Config struct {
+	Cassette string `json:"cassette"`           // path to the cassette file
+	Mode     string `json:"mode,omitempty"`     // "replay" (default) or "record"
+	Realtime bool   `json:"realtime,omitempty"` // replay: reproduce recorded chunk timing
+
+	// Record is the provider to wrap in record mode, as in the providers list.
+	Record *struct {
+		Type   string          `json:"type"`
+		Config json.RawMessage `json:"config,omitempty"`
+	} `json:"record,omitempty"`
+}
+
+func init() {
+	provider.RegisterFactory("replay", Factory)
+}
+
+// Factory creates a replay provider from raw JSON config.
+func Factory(rawConfig json.RawMessage) (provider.Provider, error) {
+	var cfg Config
+	if rawConfig != nil {
+		if err := json.Unmarshal(rawConfig, &cfg); err != nil {
+			return nil, fmt.Errorf("parsing replay config: %w", err)
+		}
+	}
+	if cfg.Cassette == "" {
+		return nil, fmt.Errorf("replay: cassette path is required")
+	}
+
+	cassette, err := LoadCassette(cfg.Cassette)
+	if err != nil {
+		return nil, err
+	}
+	p := &Provider{path: cfg.Cassette, cassette: cassette, realtime: cfg.Realtime}
+
+	switch cfg.Mode {
+	case "", "replay":
+	case "record":
+		if cfg.Record == nil || cfg.Record.Type == "" {
+			return nil, fmt.Errorf("replay: record mode needs a provider to wrap")
+		}
+		inner, err := provider.CreateProvider(cfg.Record.Type, cfg.Record.Config)
+		if err != nil {
+			return nil, fmt.Errorf("replay: creating recorded provider: %w", err)
+		}
+		p.inner = inner
+	default:
+		return nil, fmt.Errorf("replay: unknown mode %q", cfg.Mode)
+	}
+	return p, nil
+}
+
+// ErrNotRecorded is returned when a replayed request has no interaction in
+// the cassette.
+var ErrNotRecorded = errors.New("no recorded interaction for this request")
+
+// Provider replays a cassette, or records one when inner is set.
+type Provider struct {
+	path     string
+	realtime bool
+	inner    provider.Provider // record mode: the provider being recorded
+
+	mu       sync.Mutex
+	cassette *Cassette
+}
+
+func (p *Provider) ID() string { return "replay" }
+
+func (p *Provider) Name() string {
+	if p.inner != nil {
+		return "Replay (recording " + p.inner.Name() + ")"
+	}
+	return "Replay"
+}
+
+func (p *Provider) Available() bool {
+	if p.inner != nil {
+		return p.inner.Available()
+	}
+	return true
+}
+
+// SupportedParams passes on the wrapped provider's parameters in record
+// mode. Replay ignores them: interactions are matched on model and messages.
+func (p *Provider) SupportedParams() []string {
+	if ps, ok := p.inner.(provider.ParamSupporter); ok {
+		return ps.SupportedParams()
+	}
+	return nil
+}
+
+// UsesWorkspace passes on the wrapped provider's answer in record mode.
+// Replayed completions never touch the workspace.
+func (p *Provider) UsesWorkspace() bool {
+	wa, ok := p.inner.(provider.WorkspaceAgent)
+	return ok && wa.UsesWorkspace()
+}
+
+// Models lists the models recorded in the cassette, plus the wrapped
+// provider's models in record mode.
+func (p *Provider) Models() []provider.Model {
+	var models []provider.Model
+	seen := map[string]bool{}
+	if p.inner != nil {
+		for _, m := range p.inner.Models() {
+			seen[m.ID] = true
+			models = append(models, provider.Model{ID: m.ID, Name: m.Name, Provider: "replay"})
+		}
+	}
+
+	p.mu.Lock()
+	var recorded []string
+	for _, in := range p.cassette.Interactions {
+		if !seen[in.Model] {
+			seen[in.Model] = true
+			recorded = append(recorded, in.Model)
+		}
+	}
+	p.mu.Unlock()
+
+	sort.Strings(recorded)
+	for _, id := range recorded {
+		models = append(models, provider.Model{ID: id, Name: id + " (replay)", Provider: "replay"})
+	}
+	return models
+}
+
+func (p *Provider) Complete(ctx context.Context, req *provider.ChatCompletionRequest) (<-chan provider.ChatCompletionChunk, error) {
+	if p.inner != nil {
+		return p.record(ctx, req)
+	}
+
+	key := Key(req.Model, req.Messages)
+	p.mu.Lock()
+	in := p.cassette.Find(key)
+	p.mu.Unlock()
+	if in == nil {
+		return nil, fmt.Errorf("%w (model %q, key %s)", ErrNotRecorded, req.Model, key[:12])
+	}
+
+	ch := make(chan provider.ChatCompletionChunk, 32)
+
+	go func() {
+		defer close(ch)
+		for _, c := range in.Chunks {
+			if p.realtime && c.DelayMS > 0 {
+				select {
+				case <-time.After(time.Duration(c.DelayMS) * time.Millisecond):
+				case <-ctx.Done():
+					return
+				}
+			}
+
+			chunk := provider.ChatCompletionChunk{
+				Content:      c.Content,
+				Reasoning:    c.Reasoning,
+				Done:         c.Done,
+				FinishReason: c.FinishReason,
+				Usage:        c.Usage,
+			}
+			if c.Error != "" {
+				chunk.Error = errors.New(c.Error)
+			}
+			select {
+			case ch <- chunk:
+			case <-ctx.Done():
+				return
+			}
+			if chunk.Done || chunk.Error != nil {
+				return // the stream ends at its first Done or error
+			}
+		}
+	}()
+
+	return ch, nil
+}
+
+// record passes the wrapped provider's stream through while capturing it,
+// and saves the interaction once the stream ends. Cancelled requests are
+// not recorded — their stream is incomplete.
+func (p *Provider) record(ctx context.Context, req *provider.ChatCompletionRequest) (<-chan provider.ChatCompletionChunk, error) {
+	start := time.Now()
+	stream, err := p.inner.Complete(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	in := Interaction{
+		Key:      Key(req.Model, req.Messages),
+		Model:    req.Model,
+		Messages: append([]provider.Message(nil), req.Messages...),
+	}
+	ch := make(chan provider.ChatCompletionChunk, 32)
+
+	go func() {
+		defer close(ch)
+
+		last := start
+		for chunk := range stream {
+			now := time.Now()
+			c := Chunk{
+				DelayMS:      now.Sub(last).Milliseconds(),
+				Content:      chunk.Content,
+				Reasoning:    chunk.Reasoning,
+				Done:         chunk.Done,
+				FinishReason: chunk.FinishReason,
+				Usage:        chunk.Usage,
+			}
+			if chunk.Error != nil {
+				c.Error = chunk.Error.Error()
+			}
+			in.Chunks = append(in.Chunks, c)
+			last = now
+
+			select {
+			case ch <- chunk:
+			case <-ctx.Done():
+				// Drain so the wrapped provider can finish
+				for range stream {
+				}
+				return
+			}
+		}
+
+		if ctx.Err() != nil {
+			return
+		}
+		in.RecordedAt = time.Now().UTC()
+		// The client already has its Done chunk, so a failed save can only
+		// be logged
+		if err := p.save(in); err != nil {
+			log.Printf("%v", err)
+		}
+	}()
+
+	return ch, nil
+}
+
+func (p *Provider) save(in Interaction) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.cassette.Add(in)
+	if err := p.cassette.Save(p.path); err != nil {
+		return fmt.Errorf("replay: saving cassette: %w", err)
+	}
+	return nil
+}
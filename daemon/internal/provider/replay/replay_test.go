@@ -0,0 +1,113 @@
+package replay
+
+import (
+	"context"
+	"encoding/json"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"plugmyai/internal/provider"
+	_ "plugmyai/internal/provider/mock" // wrapped in record mode
+	"plugmyai/internal/provider/providertest"
+)
+
+func newProvider(t *testing.T, cfg map[string]any) provider.Provider {
+	t.Helper()
+	raw, _ := json.Marshal(cfg)
+	p, err := Factory(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestConformance(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cassette.json")
+
+	c := &Cassette{}
+	c.Add(TextInteraction("gpt-test", request("gpt-test", "Say hello").Messages, "Hello!",
+		&provider.Usage{PromptTokens: 2, CompletionTokens: 1, TotalTokens: 3}, 0))
+	slow := Interaction{Model: "gpt-test", Messages: request("gpt-test", "Count").Messages}
+	for _, word := range []string{"one ", "two ", "three ", "four ", "five"} {
+		slow.Chunks = append(slow.Chunks, Chunk{Content: word, DelayMS: 200})
+	}
+	slow.Chunks = append(slow.Chunks, Chunk{Done: true, FinishReason: "stop"})
+	c.Add(slow)
+	c.Add(Interaction{
+		Model:    "gpt-test",
+		Messages: request("gpt-test", "Fail").Messages,
+		Chunks:   []Chunk{{Content: "Par"}, {Error: "upstream went away"}},
+	})
+	if err := c.Save(path); err != nil {
+		t.Fatal(err)
+	}
+
+	providertest.Run(t, newProvider(t, map[string]any{"cassette": path, "realtime": true}), providertest.Options{
+		Request:        request("gpt-test", "Say hello"),
+		SlowRequest:    request("gpt-test", "Count"),
+		FailingRequest: request("gpt-test", "Fail"),
+	})
+}
+
+func TestRecordConformance(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cassette.json")
+	p := newProvider(t, map[string]any{
+		"cassette": path,
+		"mode":     "record",
+		"record":   map[string]any{"type": "mock"},
+	})
+
+	providertest.Run(t, p, providertest.Options{
+		Request:        request("mock-echo", "Say hello"),
+		SlowRequest:    request("mock-slow", "one two three four five"),
+		FailingRequest: request("mock-error", "Go"),
+	})
+}
+
+func TestRecordThenReplay(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cassette.json")
+	recorder := newProvider(t, map[string]any{
+		"cassette": path,
+		"mode":     "record",
+		"record":   map[string]any{"type": "mock"},
+	})
+	recorded := collect(t, recorder, request("mock-think", "Say hello"))
+
+	player := newProvider(t, map[string]any{"cassette": path})
+	replayed := collect(t, player, request("mock-think", " Say hello\r\n"))
+	if len(replayed) != len(recorded) {
+		t.Fatalf("replayed %d chunks, recorded %d", len(replayed), len(recorded))
+	}
+	for i := range recorded {
+		r, p := recorded[i], replayed[i]
+		if r.Content != p.Content || r.Reasoning != p.Reasoning || r.Done != p.Done || r.FinishReason != p.FinishReason {
+			t.Errorf("chunk %d: replayed %+v, recorded %+v", i, p, r)
+		}
+	}
+
+	_, err := player.Complete(context.Background(), request("mock-think", "Something else"))
+	if err == nil {
+		t.Error("unrecorded request replayed")
+	}
+}
+
+func collect(t *testing.T, p provider.Provider, req *provider.ChatCompletionRequest) []provider.ChatCompletionChunk {
+	t.Helper()
+	stream, err := p.Complete(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chunks, closed := providertest.Drain(stream, 5*time.Second)
+	if !closed {
+		t.Fatal("stream not closed")
+	}
+	return chunks
+}
+
+func request(model, prompt string) *provider.ChatCompletionRequest {
+	return &provider.ChatCompletionRequest{
+		Model:    model,
+		Messages: []provider.Message{{Role: "user", Content: prompt}},
+	}
+}
@@ -0,0 +1,110 @@
+package provider
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// CommandSpec describes a CLI invocation before any isolation is applied.
+type CommandSpec struct {
+	Path string   // executable, ideally an absolute path
+	Args []string // arguments, not including Path
+	Dir  string   // working directory (the app's workspace); mounted read-write
+	Env  []string // KEY=value environment for the process
+
+	// ReadOnly lists host paths the command needs to read, such as the CLI install.
+	ReadOnly []string
+	// Writable lists host paths besides Dir the command must write to,
+	// such as the CLI's session/credential state. Missing paths are skipped.
+	Writable []string
+}
+
+// SandboxPolicy is the per-app isolation setting. Set by the server.
+type SandboxPolicy struct {
+	Runner  string // registered runner name (e.g. "bwrap"); "" = run directly
+	Network bool   // allow network access inside the sandbox
+}
+
+// Runner launches CLI commands inside an isolation backend.
+// Backends live in their own package and self-register via init(),
+// the same way providers do.
+type Runner interface {
+	// Available reports whether the backend works on this system.
+	Available() bool
+
+	// Command wraps spec so that it runs inside the sandbox.
+	Command(ctx context.Context, spec CommandSpec, policy SandboxPolicy) (*exec.Cmd, error)
+}
+
+var runners = map[string]Runner{}
+
+// RegisterRunner registers an isolation backend under the given name.
+// Typically called from the backend package's init() function.
+func RegisterRunner(name string, r Runner) {
+	runners[name] = r
+}
+
+// LookupRunner returns the runner registered under name.
+func LookupRunner(name string) (Runner, bool) {
+	r, ok := runners[name]
+	return r, ok
+}
+
+// RunnerNames returns the names of all registered runners, sorted.
+func RunnerNames() []string {
+	names := make([]string, 0, len(runners))
+	for name := range runners {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Command builds the *exec.Cmd for spec. Without a sandbox policy the command
+// runs directly; otherwise it is wrapped by the named runner. An unknown or
+// unavailable runner is an error — a sandboxed app never silently runs unsandboxed.
+func Command(ctx context.Context, spec CommandSpec, policy *SandboxPolicy) (*exec.Cmd, error) {
+	if policy == nil || policy.Runner == "" {
+		cmd := exec.CommandContext(ctx, spec.Path, spec.Args...)
+		cmd.Dir = spec.Dir
+		cmd.Env = spec.Env
+		return cmd, nil
+	}
+
+	r, ok := runners[policy.Runner]
+	if !ok {
+		return nil, fmt.Errorf("unknown sandbox runner: %s", policy.Runner)
+	}
+	if !r.Available() {
+		return nil, fmt.Errorf("sandbox runner %s is not available on this system", policy.Runner)
+	}
+	return r.Command(ctx, spec, *policy)
+}
+
+// InstallPaths returns the host paths a sandboxed CLI needs read-only access to:
+// the directory holding the executable on PATH and, if that is a symlink, the
+// package it points into (e.g. an npm global install under node_modules).
+func InstallPaths(path string) []string {
+	paths := []string{filepath.Dir(path)}
+
+	real, err := filepath.EvalSymlinks(path)
+	if err != nil || real == path {
+		return paths
+	}
+
+	root := filepath.Dir(real)
+	if before, after, ok := strings.Cut(real, string(filepath.Separator)+"node_modules"+string(filepath.Separator)); ok {
+		// Keep node_modules/<pkg> or node_modules/@scope/<pkg>
+		parts := strings.Split(after, string(filepath.Separator))
+		n := 1
+		if strings.HasPrefix(parts[0], "@") && len(parts) > 1 {
+			n = 2
+		}
+		root = filepath.Join(append([]string{before, "node_modules"}, parts[:n]...)...)
+	}
+	return append(paths, root)
+}
@@ -0,0 +1,93 @@
+package provider
+
+import (
+	"strings"
+	"time"
+)
+
+// ToolPolicy is a per-app allow/deny list of agent tools, using Claude Code
+// tool names ("Read", "Grep", "Bash", "Write", ...). Entries may carry a
+// Claude Code argument pattern such as "Bash(git log:*)"; "*" in Allow
+// permits every tool. Deny always wins over Allow.
+type ToolPolicy struct {
+	Allow []string `json:"allow"`
+	Deny  []string `json:"deny"`
+}
+
+// WriteTools are the tools that modify the filesystem or run commands.
+// Providers without per-tool controls use them to pick a coarser mode.
+var WriteTools = []string{"Bash", "Write", "Edit", "MultiEdit", "NotebookEdit"}
+
+// Allows reports whether the policy permits the named tool in some form.
+func (tp *ToolPolicy) Allows(tool string) bool {
+	if tp.Denies(tool) {
+		return false
+	}
+	for _, a := range tp.Allow {
+		if a == "*" || toolName(a) == tool {
+			return true
+		}
+	}
+	return false
+}
+
+// Denies reports whether the policy explicitly denies the named tool.
+func (tp *ToolPolicy) Denies(tool string) bool {
+	for _, d := range tp.Deny {
+		if d == "*" || d == tool {
+			return true
+		}
+	}
+	return false
+}
+
+// AllowsAny reports whether the policy permits at least one of the tools.
+func (tp *ToolPolicy) AllowsAny(tools []string) bool {
+	for _, t := range tools {
+		if tp.Allows(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// toolName strips an argument pattern: "Bash(git log:*)" → "Bash".
+func toolName(entry string) string {
+	if i := strings.IndexByte(entry, '('); i >= 0 {
+		return entry[:i]
+	}
+	return entry
+}
+
+// ApprovalHook routes tool calls back to the daemon for a human decision
+// before they run. Providers that support hooks invoke Executable with Args
+// for each matching tool call; the hook blocks until the user decides or
+// Timeout passes (which counts as a deny).
+type ApprovalHook struct {
+	Executable string        // absolute path of the hook binary (the daemon itself)
+	Args       []string      // arguments identifying the run to the daemon
+	Tools      []string      // tool names that need approval; empty = WriteTools
+	Timeout    time.Duration // how long the provider should wait for the hook
+}
+
+// Matcher returns the tool names needing approval as a "|"-separated pattern.
+func (h *ApprovalHook) Matcher() string {
+	tools := h.Tools
+	if len(tools) == 0 {
+		tools = WriteTools
+	}
+	return strings.Join(tools, "|")
+}
+
+// ShellCommand returns the hook invocation as a single shell-quoted string.
+func (h *ApprovalHook) ShellCommand() string {
+	parts := []string{shellQuote(h.Executable)}
+	for _, a := range h.Args {
+		parts = append(parts, shellQuote(a))
+	}
+	return strings.Join(parts, " ")
+}
+
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
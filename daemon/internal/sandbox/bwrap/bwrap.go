@@ -0,0 +1,72 @@
+// Package bwrap runs CLI providers inside a bubblewrap sandbox on Linux.
+//
+// The sandbox sees the system directories and the CLI install read-only, the
+// app's workspace (plus the CLI's own state directories) read-write, and
+// nothing else from the host filesystem. Network access follows the policy;
+// the server always grants it, since the CLIs need it for their model APIs.
+package bwrap
+
+import (
+	"context"
+	"os/exec"
+	"runtime"
+
+	"plugmyai/internal/provider"
+)
+
+func init() {
+	provider.RegisterRunner("bwrap", &Runner{path: "bwrap"})
+}
+
+// systemPaths are mounted read-only so dynamically linked binaries, shells,
+// TLS certificates and DNS configuration keep working inside the sandbox.
+var systemPaths = []string{"/usr", "/bin", "/sbin", "/lib", "/lib32", "/lib64", "/etc", "/opt"}
+
+// Runner wraps commands with bwrap(1).
+type Runner struct {
+	path string
+}
+
+func (r *Runner) Available() bool {
+	if runtime.GOOS != "linux" {
+		return false
+	}
+	path, err := exec.LookPath(r.path)
+	return err == nil && path != ""
+}
+
+func (r *Runner) Command(ctx context.Context, spec provider.CommandSpec, policy provider.SandboxPolicy) (*exec.Cmd, error) {
+	args := []string{
+		"--die-with-parent",
+		"--new-session",
+		"--unshare-all",
+	}
+	if policy.Network {
+		args = append(args, "--share-net")
+	}
+
+	for _, p := range systemPaths {
+		args = append(args, "--ro-bind-try", p, p)
+	}
+	args = append(args,
+		"--proc", "/proc",
+		"--dev", "/dev",
+		"--tmpfs", "/tmp",
+	)
+	for _, p := range spec.ReadOnly {
+		args = append(args, "--ro-bind-try", p, p)
+	}
+	for _, p := range spec.Writable {
+		args = append(args, "--bind-try", p, p)
+	}
+	if spec.Dir != "" {
+		args = append(args, "--bind", spec.Dir, spec.Dir, "--chdir", spec.Dir)
+	}
+
+	args = append(args, "--", spec.Path)
+	args = append(args, spec.Args...)
+
+	cmd := exec.CommandContext(ctx, r.path, args...)
+	cmd.Env = spec.Env
+	return cmd, nil
+}
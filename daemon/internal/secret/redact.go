@@ -0,0 +1,62 @@
+package secret
+
+import (
+	"io"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Mask replaces redacted values.
+const Mask = "[redacted]"
+
+// minRedactLen keeps very short values from masking unrelated text.
+const minRedactLen = 6
+
+var (
+	redactMu sync.RWMutex
+	redacted []string // longest first, so overlapping values mask fully
+)
+
+// Register adds a value to be masked by Redact.
+func Register(value string) {
+	if len(value) < minRedactLen {
+		return
+	}
+	redactMu.Lock()
+	defer redactMu.Unlock()
+	for _, v := range redacted {
+		if v == value {
+			return
+		}
+	}
+	redacted = append(redacted, value)
+	sort.Slice(redacted, func(i, j int) bool { return len(redacted[i]) > len(redacted[j]) })
+}
+
+// Redact masks every registered value in s.
+func Redact(s string) string {
+	redactMu.RLock()
+	defer redactMu.RUnlock()
+	for _, v := range redacted {
+		if strings.Contains(s, v) {
+			s = strings.ReplaceAll(s, v, Mask)
+		}
+	}
+	return s
+}
+
+// RedactingWriter wraps w, masking registered values in everything written.
+// Use it as the log output: each log line arrives in a single Write.
+func RedactingWriter(w io.Writer) io.Writer {
+	return redactingWriter{w}
+}
+
+type redactingWriter struct{ w io.Writer }
+
+func (rw redactingWriter) Write(p []byte) (int, error) {
+	if _, err := io.WriteString(rw.w, Redact(string(p))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
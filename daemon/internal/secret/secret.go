@@ -0,0 +1,142 @@
+// Package secret keeps credentials out of config.json. Config values may be
+// references instead of the credential itself:
+//
+//	env:NAME     the environment variable NAME
+//	file:PATH    the contents of PATH, trimmed (~ expands to the home directory)
+//	secret:NAME  NAME from the daemon's encrypted secrets file (see Store)
+//
+// Resolved values are registered for redaction, so they are masked in logs
+// and error messages.
+package secret
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// refPattern matches a whole config value that is a secret reference.
+var refPattern = regexp.MustCompile(`^(env|file|secret):(\S+)$`)
+
+// IsRef reports whether value is a secret reference.
+func IsRef(value string) bool {
+	return refPattern.MatchString(value)
+}
+
+// Resolver resolves secret references. The secrets file is opened the first
+// time a secret: reference needs it.
+type Resolver struct {
+	dataDir string
+
+	once  sync.Once
+	store *Store
+	err   error
+}
+
+// NewResolver returns a resolver using the secrets file in dataDir.
+func NewResolver(dataDir string) *Resolver {
+	return &Resolver{dataDir: dataDir}
+}
+
+// Resolve returns the value a reference points to. Values that aren't
+// references are returned unchanged.
+func (r *Resolver) Resolve(value string) (string, error) {
+	m := refPattern.FindStringSubmatch(value)
+	if m == nil {
+		return value, nil
+	}
+	kind, name := m[1], m[2]
+
+	var resolved string
+	switch kind {
+	case "env":
+		v, ok := os.LookupEnv(name)
+		if !ok || v == "" {
+			return "", fmt.Errorf("%s: environment variable not set", value)
+		}
+		resolved = v
+	case "file":
+		if strings.HasPrefix(name, "~/") {
+			if home, err := os.UserHomeDir(); err == nil {
+				name = filepath.Join(home, name[2:])
+			}
+		}
+		data, err := os.ReadFile(name)
+		if err != nil {
+			return "", fmt.Errorf("%s: %w", value, err)
+		}
+		resolved = strings.TrimSpace(string(data))
+		if resolved == "" {
+			return "", fmt.Errorf("%s: file is empty", value)
+		}
+	case "secret":
+		r.once.Do(func() { r.store, r.err = OpenStore(r.dataDir) })
+		if r.err != nil {
+			return "", r.err
+		}
+		v, err := r.store.Get(name)
+		if err != nil {
+			return "", err
+		}
+		resolved = v
+	}
+
+	Register(resolved)
+	return resolved, nil
+}
+
+// ResolveJSON resolves every string in a JSON document that is a secret
+// reference, so any provider's config can use them without knowing about
+// this package.
+func (r *Resolver) ResolveJSON(raw json.RawMessage) (json.RawMessage, error) {
+	if len(raw) == 0 {
+		return raw, nil
+	}
+	var doc any
+	if err := json.Unmarshal(raw, &doc); err != nil {
+		return nil, err
+	}
+
+	changed := false
+	var walk func(v any) (any, error)
+	walk = func(v any) (any, error) {
+		switch v := v.(type) {
+		case string:
+			if !IsRef(v) {
+				return v, nil
+			}
+			changed = true
+			return r.Resolve(v)
+		case map[string]any:
+			for k, e := range v {
+				out, err := walk(e)
+				if err != nil {
+					return nil, fmt.Errorf("%s: %w", k, err)
+				}
+				v[k] = out
+			}
+		case []any:
+			for i, e := range v {
+				out, err := walk(e)
+				if err != nil {
+					return nil, fmt.Errorf("[%d]: %w", i, err)
+				}
+				v[i] = out
+			}
+		}
+		return v, nil
+	}
+
+	doc, err := walk(doc)
+	if err != nil {
+		return nil, err
+	}
+	if !changed {
+		return raw, nil
+	}
+	return json.Marshal(doc)
+}
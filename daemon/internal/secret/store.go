@@ -0,0 +1,167 @@
+package secret
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const (
+	StoreFileName = "secrets.json"
+	KeyFileName   = "secret.key"
+
+	// KeyEnv, if set, holds the master key (hex) instead of KeyFileName.
+	KeyEnv = "PLUGMYAI_MASTER_KEY"
+)
+
+// Store is the daemon-managed secrets file. Each value is encrypted with
+// AES-256-GCM under a master key kept next to it in secret.key (created on
+// first use, mode 0600) or given in $PLUGMYAI_MASTER_KEY. Names are stored
+// in the clear so they can be listed without the key.
+type Store struct {
+	path string
+	gcm  cipher.AEAD
+
+	Version int               `json:"version"`
+	Secrets map[string]string `json:"secrets"` // name → base64(nonce || ciphertext)
+}
+
+// OpenStore opens the secrets file in dataDir, creating the master key if
+// there is none yet.
+func OpenStore(dataDir string) (*Store, error) {
+	key, err := masterKey(dataDir)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("secrets: %w", err)
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("secrets: %w", err)
+	}
+
+	s := &Store{path: filepath.Join(dataDir, StoreFileName), gcm: gcm, Version: 1}
+	data, err := os.ReadFile(s.path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("reading secrets: %w", err)
+	}
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, s); err != nil {
+			return nil, fmt.Errorf("parsing %s: %w", s.path, err)
+		}
+	}
+	if s.Secrets == nil {
+		s.Secrets = map[string]string{}
+	}
+	return s, nil
+}
+
+func masterKey(dataDir string) ([]byte, error) {
+	if v := os.Getenv(KeyEnv); v != "" {
+		return decodeKey(v, "$"+KeyEnv)
+	}
+
+	path := filepath.Join(dataDir, KeyFileName)
+	data, err := os.ReadFile(path)
+	if err == nil {
+		return decodeKey(string(data), path)
+	}
+	if !os.IsNotExist(err) {
+		return nil, fmt.Errorf("reading master key: %w", err)
+	}
+
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, fmt.Errorf("generating master key: %w", err)
+	}
+	if err := os.MkdirAll(dataDir, 0700); err != nil {
+		return nil, fmt.Errorf("creating data dir: %w", err)
+	}
+	if err := os.WriteFile(path, []byte(hex.EncodeToString(key)+"\n"), 0600); err != nil {
+		return nil, fmt.Errorf("writing master key: %w", err)
+	}
+	return key, nil
+}
+
+func decodeKey(s, source string) ([]byte, error) {
+	key, err := hex.DecodeString(strings.TrimSpace(s))
+	if err != nil || len(key) != 32 {
+		return nil, fmt.Errorf("master key in %s must be 64 hex characters", source)
+	}
+	return key, nil
+}
+
+// Get decrypts the secret called name.
+func (s *Store) Get(name string) (string, error) {
+	enc, ok := s.Secrets[name]
+	if !ok {
+		return "", fmt.Errorf("secret:%s: not found in %s", name, s.path)
+	}
+	data, err := base64.StdEncoding.DecodeString(enc)
+	if err != nil || len(data) < s.gcm.NonceSize() {
+		return "", fmt.Errorf("secret:%s: corrupt entry", name)
+	}
+	nonce, ciphertext := data[:s.gcm.NonceSize()], data[s.gcm.NonceSize():]
+	plain, err := s.gcm.Open(nil, nonce, ciphertext, []byte(name))
+	if err != nil {
+		return "", fmt.Errorf("secret:%s: cannot decrypt (wrong master key?)", name)
+	}
+	return string(plain), nil
+}
+
+// Set encrypts value under name and saves the file.
+func (s *Store) Set(name, value string) error {
+	if name == "" || strings.ContainsAny(name, " \t\n") {
+		return errors.New("secret names must be non-empty and without whitespace")
+	}
+	nonce := make([]byte, s.gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	sealed := s.gcm.Seal(nonce, nonce, []byte(value), []byte(name))
+	s.Secrets[name] = base64.StdEncoding.EncodeToString(sealed)
+	return s.save()
+}
+
+// Delete removes name and saves the file. It reports whether name existed.
+func (s *Store) Delete(name string) (bool, error) {
+	if _, ok := s.Secrets[name]; !ok {
+		return false, nil
+	}
+	delete(s.Secrets, name)
+	return true, s.save()
+}
+
+// Names lists the stored secrets, sorted.
+func (s *Store) Names() []string {
+	names := make([]string, 0, len(s.Secrets))
+	for name := range s.Secrets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// save writes the file atomically.
+func (s *Store) save() error {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return fmt.Errorf("writing secrets: %w", err)
+	}
+	return os.Rename(tmp, s.path)
+}
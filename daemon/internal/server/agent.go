@@ -0,0 +1,316 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"regexp"
+	"sort"
+	"time"
+
+	"plugmyai/internal/mcp"
+	"plugmyai/internal/provider"
+)
+
+const (
+	agentDialTimeout = 30 * time.Second
+	agentToolTimeout = 2 * time.Minute
+)
+
+// agentTool maps a function name offered to the model to an MCP server tool.
+type agentTool struct {
+	client *mcp.Client
+	tool   string
+}
+
+// complete starts a completion, running the daemon's agent loop when the app
+// has MCP servers and the provider's models call functions rather than run
+// tools themselves.
+//
+// Stop sequences, max_tokens and response_format are applied here for
+// providers that don't support them.
+func (s *Server) complete(ctx context.Context, p provider.Provider, req *provider.ChatCompletionRequest) (<-chan provider.ChatCompletionChunk, error) {
+	if wantsJSON(req) {
+		return s.runStructured(ctx, p, req)
+	}
+	return s.withLimits(ctx, p, req)
+}
+
+// withLimits starts a completion, cutting it at the first stop sequence and
+// at max_tokens when the provider can't.
+func (s *Server) withLimits(ctx context.Context, p provider.Provider, req *provider.ChatCompletionRequest) (<-chan provider.ChatCompletionChunk, error) {
+	stop := len(req.Stop) > 0 && !provider.Supports(p, provider.ParamStop)
+	limit := req.MaxTokens != nil && *req.MaxTokens > 0 && !provider.Supports(p, provider.ParamMaxTokens)
+	if !stop && !limit {
+		return s.start(ctx, p, req)
+	}
+
+	runCtx, cancel := context.WithCancel(ctx)
+	stream, err := s.start(runCtx, p, req)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	switch {
+	case !limit:
+		return applyStop(runCtx, stream, req.Stop, cancel), nil
+	case stop:
+		stream = applyStop(runCtx, stream, req.Stop, cancel)
+	}
+	return applyMaxTokens(ctx, stream, *req.MaxTokens, cancel), nil
+}
+
+func (s *Server) start(ctx context.Context, p provider.Provider, req *provider.ChatCompletionRequest) (<-chan provider.ChatCompletionChunk, error) {
+	if tc, ok := p.(provider.ToolCaller); ok && tc.SupportsTools() && len(req.MCPServers) > 0 {
+		return s.runAgent(ctx, p, req)
+	}
+	return p.Complete(ctx, req)
+}
+
+// runAgent offers the tools of the app's MCP servers to the model, executes
+// the calls it makes, feeds the results back, and repeats until the model
+// answers without calling tools. Only the final answer is streamed, with one
+// Trace chunk per tool call and each turn's reasoning before it. Usage is
+// summed over all turns.
+func (s *Server) runAgent(ctx context.Context, p provider.Provider, req *provider.ChatCompletionRequest) (<-chan provider.ChatCompletionChunk, error) {
+	tools, defs, closeAll := s.connectAgentTools(ctx, req)
+	if len(defs) == 0 {
+		closeAll()
+		return p.Complete(ctx, req)
+	}
+
+	ch := make(chan provider.ChatCompletionChunk, 32)
+
+	go func() {
+		defer close(ch)
+		defer closeAll()
+
+		send := func(chunk provider.ChatCompletionChunk) bool {
+			select {
+			case ch <- chunk:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		}
+
+		messages := append([]provider.Message(nil), req.Messages...)
+		var usage *provider.Usage
+		maxIterations := s.cfg.AgentIterations()
+
+		for iteration := 1; iteration <= maxIterations; iteration++ {
+			turn := *req
+			turn.Messages = messages
+			turn.AgentTools = defs
+
+			stream, err := p.Complete(ctx, &turn)
+			if err != nil {
+				send(provider.ChatCompletionChunk{Error: fmt.Errorf("provider error: %w", err)})
+				return
+			}
+			content, reasoning, done, err := drainTurn(stream)
+			if err != nil {
+				send(provider.ChatCompletionChunk{Error: err})
+				return
+			}
+			if reasoning != "" && !send(provider.ChatCompletionChunk{Reasoning: reasoning}) {
+				return
+			}
+			usage = addUsage(usage, done.Usage)
+
+			if len(done.ToolCalls) == 0 {
+				// Final answer
+				if content != "" && !send(provider.ChatCompletionChunk{Content: content}) {
+					return
+				}
+				finish := done.FinishReason
+				if finish == "" || finish == "tool_calls" {
+					finish = "stop"
+				}
+				send(provider.ChatCompletionChunk{Done: true, FinishReason: finish, Usage: usage})
+				return
+			}
+
+			messages = append(messages, provider.Message{Role: "assistant", Content: content, ToolCalls: done.ToolCalls})
+			for i, call := range done.ToolCalls {
+				if call.ID == "" {
+					call.ID = fmt.Sprintf("call_%d_%d", iteration, i)
+					messages[len(messages)-1].ToolCalls[i].ID = call.ID
+				}
+				trace := s.callAgentTool(ctx, req, tools, call, iteration)
+				result := trace.Result
+				if trace.IsError {
+					result = "Error: " + result
+				}
+				messages = append(messages, provider.Message{
+					Role:       "tool",
+					ToolCallID: call.ID,
+					Name:       call.Function.Name,
+					Content:    result,
+				})
+				if !send(provider.ChatCompletionChunk{Trace: &trace}) {
+					return
+				}
+			}
+		}
+
+		send(provider.ChatCompletionChunk{
+			Error: fmt.Errorf("agent loop stopped after %d iterations without a final answer", maxIterations),
+		})
+	}()
+
+	return ch, nil
+}
+
+// connectAgentTools connects to the request's MCP servers and returns their
+// tools as function definitions, skipping tools the app's policy denies.
+// A server that can't be reached is logged and left out.
+func (s *Server) connectAgentTools(ctx context.Context, req *provider.ChatCompletionRequest) (map[string]agentTool, []provider.ToolDefinition, func()) {
+	names := make([]string, 0, len(req.MCPServers))
+	for name := range req.MCPServers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	tools := map[string]agentTool{}
+	var defs []provider.ToolDefinition
+	var clients []*mcp.Client
+	closeAll := func() {
+		for _, c := range clients {
+			c.Close()
+		}
+	}
+
+	dialCtx, cancel := context.WithTimeout(ctx, agentDialTimeout)
+	defer cancel()
+
+	for _, name := range names {
+		if req.Tools != nil && req.Tools.Denies("mcp__"+name) {
+			continue
+		}
+		client, err := mcp.Dial(dialCtx, name, req.MCPServers[name], provider.CLIEnv(nil))
+		if err != nil {
+			log.Printf("agent: %v", err)
+			continue
+		}
+		clients = append(clients, client)
+
+		list, err := client.ListTools(dialCtx)
+		if err != nil {
+			log.Printf("agent: %v", err)
+			continue
+		}
+		for _, t := range list {
+			if req.Tools != nil && req.Tools.Denies("mcp__"+name+"__"+t.Name) {
+				continue
+			}
+			fn := functionName(name, t.Name)
+			if _, dup := tools[fn]; dup {
+				continue
+			}
+			tools[fn] = agentTool{client: client, tool: t.Name}
+
+			var def provider.ToolDefinition
+			def.Type = "function"
+			def.Function.Name = fn
+			def.Function.Description = t.Description
+			def.Function.Parameters = t.InputSchema
+			if def.Function.Parameters == nil {
+				def.Function.Parameters = map[string]any{"type": "object", "properties": map[string]any{}}
+			}
+			defs = append(defs, def)
+		}
+	}
+	return tools, defs, closeAll
+}
+
+// callAgentTool executes one tool call, asking the user first when the app
+// requires approval. Failures are reported in the trace, for the model to see.
+func (s *Server) callAgentTool(ctx context.Context, req *provider.ChatCompletionRequest, tools map[string]agentTool, call provider.ToolCall, iteration int) provider.ToolTrace {
+	start := time.Now()
+	trace := provider.ToolTrace{
+		Iteration: iteration,
+		Tool:      call.Function.Name,
+		Arguments: json.RawMessage(call.Function.Arguments),
+	}
+	if !json.Valid(trace.Arguments) {
+		trace.Arguments = json.RawMessage("{}")
+	}
+	fail := func(format string, args ...any) provider.ToolTrace {
+		trace.Result = fmt.Sprintf(format, args...)
+		trace.IsError = true
+		trace.DurationMS = time.Since(start).Milliseconds()
+		return trace
+	}
+
+	t, ok := tools[call.Function.Name]
+	if !ok {
+		return fail("unknown tool: %s", call.Function.Name)
+	}
+	trace.Server = t.client.Name()
+	trace.Tool = t.tool
+
+	if req.Approval != nil {
+		run := approvalRun{AppID: ctx.Value(ctxAppID).(string), AppName: ctx.Value(ctxAppName).(string)}
+		approved, reason, err := s.awaitApproval(ctx, run, "mcp__"+trace.Server+"__"+t.tool, trace.Arguments)
+		if err != nil {
+			return fail("%v", err)
+		}
+		if !approved {
+			return fail("tool call not allowed: %s", reason)
+		}
+	}
+
+	callCtx, cancel := context.WithTimeout(ctx, agentToolTimeout)
+	defer cancel()
+	result, err := t.client.CallTool(callCtx, t.tool, trace.Arguments)
+	if err != nil {
+		return fail("%v", err)
+	}
+	trace.Result = result.Text()
+	trace.IsError = result.IsError
+	trace.DurationMS = time.Since(start).Milliseconds()
+	return trace
+}
+
+// drainTurn reads one model turn to the end, returning its text, its
+// reasoning and the Done chunk (which carries tool calls and usage).
+func drainTurn(stream <-chan provider.ChatCompletionChunk) (content, reasoning string, done provider.ChatCompletionChunk, err error) {
+	for chunk := range stream {
+		if chunk.Error != nil {
+			return "", "", done, chunk.Error
+		}
+		content += chunk.Content
+		reasoning += chunk.Reasoning
+		if chunk.Done && !done.Done {
+			done = chunk
+		}
+	}
+	return content, reasoning, done, nil
+}
+
+func addUsage(total, turn *provider.Usage) *provider.Usage {
+	if turn == nil {
+		return total
+	}
+	if total == nil {
+		total = &provider.Usage{}
+	}
+	total.PromptTokens += turn.PromptTokens
+	total.CompletionTokens += turn.CompletionTokens
+	total.TotalTokens += turn.TotalTokens
+	return total
+}
+
+var invalidFunctionChars = regexp.MustCompile(`[^a-zA-Z0-9_-]`)
+
+// functionName builds the function name offered to the model for an MCP
+// tool, within OpenAI's ^[a-zA-Z0-9_-]{1,64}$ limits.
+func functionName(server, tool string) string {
+	name := invalidFunctionChars.ReplaceAllString(server+"__"+tool, "_")
+	if len(name) > 64 {
+		name = name[:64]
+	}
+	return name
+}
@@ -0,0 +1,121 @@
+package server
+
+import (
+	"encoding/json"
+	"sort"
+	"sync"
+	"time"
+)
+
+// approvalQueue parks agent tool calls until the user approves or denies them.
+//
+// Each completion for an app with approvals enabled registers a run token;
+// the CLI's approval hook presents that token when it asks about a tool call,
+// so a hook can only raise approvals for the run it belongs to.
+type approvalQueue struct {
+	mu      sync.Mutex
+	runs    map[string]approvalRun      // run token → app
+	pending map[string]*pendingApproval // approval ID → parked tool call
+}
+
+type approvalRun struct {
+	AppID   string
+	AppName string
+}
+
+type pendingApproval struct {
+	ID        string          `json:"id"`
+	AppID     string          `json:"app_id"`
+	AppName   string          `json:"app_name"`
+	Tool      string          `json:"tool"`
+	Input     json.RawMessage `json:"input"`
+	CreatedAt time.Time       `json:"created_at"`
+	ExpiresAt time.Time       `json:"expires_at"`
+
+	decision chan bool // buffered; the first decision wins
+}
+
+func newApprovalQueue() *approvalQueue {
+	return &approvalQueue{
+		runs:    map[string]approvalRun{},
+		pending: map[string]*pendingApproval{},
+	}
+}
+
+// startRun registers a completion and returns the token its hook must present.
+func (q *approvalQueue) startRun(appID, appName string) string {
+	token := "pma_run_" + generateShortID() + generateShortID()
+	q.mu.Lock()
+	q.runs[token] = approvalRun{AppID: appID, AppName: appName}
+	q.mu.Unlock()
+	return token
+}
+
+func (q *approvalQueue) endRun(token string) {
+	q.mu.Lock()
+	delete(q.runs, token)
+	q.mu.Unlock()
+}
+
+func (q *approvalQueue) lookupRun(token string) (approvalRun, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	run, ok := q.runs[token]
+	return run, ok
+}
+
+// park adds a tool call to the pending list. The caller waits on its decision
+// channel and must call remove when done.
+func (q *approvalQueue) park(run approvalRun, tool string, input json.RawMessage, timeout time.Duration) *pendingApproval {
+	now := time.Now()
+	pa := &pendingApproval{
+		ID:        generateShortID(),
+		AppID:     run.AppID,
+		AppName:   run.AppName,
+		Tool:      tool,
+		Input:     input,
+		CreatedAt: now,
+		ExpiresAt: now.Add(timeout),
+		decision:  make(chan bool, 1),
+	}
+	q.mu.Lock()
+	q.pending[pa.ID] = pa
+	q.mu.Unlock()
+	return pa
+}
+
+// resolve records a decision. Returns false if the approval is unknown
+// or already decided.
+func (q *approvalQueue) resolve(id string, approved bool) bool {
+	q.mu.Lock()
+	pa, ok := q.pending[id]
+	q.mu.Unlock()
+	if !ok {
+		return false
+	}
+	select {
+	case pa.decision <- approved:
+		return true
+	default:
+		return false
+	}
+}
+
+func (q *approvalQueue) remove(id string) {
+	q.mu.Lock()
+	delete(q.pending, id)
+	q.mu.Unlock()
+}
+
+// list returns pending approvals, oldest first.
+func (q *approvalQueue) list() []pendingApproval {
+	q.mu.Lock()
+	out := make([]pendingApproval, 0, len(q.pending))
+	for _, pa := range q.pending {
+		out = append(out, *pa)
+	}
+	q.mu.Unlock()
+
+	sort.Slice(out, func(i, j int) bool { return out[i].CreatedAt.Before(out[j].CreatedAt) })
+	return out
+}
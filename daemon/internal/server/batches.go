@@ -0,0 +1,633 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"plugmyai/internal/provider"
+	"plugmyai/internal/store"
+)
+
+const (
+	// maxBatchRequests caps the requests of one batch, as OpenAI does.
+	maxBatchRequests = 50000
+
+	// batchWindow is the only completion_window supported: a batch still
+	// running after it expires.
+	batchWindow = 24 * time.Hour
+
+	// maxBatchErrors caps the input errors reported for a rejected batch.
+	maxBatchErrors = 100
+)
+
+// batchRegistry tracks the batches running in this process, so they can be
+// cancelled. A run is registered before it starts and stays registered
+// until its outcome is stored.
+type batchRegistry struct {
+	mu   sync.Mutex
+	runs map[string]*batchRun
+}
+
+type batchRun struct {
+	cancel    context.CancelFunc
+	finishing bool // the outcome is being decided and stored
+}
+
+func newBatchRegistry() *batchRegistry {
+	return &batchRegistry{runs: make(map[string]*batchRun)}
+}
+
+func (r *batchRegistry) put(id string, cancel context.CancelFunc) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.runs[id] = &batchRun{cancel: cancel}
+}
+
+func (r *batchRegistry) remove(id string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.runs, id)
+}
+
+// finish marks a run as storing its outcome; cancelling it has no effect
+// from then on.
+func (r *batchRegistry) finish(id string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if run, ok := r.runs[id]; ok {
+		run.finishing = true
+	}
+}
+
+// cancel calls mark and cancels the run of a batch, unless the run is
+// finishing. It reports whether a run is registered and whether it was
+// cancelled; mark runs under the registry's lock, so a run can't start
+// finishing in between.
+func (r *batchRegistry) cancel(id string, mark func() error) (running, cancelled bool, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	run, ok := r.runs[id]
+	if !ok {
+		return false, false, nil
+	}
+	if run.finishing {
+		return true, false, nil
+	}
+	if err := mark(); err != nil {
+		return true, false, err
+	}
+	run.cancel()
+	return true, true, nil
+}
+
+// batchError is a problem with a batch's input file, in OpenAI's format.
+type batchError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	Param   any    `json:"param"`
+	Line    int    `json:"line,omitempty"` // from 1
+}
+
+// readBatchInput parses a batch input file: one request per line, as
+// {"custom_id", "method": "POST", "url": endpoint, "body"}.
+func readBatchInput(r io.Reader, endpoint string) ([]store.BatchItem, []batchError) {
+	var items []store.BatchItem
+	var problems []batchError
+	seen := make(map[string]bool)
+	fail := func(line int, code, msg string) {
+		if len(problems) < maxBatchErrors {
+			problems = append(problems, batchError{Code: code, Message: msg, Line: line})
+		}
+	}
+
+	br := bufio.NewReader(r)
+	for lineNo := 1; ; lineNo++ {
+		line, err := br.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return nil, []batchError{{Code: "invalid_file", Message: "reading file: " + err.Error()}}
+		}
+		if len(bytes.TrimSpace(line)) > 0 {
+			var in struct {
+				CustomID string          `json:"custom_id"`
+				Method   string          `json:"method"`
+				URL      string          `json:"url"`
+				Body     json.RawMessage `json:"body"`
+			}
+			switch {
+			case json.Unmarshal(line, &in) != nil:
+				fail(lineNo, "invalid_json_line", "line is not a JSON object")
+			case in.CustomID == "":
+				fail(lineNo, "missing_custom_id", "custom_id is required")
+			case seen[in.CustomID]:
+				fail(lineNo, "duplicate_custom_id", "custom_id must be unique: "+in.CustomID)
+			case in.Method != http.MethodPost:
+				fail(lineNo, "invalid_method", "method must be POST")
+			case in.URL != endpoint:
+				fail(lineNo, "mismatched_endpoint", "url must be the batch's endpoint, "+endpoint)
+			case len(in.Body) == 0 || in.Body[0] != '{':
+				fail(lineNo, "invalid_body", "body must be a JSON object")
+			default:
+				seen[in.CustomID] = true
+				items = append(items, store.BatchItem{Line: len(items), CustomID: in.CustomID, Body: in.Body, Status: "pending"})
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+	}
+
+	switch {
+	case len(problems) > 0:
+		return nil, problems
+	case len(items) == 0:
+		return nil, []batchError{{Code: "empty_file", Message: "the input file has no requests"}}
+	case len(items) > maxBatchRequests:
+		return nil, []batchError{{Code: "too_many_requests", Message: fmt.Sprintf("a batch holds at most %d requests", maxBatchRequests)}}
+	}
+	return items, nil
+}
+
+// orNull is v, or JSON null if it is empty.
+func orNull(v string) any {
+	if v == "" {
+		return nil
+	}
+	return v
+}
+
+// batchObject is a batch in OpenAI's format.
+func batchObject(b *store.Batch) map[string]any {
+	unix := func(t *time.Time) any {
+		if t == nil {
+			return nil
+		}
+		return t.Unix()
+	}
+	var errs, metadata any
+	if b.Errors != nil {
+		errs = b.Errors
+	}
+	if b.Metadata != nil {
+		metadata = b.Metadata
+	}
+	return map[string]any{
+		"id":                b.ID,
+		"object":            "batch",
+		"endpoint":          b.Endpoint,
+		"errors":            errs,
+		"input_file_id":     b.InputFileID,
+		"completion_window": b.CompletionWindow,
+		"status":            b.Status,
+		"output_file_id":    orNull(b.OutputFileID),
+		"error_file_id":     orNull(b.ErrorFileID),
+		"created_at":        b.CreatedAt.Unix(),
+		"in_progress_at":    unix(b.InProgressAt),
+		"expires_at":        b.ExpiresAt.Unix(),
+		"finalizing_at":     unix(b.FinalizingAt),
+		"completed_at":      unix(b.CompletedAt),
+		"failed_at":         unix(b.FailedAt),
+		"expired_at":        unix(b.ExpiredAt),
+		"cancelling_at":     unix(b.CancellingAt),
+		"cancelled_at":      unix(b.CancelledAt),
+		"request_counts": map[string]int{
+			"total":     b.Total,
+			"completed": b.Completed,
+			"failed":    b.Failed,
+		},
+		"metadata": metadata,
+	}
+}
+
+// startBatch registers a batch's run and starts it.
+func (s *Server) startBatch(b *store.Batch) {
+	ctx, cancel := context.WithCancel(context.Background())
+	s.batches.put(b.ID, cancel)
+	go func() {
+		defer s.batches.remove(b.ID)
+		defer cancel()
+		s.runBatch(ctx, b)
+	}()
+}
+
+// runBatch runs a batch's pending requests, at most batch_concurrency at a
+// time over all batches, then writes its output and error files. It also
+// resumes batches a previous daemon left unfinished: requests already run
+// are kept, the rest run now. A batch that can't run is marked failed.
+func (s *Server) runBatch(ctx context.Context, b *store.Batch) {
+	fail := func(what string, err error) {
+		log.Printf("batch %s: %s: %v", b.ID, what, err)
+		s.batches.finish(b.ID)
+		if err := s.store.SetBatchStatus(b.ID, "failed"); err != nil {
+			log.Printf("batch %s: %v", b.ID, err)
+		}
+	}
+
+	var app *store.App
+	if b.AppID != "admin" {
+		var err error
+		if app, err = s.store.GetApp(b.AppID); err != nil {
+			fail("loading app", err)
+			return
+		}
+	}
+
+	ctx, cancel := context.WithDeadline(appContext(ctx, app), b.ExpiresAt)
+	defer cancel()
+
+	if b.AppID != "admin" && (app == nil || app.Revoked) {
+		// The app lost access: stop as if it had cancelled
+		cancel()
+	}
+
+	if b.Status == "in_progress" {
+		items, err := s.store.PendingBatchItems(b.ID)
+		if err != nil {
+			fail("loading requests", err)
+			return
+		}
+
+		var wg sync.WaitGroup
+	run:
+		for _, it := range items {
+			select {
+			case s.batchSlots <- struct{}{}:
+			case <-ctx.Done():
+				break run
+			}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				defer func() { <-s.batchSlots }()
+				s.runBatchItem(ctx, b, it)
+			}()
+		}
+		wg.Wait()
+	}
+
+	// From here on a cancel request is refused: the outcome is being stored
+	s.batches.finish(b.ID)
+	status := "completed"
+	switch {
+	case b.Status == "cancelling" || errors.Is(ctx.Err(), context.Canceled):
+		status = "cancelled"
+	case errors.Is(ctx.Err(), context.DeadlineExceeded):
+		status = "expired"
+	default:
+		if err := s.store.SetBatchStatus(b.ID, "finalizing"); err != nil {
+			log.Printf("batch %s: %v", b.ID, err)
+		}
+	}
+	if err := s.finalizeBatch(b, status); err != nil {
+		log.Printf("batch %s: finalizing: %v", b.ID, err)
+	}
+}
+
+// runBatchItem runs one request of a batch and records its outcome. A
+// request cut short by the batch's cancellation or expiry stays pending.
+func (s *Server) runBatchItem(ctx context.Context, b *store.Batch, it store.BatchItem) {
+	status, resp, requestID, err := s.batchRequest(ctx, b, it.Body)
+	if err != nil && ctx.Err() != nil {
+		return
+	}
+
+	it.Status = "completed"
+	if status != http.StatusOK {
+		it.Status = "failed"
+	}
+	it.StatusCode = status
+	it.Response = resp
+	it.RequestID = requestID
+	if err := s.store.FinishBatchItem(b.ID, &it); err != nil {
+		log.Printf("batch %s: recording request %s: %v", b.ID, it.CustomID, err)
+	}
+}
+
+// batchRequest runs a batch request as /v1/chat/completions would, with the
+// batch app's settings, and logs it to history tagged with the batch. It
+// returns the HTTP status and body of the response, and the ID of its
+// history entry if it got as far as the provider.
+func (s *Server) batchRequest(ctx context.Context, b *store.Batch, body json.RawMessage) (int, json.RawMessage, string, error) {
+	fail := func(err error) (int, json.RawMessage, string, error) {
+		status, resp := errorResult(err)
+		return status, resp, "", err
+	}
+
+	var req provider.ChatCompletionRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		return fail(&completionError{http.StatusBadRequest, "invalid request body: " + err.Error()})
+	}
+	req.Stream = false
+	req.StreamOptions = nil
+	req.Background = false
+
+	n, err := validateCompletion(&req)
+	if err != nil {
+		return fail(err)
+	}
+	p, release, err := s.prepareCompletion(ctx, &req)
+	if err != nil {
+		return fail(err)
+	}
+	defer release()
+	if ignored := ignoredParams(p, &req); len(ignored) > 0 && s.cfg.StrictParams {
+		err := &completionError{http.StatusBadRequest, fmt.Sprintf("%s does not support: %s", p.Name(), strings.Join(ignored, ", "))}
+		return fail(err)
+	}
+
+	startTime := time.Now()
+	stream, err := s.completeChoices(ctx, p, &req, n)
+	if err != nil {
+		return fail(err)
+	}
+	full, usage, err := collectChoices(stream, n)
+	messagesJSON, _ := json.Marshal(req.Messages)
+
+	var resp json.RawMessage
+	status := http.StatusOK
+	if err != nil {
+		// Keep only the tool calls made before the failure
+		for i := range full {
+			full[i].Content = ""
+		}
+		usage = nil
+		status, resp = errorResult(err)
+	} else {
+		if usage == nil {
+			usage = estimateUsage(req.Messages, choicesHistory(full))
+		}
+		resp, _ = json.Marshal(completionResponse("chatcmpl-"+generateShortID(), req.Model, full, usage, startTime))
+	}
+
+	entry := historyEntry(b.AppID, b.AppName, req.Model, p.ID(), messagesJSON, choicesHistory(full), usage, startTime, err)
+	entry.BatchID = b.ID
+	if err := s.store.LogRequest(entry); err != nil {
+		log.Printf("failed to log request: %v", err)
+	}
+	return status, resp, entry.ID, err
+}
+
+// errorResult is the HTTP status and JSON error body a request failing
+// with err gets.
+func errorResult(err error) (int, json.RawMessage) {
+	var ce *completionError
+	if errors.As(err, &ce) {
+		err = &provider.StatusError{Status: ce.status, Message: ce.msg}
+	}
+	status := http.StatusInternalServerError
+	var se *provider.StatusError
+	if errors.As(err, &se) {
+		status = se.Status
+	}
+	return status, json.RawMessage(streamError(err))
+}
+
+// finalizeBatch writes a finished batch's output file (successful
+// responses) and error file (failed ones, and any requests that never ran
+// because the batch was cancelled or expired), in input order, and moves
+// it to its final status.
+func (s *Server) finalizeBatch(b *store.Batch, status string) error {
+	items, err := s.store.FinishedBatchItems(b.ID)
+	if err != nil {
+		return err
+	}
+	var output, errs bytes.Buffer
+	for _, it := range items {
+		line, _ := json.Marshal(map[string]any{
+			"id":        "batch_req_" + generateShortID(),
+			"custom_id": it.CustomID,
+			"response": map[string]any{
+				"status_code": it.StatusCode,
+				"request_id":  orNull(it.RequestID),
+				"body":        it.Response,
+			},
+			"error": nil,
+		})
+		if it.Status == "completed" {
+			output.Write(append(line, '\n'))
+		} else {
+			errs.Write(append(line, '\n'))
+		}
+	}
+
+	if status != "completed" {
+		pending, err := s.store.PendingBatchItems(b.ID)
+		if err != nil {
+			return err
+		}
+		code, msg := "batch_cancelled", "the batch was cancelled before this request ran"
+		if status == "expired" {
+			code, msg = "batch_expired", "the batch expired before this request ran"
+		}
+		for _, it := range pending {
+			line, _ := json.Marshal(map[string]any{
+				"id":        "batch_req_" + generateShortID(),
+				"custom_id": it.CustomID,
+				"response":  nil,
+				"error":     map[string]any{"code": code, "message": msg},
+			})
+			errs.Write(append(line, '\n'))
+		}
+	}
+
+	var outputID, errorID string
+	if output.Len() > 0 {
+		f, err := s.saveFile(b.AppID, b.ID+"_output.jsonl", "batch_output", &output)
+		if err != nil {
+			return err
+		}
+		outputID = f.ID
+	}
+	if errs.Len() > 0 {
+		f, err := s.saveFile(b.AppID, b.ID+"_error.jsonl", "batch_output", &errs)
+		if err != nil {
+			return err
+		}
+		errorID = f.ID
+	}
+	if err := s.store.SetBatchFiles(b.ID, outputID, errorID); err != nil {
+		return err
+	}
+	return s.store.SetBatchStatus(b.ID, status)
+}
+
+// resumeBatches restarts the batches a previous daemon left unfinished.
+func (s *Server) resumeBatches() {
+	batches, err := s.store.ListUnfinishedBatches()
+	if err != nil {
+		log.Printf("failed to load unfinished batches: %v", err)
+		return
+	}
+	for i := range batches {
+		log.Printf("Resuming batch %s (%d of %d requests done)", batches[i].ID, batches[i].Completed+batches[i].Failed, batches[i].Total)
+		s.startBatch(&batches[i])
+	}
+}
+
+// --- Handlers ---
+
+// lookupBatch returns the batch named in the path if the caller may see it.
+func (s *Server) lookupBatch(w http.ResponseWriter, r *http.Request) *store.Batch {
+	b, err := s.store.GetBatch(r.PathValue("id"))
+	if err != nil {
+		jsonError(w, http.StatusInternalServerError, "failed to get batch")
+		return nil
+	}
+	if b == nil || !canAccess(r, b.AppID) {
+		jsonError(w, http.StatusNotFound, "batch not found")
+		return nil
+	}
+	return b
+}
+
+// handleCreateBatch validates an uploaded input file and starts running it.
+// Like OpenAI, a file with bad lines still creates a batch, which fails at
+// once with the problems as its errors.
+func (s *Server) handleCreateBatch(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		InputFileID      string          `json:"input_file_id"`
+		Endpoint         string          `json:"endpoint"`
+		CompletionWindow string          `json:"completion_window"`
+		Metadata         json.RawMessage `json:"metadata"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		jsonError(w, http.StatusBadRequest, "invalid request body: "+err.Error())
+		return
+	}
+	if body.Endpoint != "/v1/chat/completions" {
+		jsonError(w, http.StatusBadRequest, "endpoint must be /v1/chat/completions")
+		return
+	}
+	if body.CompletionWindow != "24h" {
+		jsonError(w, http.StatusBadRequest, `completion_window must be "24h"`)
+		return
+	}
+	if string(body.Metadata) == "null" {
+		body.Metadata = nil
+	}
+
+	in, err := s.store.GetFile(body.InputFileID)
+	if err != nil {
+		jsonError(w, http.StatusInternalServerError, "failed to get file")
+		return
+	}
+	if in == nil || !canAccess(r, in.AppID) {
+		jsonError(w, http.StatusNotFound, "input file not found: "+body.InputFileID)
+		return
+	}
+	if in.Purpose != "batch" {
+		jsonError(w, http.StatusBadRequest, `input file purpose must be "batch"`)
+		return
+	}
+	contents, err := os.Open(s.filePath(in.ID))
+	if err != nil {
+		jsonError(w, http.StatusInternalServerError, "failed to read input file")
+		return
+	}
+	items, problems := readBatchInput(contents, body.Endpoint)
+	contents.Close()
+
+	now := time.Now().UTC()
+	b := &store.Batch{
+		ID:               "batch_" + generateShortID(),
+		AppID:            r.Context().Value(ctxAppID).(string),
+		AppName:          r.Context().Value(ctxAppName).(string),
+		InputFileID:      in.ID,
+		Endpoint:         body.Endpoint,
+		CompletionWindow: body.CompletionWindow,
+		Metadata:         body.Metadata,
+		Total:            len(items),
+		CreatedAt:        now,
+		ExpiresAt:        now.Add(batchWindow),
+	}
+	if problems != nil {
+		b.Status = "failed"
+		b.FailedAt = &now
+		b.Errors, _ = json.Marshal(map[string]any{"object": "list", "data": problems})
+	} else {
+		b.Status = "in_progress"
+		b.InProgressAt = &now
+	}
+	if err := s.store.CreateBatch(b, items); err != nil {
+		log.Printf("failed to create batch: %v", err)
+		jsonError(w, http.StatusInternalServerError, "failed to create batch")
+		return
+	}
+	if b.Status == "in_progress" {
+		s.startBatch(b)
+	}
+	jsonOK(w, batchObject(b))
+}
+
+func (s *Server) handleListBatches(w http.ResponseWriter, r *http.Request) {
+	limit := 20
+	if v := r.URL.Query().Get("limit"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 && n <= 100 {
+			limit = n
+		}
+	}
+	appID := ""
+	if isAdmin, _ := r.Context().Value(ctxIsAdmin).(bool); !isAdmin {
+		appID = r.Context().Value(ctxAppID).(string)
+	}
+	batches, err := s.store.ListBatches(appID, limit)
+	if err != nil {
+		jsonError(w, http.StatusInternalServerError, "failed to list batches")
+		return
+	}
+	data := make([]map[string]any, len(batches))
+	for i := range batches {
+		data[i] = batchObject(&batches[i])
+	}
+	jsonOK(w, map[string]any{"object": "list", "data": data})
+}
+
+func (s *Server) handleGetBatch(w http.ResponseWriter, r *http.Request) {
+	if b := s.lookupBatch(w, r); b != nil {
+		jsonOK(w, batchObject(b))
+	}
+}
+
+// handleCancelBatch stops a running batch. It is "cancelling" until the
+// requests in flight have stopped, then "cancelled" with the results so far.
+// A batch with no run in this process is cancelled on the spot.
+func (s *Server) handleCancelBatch(w http.ResponseWriter, r *http.Request) {
+	b := s.lookupBatch(w, r)
+	if b == nil {
+		return
+	}
+	if b.Status != "in_progress" {
+		jsonError(w, http.StatusConflict, "batch is not in progress: "+b.Status)
+		return
+	}
+
+	running, cancelled, err := s.batches.cancel(b.ID, func() error {
+		return s.store.SetBatchStatus(b.ID, "cancelling")
+	})
+	switch {
+	case err != nil:
+		jsonError(w, http.StatusInternalServerError, "failed to cancel batch")
+		return
+	case running && !cancelled:
+		jsonError(w, http.StatusConflict, "batch is finalizing")
+		return
+	case !running:
+		if err := s.finalizeBatch(b, "cancelled"); err != nil {
+			log.Printf("batch %s: finalizing: %v", b.ID, err)
+			jsonError(w, http.StatusInternalServerError, "failed to cancel batch")
+			return
+		}
+	}
+	s.handleGetBatch(w, r)
+}
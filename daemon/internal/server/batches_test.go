@@ -0,0 +1,50 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestBatchRegistryCancel(t *testing.T) {
+	r := newBatchRegistry()
+	marked := 0
+	mark := func() error { marked++; return nil }
+
+	if running, _, _ := r.cancel("batch_x", mark); running || marked != 0 {
+		t.Fatalf("unregistered batch: running = %v, marked %d times", running, marked)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	r.put("batch_x", cancel)
+	running, cancelled, err := r.cancel("batch_x", mark)
+	if !running || !cancelled || err != nil || marked != 1 {
+		t.Fatalf("running batch: running = %v, cancelled = %v, err = %v, marked %d times", running, cancelled, err, marked)
+	}
+	if ctx.Err() == nil {
+		t.Fatal("running batch: context not cancelled")
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	r.put("batch_y", cancel)
+	r.finish("batch_y")
+	running, cancelled, _ = r.cancel("batch_y", mark)
+	if !running || cancelled || marked != 1 || ctx.Err() != nil {
+		t.Fatalf("finishing batch: running = %v, cancelled = %v, marked %d times, ctx err %v", running, cancelled, marked, ctx.Err())
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	r.put("batch_z", cancel)
+	_, cancelled, err = r.cancel("batch_z", func() error { return errors.New("disk full") })
+	if cancelled || err == nil || ctx.Err() != nil {
+		t.Fatalf("failed mark: cancelled = %v, err = %v, ctx err %v", cancelled, err, ctx.Err())
+	}
+
+	r.remove("batch_x")
+	if running, _, _ := r.cancel("batch_x", mark); running {
+		t.Fatal("removed batch still running")
+	}
+}
@@ -0,0 +1,145 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"plugmyai/internal/provider"
+)
+
+// maxChoices caps n on chat completions.
+const maxChoices = 16
+
+// choiceChunk is a chunk of one of a request's n choices.
+type choiceChunk struct {
+	index int
+	provider.ChatCompletionChunk
+}
+
+// choiceCount validates n, defaulting to 1.
+func choiceCount(req *provider.ChatCompletionRequest) (int, error) {
+	if req.N == nil {
+		return 1, nil
+	}
+	if n := *req.N; n < 1 || n > maxChoices {
+		return 0, &completionError{http.StatusBadRequest, fmt.Sprintf("n must be between 1 and %d", maxChoices)}
+	}
+	return *req.N, nil
+}
+
+// completeChoices runs the n choices of req as independent completions, at
+// most max_parallel_choices at a time, and merges their chunks. Usage is
+// summed over the choices and carried by the Done chunk of the last one to
+// finish. The first error cancels the other choices and ends the stream.
+// Choice 0 starts before returning, so its errors reach the client with
+// their HTTP status.
+func (s *Server) completeChoices(ctx context.Context, p provider.Provider, req *provider.ChatCompletionRequest, n int) (<-chan choiceChunk, error) {
+	ctx, cancel := context.WithCancel(ctx)
+
+	first, err := s.complete(ctx, p, choiceRequest(req, 0))
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	ch := make(chan choiceChunk, 32)
+	// send gives up once the client is gone; the streams are still drained
+	send := func(chunk choiceChunk) {
+		select {
+		case ch <- chunk:
+		case <-ctx.Done():
+		}
+	}
+
+	if n == 1 {
+		go func() {
+			defer close(ch)
+			defer cancel()
+			for chunk := range first {
+				send(choiceChunk{0, chunk})
+			}
+		}()
+		return ch, nil
+	}
+
+	merged := make(chan choiceChunk, 32)
+	slots := make(chan struct{}, s.cfg.ParallelChoices())
+	var wg sync.WaitGroup
+	relay := func(index int, stream <-chan provider.ChatCompletionChunk) {
+		defer wg.Done()
+		defer func() { <-slots }()
+		for chunk := range stream {
+			merged <- choiceChunk{index, chunk}
+		}
+	}
+
+	slots <- struct{}{}
+	wg.Add(n)
+	go relay(0, first)
+	for i := 1; i < n; i++ {
+		go func(i int) {
+			select {
+			case slots <- struct{}{}:
+			case <-ctx.Done():
+				wg.Done()
+				return
+			}
+			stream, err := s.complete(ctx, p, choiceRequest(req, i))
+			if err != nil {
+				merged <- choiceChunk{i, provider.ChatCompletionChunk{Error: err}}
+				<-slots
+				wg.Done()
+				return
+			}
+			relay(i, stream)
+		}(i)
+	}
+	go func() {
+		wg.Wait()
+		close(merged)
+	}()
+
+	go func() {
+		defer close(ch)
+		defer cancel()
+
+		var usage *provider.Usage
+		remaining := n
+		failed := false
+		for chunk := range merged {
+			if failed {
+				continue // draining the cancelled choices
+			}
+			if chunk.Error != nil {
+				failed = true
+				send(chunk)
+				cancel()
+				continue
+			}
+			if chunk.Done {
+				usage = addUsage(usage, chunk.Usage)
+				chunk.Usage = nil
+				if remaining--; remaining == 0 {
+					chunk.Usage = usage
+				}
+			}
+			send(chunk)
+		}
+	}()
+
+	return ch, nil
+}
+
+// choiceRequest is req as run for choice i. Choices get distinct seeds so
+// a seeded request still yields n different samples.
+func choiceRequest(req *provider.ChatCompletionRequest, i int) *provider.ChatCompletionRequest {
+	r := *req
+	r.N = nil
+	if req.Seed != nil {
+		seed := *req.Seed + int64(i)
+		r.Seed = &seed
+	}
+	return &r
+}
@@ -0,0 +1,165 @@
+package server
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"plugmyai/internal/store"
+)
+
+// maxFileBytes caps uploads to /v1/files, as OpenAI does for batch input.
+const maxFileBytes = 200 << 20
+
+// filePath is where a file's contents are kept: DataDir/files/<id>.
+func (s *Server) filePath(id string) string {
+	return filepath.Join(s.cfg.DataDir, "files", id)
+}
+
+// saveFile stores contents as a new file owned by appID.
+func (s *Server) saveFile(appID, filename, purpose string, contents io.Reader) (*store.File, error) {
+	if err := os.MkdirAll(filepath.Join(s.cfg.DataDir, "files"), 0700); err != nil {
+		return nil, err
+	}
+	f := &store.File{
+		ID:        "file-" + generateShortID(),
+		AppID:     appID,
+		Filename:  filename,
+		Purpose:   purpose,
+		CreatedAt: time.Now().UTC(),
+	}
+
+	out, err := os.OpenFile(s.filePath(f.ID), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, err
+	}
+	f.Bytes, err = io.Copy(out, contents)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = s.store.CreateFile(f)
+	}
+	if err != nil {
+		os.Remove(s.filePath(f.ID))
+		return nil, err
+	}
+	return f, nil
+}
+
+// fileObject is a file in OpenAI's format.
+func fileObject(f *store.File) map[string]any {
+	return map[string]any{
+		"id":         f.ID,
+		"object":     "file",
+		"bytes":      f.Bytes,
+		"created_at": f.CreatedAt.Unix(),
+		"filename":   f.Filename,
+		"purpose":    f.Purpose,
+	}
+}
+
+// lookupFile returns the file named in the path if the caller may see it.
+func (s *Server) lookupFile(w http.ResponseWriter, r *http.Request) *store.File {
+	f, err := s.store.GetFile(r.PathValue("id"))
+	if err != nil {
+		jsonError(w, http.StatusInternalServerError, "failed to get file")
+		return nil
+	}
+	if f == nil || !canAccess(r, f.AppID) {
+		jsonError(w, http.StatusNotFound, "file not found")
+		return nil
+	}
+	return f
+}
+
+// handleUploadFile stores a multipart upload ("file" and "purpose" fields).
+// Only batch input files are accepted.
+func (s *Server) handleUploadFile(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxFileBytes+1<<20)
+	if err := r.ParseMultipartForm(32 << 20); err != nil {
+		jsonError(w, http.StatusBadRequest, "invalid multipart upload: "+err.Error())
+		return
+	}
+	defer r.MultipartForm.RemoveAll()
+
+	if purpose := r.FormValue("purpose"); purpose != "batch" {
+		jsonError(w, http.StatusBadRequest, `purpose must be "batch"`)
+		return
+	}
+	upload, header, err := r.FormFile("file")
+	if err != nil {
+		jsonError(w, http.StatusBadRequest, "file is required")
+		return
+	}
+	defer upload.Close()
+	if header.Size > maxFileBytes {
+		jsonError(w, http.StatusRequestEntityTooLarge, "file exceeds 200 MB")
+		return
+	}
+
+	appID := r.Context().Value(ctxAppID).(string)
+	f, err := s.saveFile(appID, filepath.Base(header.Filename), "batch", upload)
+	if err != nil {
+		log.Printf("failed to save upload: %v", err)
+		jsonError(w, http.StatusInternalServerError, "failed to save file")
+		return
+	}
+	jsonOK(w, fileObject(f))
+}
+
+func (s *Server) handleListFiles(w http.ResponseWriter, r *http.Request) {
+	appID := ""
+	if isAdmin, _ := r.Context().Value(ctxIsAdmin).(bool); !isAdmin {
+		appID = r.Context().Value(ctxAppID).(string)
+	}
+	files, err := s.store.ListFiles(appID)
+	if err != nil {
+		jsonError(w, http.StatusInternalServerError, "failed to list files")
+		return
+	}
+	data := make([]map[string]any, len(files))
+	for i := range files {
+		data[i] = fileObject(&files[i])
+	}
+	jsonOK(w, map[string]any{"object": "list", "data": data})
+}
+
+func (s *Server) handleGetFile(w http.ResponseWriter, r *http.Request) {
+	if f := s.lookupFile(w, r); f != nil {
+		jsonOK(w, fileObject(f))
+	}
+}
+
+func (s *Server) handleFileContent(w http.ResponseWriter, r *http.Request) {
+	f := s.lookupFile(w, r)
+	if f == nil {
+		return
+	}
+	contents, err := os.Open(s.filePath(f.ID))
+	if err != nil {
+		jsonError(w, http.StatusInternalServerError, "failed to read file")
+		return
+	}
+	defer contents.Close()
+	w.Header().Set("Content-Type", "application/jsonl")
+	http.ServeContent(w, r, f.Filename, f.CreatedAt, contents)
+}
+
+func (s *Server) handleDeleteFile(w http.ResponseWriter, r *http.Request) {
+	f := s.lookupFile(w, r)
+	if f == nil {
+		return
+	}
+	if err := s.store.DeleteFile(f.ID); err != nil {
+		jsonError(w, http.StatusInternalServerError, "failed to delete file")
+		return
+	}
+	if err := os.Remove(s.filePath(f.ID)); err != nil && !os.IsNotExist(err) {
+		log.Printf("failed to remove file %s: %v", f.ID, err)
+	}
+	jsonOK(w, map[string]any{"id": f.ID, "object": "file", "deleted": true})
+}
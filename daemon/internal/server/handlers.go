@@ -5,16 +5,27 @@ import (
 	"crypto/rand"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
+	"math"
 	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
 
 	"plugmyai/internal/config"
+	"plugmyai/internal/mcp"
 	"plugmyai/internal/provider"
+	"plugmyai/internal/secret"
 	"plugmyai/internal/store"
+	"plugmyai/internal/tokens"
 )
 
 // --- Status ---
@@ -74,47 +85,200 @@ func (s *Server) handleChatCompletions(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if len(req.Messages) == 0 {
-		jsonError(w, http.StatusBadRequest, "messages array is required")
+	n, err := validateCompletion(&req)
+	if err != nil {
+		writeCompletionError(w, err)
 		return
 	}
 
-	// Find provider for the requested model
-	p := s.registry.FindProvider(req.Model)
-	if p == nil {
-		jsonError(w, http.StatusBadRequest, "no available provider for model: "+req.Model)
+	p, release, err := s.prepareCompletion(r.Context(), &req)
+	if err != nil {
+		writeCompletionError(w, err)
 		return
 	}
+	defer func() { release() }()
 
-	// Enforce provider scoping
-	allowed := r.Context().Value(ctxAllowedProviders).([]string)
-	if !providerAllowed(allowed, p.ID()) {
-		jsonError(w, http.StatusForbidden, "app is not allowed to use provider: "+p.ID())
+	if ignored := ignoredParams(p, &req); len(ignored) > 0 {
+		if s.strictParams(r) {
+			jsonError(w, http.StatusBadRequest, fmt.Sprintf("%s does not support: %s", p.Name(), strings.Join(ignored, ", ")))
+			return
+		}
+		w.Header().Set("X-PlugMyAI-Ignored-Params", strings.Join(ignored, ", "))
+	}
+
+	if req.Background {
+		job, err := s.startJob(r.Context(), p, &req, n, release)
+		if err != nil {
+			writeProviderError(w, err)
+			return
+		}
+		release = func() {} // the job releases it when it ends
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(job)
 		return
 	}
 
 	appID := r.Context().Value(ctxAppID).(string)
 	appName := r.Context().Value(ctxAppName).(string)
-	req.Scope = r.Context().Value(ctxScope).(string)
 	startTime := time.Now()
 
 	// Start completion
-	stream, err := p.Complete(r.Context(), &req)
+	stream, err := s.completeChoices(r.Context(), p, &req, n)
 	if err != nil {
-		jsonError(w, http.StatusInternalServerError, "provider error: "+err.Error())
+		writeProviderError(w, err)
 		return
 	}
 
 	messagesJSON, _ := json.Marshal(req.Messages)
 
 	if req.Stream {
-		s.handleStreamingResponse(w, r, stream, p, appID, appName, req.Model, messagesJSON, startTime)
+		s.handleStreamingResponse(w, r, stream, n, p, appID, appName, &req, messagesJSON, startTime)
 	} else {
-		s.handleNonStreamingResponse(w, stream, p, appID, appName, req.Model, messagesJSON, startTime)
+		s.handleNonStreamingResponse(w, stream, n, p, appID, appName, &req, messagesJSON, startTime)
+	}
+}
+
+// validateCompletion checks a chat request's parameters, returning its
+// number of choices.
+func validateCompletion(req *provider.ChatCompletionRequest) (int, error) {
+	if len(req.Messages) == 0 {
+		return 0, &completionError{http.StatusBadRequest, "messages array is required"}
+	}
+	if len(req.Stop) > 4 {
+		return 0, &completionError{http.StatusBadRequest, "stop accepts at most 4 sequences"}
+	}
+	if req.ReasoningEffort != "" && !slices.Contains(provider.ReasoningEfforts, req.ReasoningEffort) {
+		return 0, &completionError{http.StatusBadRequest, "reasoning_effort must be one of: " + strings.Join(provider.ReasoningEfforts, ", ")}
+	}
+	return choiceCount(req)
+}
+
+// daemonParams are the parameters the server applies itself when the
+// provider doesn't support them.
+var daemonParams = map[string]bool{
+	provider.ParamStop:           true,
+	provider.ParamResponseFormat: true,
+	provider.ParamN:              true,
+	provider.ParamMaxTokens:      true,
+}
+
+// ignoredParams lists the parameters req sets that neither p nor the
+// server will honour.
+func ignoredParams(p provider.Provider, req *provider.ChatCompletionRequest) []string {
+	var ignored []string
+	for _, name := range provider.UnsupportedParams(p, req) {
+		if !daemonParams[name] {
+			ignored = append(ignored, name)
+		}
+	}
+	return ignored
+}
+
+// strictParams reports whether unsupported parameters should fail the
+// request: the X-PlugMyAI-Strict-Params header if sent, else strict_params.
+func (s *Server) strictParams(r *http.Request) bool {
+	if v := r.Header.Get("X-PlugMyAI-Strict-Params"); v != "" {
+		strict, err := strconv.ParseBool(v)
+		return err == nil && strict
+	}
+	return s.cfg.StrictParams
+}
+
+// completionError is a chat completion failure that happened before the
+// provider was called, along with the HTTP status to report it as.
+type completionError struct {
+	status int
+	msg    string
+}
+
+func (e *completionError) Error() string { return e.msg }
+
+func writeCompletionError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	if ce, ok := err.(*completionError); ok {
+		status = ce.status
+	}
+	jsonError(w, status, err.Error())
+}
+
+// writeProviderError reports a provider failure, passing on the status of a
+// provider.StatusError (e.g. 429 with Retry-After) instead of a plain 500.
+func writeProviderError(w http.ResponseWriter, err error) {
+	var se *provider.StatusError
+	if errors.As(err, &se) {
+		if se.RetryAfter > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(se.RetryAfter.Seconds()))))
+		}
+		if len(se.Body) > 0 {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(se.Status)
+			w.Write([]byte(secret.Redact(string(se.Body))))
+			return
+		}
+		jsonError(w, se.Status, err.Error())
+		return
+	}
+	jsonError(w, http.StatusInternalServerError, "provider error: "+err.Error())
+}
+
+// prepareCompletion picks the provider for req and applies the calling app's
+// provider scoping and per-app settings (workspace, sandbox, tools, MCP
+// servers, approvals) from ctx. release must be called once the completion
+// has finished.
+func (s *Server) prepareCompletion(ctx context.Context, req *provider.ChatCompletionRequest) (provider.Provider, func(), error) {
+	// Find provider for the requested model
+	p := s.registry.FindProvider(req.Model)
+	if p == nil {
+		return nil, nil, &completionError{http.StatusBadRequest, "no available provider for model: " + req.Model}
+	}
+
+	// Enforce provider scoping
+	allowed := ctx.Value(ctxAllowedProviders).([]string)
+	if !providerAllowed(allowed, p.ID()) {
+		return nil, nil, &completionError{http.StatusForbidden, "app is not allowed to use provider: " + p.ID()}
+	}
+
+	appID := ctx.Value(ctxAppID).(string)
+	appName := ctx.Value(ctxAppName).(string)
+	req.Scope = ctx.Value(ctxScope).(string)
+	app := ctx.Value(ctxApp).(*store.App)
+	workspace, err := s.appWorkspace(app, appID)
+	if err != nil {
+		return nil, nil, err
+	}
+	req.Workspace = workspace
+	if app != nil && app.Sandbox != "" {
+		req.Sandbox = &provider.SandboxPolicy{Runner: app.Sandbox, Network: app.SandboxNetwork}
+	}
+	if app != nil && app.Tools != nil {
+		req.Tools = &provider.ToolPolicy{Allow: app.Tools.Allow, Deny: app.Tools.Deny}
+	}
+	// n choices of an agent CLI are n agents; ones that can write would edit
+	// the app's one workspace side by side
+	wa, agent := p.(provider.WorkspaceAgent)
+	writes := req.Scope == "full" || req.Tools != nil && req.Tools.AllowsAny(provider.WriteTools)
+	if req.N != nil && *req.N > 1 && agent && wa.UsesWorkspace() && writes {
+		return nil, nil, &completionError{http.StatusBadRequest, "n > 1 is not supported for agents that can write to the workspace"}
+	}
+	if app != nil {
+		req.MCPServers = s.grantedMCPServers(app.MCPServers)
+	}
+	release := func() {}
+	if app != nil && app.RequireApproval {
+		token := s.approvals.startRun(appID, appName)
+		hook, err := s.approvalHook(token)
+		if err != nil {
+			s.approvals.endRun(token)
+			return nil, nil, err
+		}
+		req.Approval = hook
+		release = func() { s.approvals.endRun(token) }
 	}
+	return p, release, nil
 }
 
-func (s *Server) handleStreamingResponse(w http.ResponseWriter, r *http.Request, stream <-chan provider.ChatCompletionChunk, p provider.Provider, appID, appName, model string, messagesJSON []byte, startTime time.Time) {
+func (s *Server) handleStreamingResponse(w http.ResponseWriter, r *http.Request, stream <-chan choiceChunk, n int, p provider.Provider, appID, appName string, req *provider.ChatCompletionRequest, messagesJSON []byte, startTime time.Time) {
 	flusher, ok := w.(http.Flusher)
 	if !ok {
 		jsonError(w, http.StatusInternalServerError, "streaming not supported")
@@ -125,152 +289,388 @@ func (s *Server) handleStreamingResponse(w http.ResponseWriter, r *http.Request,
 	w.Header().Set("Cache-Control", "no-cache")
 	w.Header().Set("Connection", "keep-alive")
 
-	completionID := "chatcmpl-" + generateShortID()
-	var fullContent string
+	enc := newChunkEncoder(req, startTime)
+	full := make([]historyResponse, n)
 	var usage *provider.Usage
+	var streamErr error
+
+	write := func(events ...sseEvent) {
+		for _, e := range events {
+			e.write(w)
+		}
+		flusher.Flush()
+	}
 
+	write(enc.open(n)...)
 	for chunk := range stream {
 		if chunk.Error != nil {
-			// Send error as SSE event
-			errData, _ := json.Marshal(map[string]any{
-				"error": map[string]any{"message": chunk.Error.Error()},
-			})
-			fmt.Fprintf(w, "data: %s\n\n", errData)
-			flusher.Flush()
+			// An error event in the shape OpenAI SDKs raise from; no [DONE]
+			// follows, as the stream did not complete
+			write(sseEvent{data: streamError(chunk.Error)})
+			streamErr = chunk.Error
 			break
 		}
-
-		fullContent += chunk.Content
-		if chunk.Usage != nil {
-			usage = chunk.Usage
+		if u := addChunk(full, chunk); u != nil {
+			usage = u
 		}
+		write(enc.chunk(chunk)...)
+	}
 
-		// OpenAI SSE format
-		sseData := map[string]any{
-			"id":      completionID,
-			"object":  "chat.completion.chunk",
-			"created": startTime.Unix(),
-			"model":   model,
-			"choices": []map[string]any{
-				{
-					"index": 0,
-					"delta": map[string]any{},
-				},
-			},
+	if streamErr == nil {
+		if usage == nil {
+			usage = estimateUsage(req.Messages, choicesHistory(full))
 		}
+		write(enc.close(usage)...)
+	}
 
-		if chunk.Content != "" {
-			sseData["choices"].([]map[string]any)[0]["delta"] = map[string]any{
-				"content": chunk.Content,
-			}
-		}
+	// Log the request
+	s.logRequest(appID, appName, req.Model, p.ID(), messagesJSON, choicesHistory(full), usage, startTime, streamErr)
+}
 
-		if chunk.Done {
-			sseData["choices"].([]map[string]any)[0]["finish_reason"] = chunk.FinishReason
-			if usage != nil {
-				sseData["usage"] = usage
-			}
-		}
+// sseEvent is one server-sent event. id is left out when zero.
+type sseEvent struct {
+	id   int
+	name string
+	data string
+}
 
-		data, _ := json.Marshal(sseData)
-		fmt.Fprintf(w, "data: %s\n\n", data)
-		flusher.Flush()
+func (e sseEvent) write(w io.Writer) {
+	if e.id > 0 {
+		fmt.Fprintf(w, "id: %d\n", e.id)
 	}
+	if e.name != "" {
+		fmt.Fprintf(w, "event: %s\n", e.name)
+	}
+	fmt.Fprintf(w, "data: %s\n\n", e.data)
+}
 
-	// Send [DONE] marker
-	fmt.Fprintf(w, "data: [DONE]\n\n")
-	flusher.Flush()
+// chunkEncoder turns a completion's chunks into SSE events in OpenAI's
+// chat.completion.chunk format.
+type chunkEncoder struct {
+	id           string
+	model        string
+	created      int64
+	includeUsage bool
+	toolTrace    bool
+}
 
-	// Log the request
-	s.logRequest(appID, appName, model, p.ID(), messagesJSON, fullContent, usage, startTime, nil)
+func newChunkEncoder(req *provider.ChatCompletionRequest, startTime time.Time) *chunkEncoder {
+	return &chunkEncoder{
+		id:           "chatcmpl-" + generateShortID(),
+		model:        req.Model,
+		created:      startTime.Unix(),
+		includeUsage: req.StreamOptions != nil && req.StreamOptions.IncludeUsage,
+		toolTrace:    req.ToolTrace,
+	}
 }
 
-func (s *Server) handleNonStreamingResponse(w http.ResponseWriter, stream <-chan provider.ChatCompletionChunk, p provider.Provider, appID, appName, model string, messagesJSON []byte, startTime time.Time) {
-	var fullContent string
-	var usage *provider.Usage
-	var lastErr error
+// event is one chat.completion.chunk. With include_usage every chunk has
+// "usage": null, and only the last one, with no choices, has the usage.
+func (e *chunkEncoder) event(choices []map[string]any, usage *provider.Usage) sseEvent {
+	sseData := map[string]any{
+		"id":      e.id,
+		"object":  "chat.completion.chunk",
+		"created": e.created,
+		"model":   e.model,
+		"choices": choices,
+	}
+	if e.includeUsage {
+		sseData["usage"] = usage
+	}
+	data, _ := json.Marshal(sseData)
+	return sseEvent{data: string(data)}
+}
 
-	for chunk := range stream {
-		if chunk.Error != nil {
-			lastErr = chunk.Error
-			break
+func (e *chunkEncoder) delta(index int, delta map[string]any, finishReason any) sseEvent {
+	return e.event([]map[string]any{{"index": index, "delta": delta, "logprobs": nil, "finish_reason": finishReason}}, nil)
+}
+
+// open starts each choice with the role, as OpenAI's streams do.
+func (e *chunkEncoder) open(n int) []sseEvent {
+	events := make([]sseEvent, n)
+	for i := range n {
+		events[i] = e.delta(i, map[string]any{"role": "assistant", "content": ""}, nil)
+	}
+	return events
+}
+
+// chunk encodes a chunk that isn't an error.
+func (e *chunkEncoder) chunk(chunk choiceChunk) []sseEvent {
+	if chunk.Trace != nil {
+		// Agent loop tool call — a named event, so OpenAI clients skip it
+		if !e.toolTrace {
+			return nil
 		}
-		fullContent += chunk.Content
-		if chunk.Usage != nil {
-			usage = chunk.Usage
+		data, _ := json.Marshal(chunk.Trace)
+		return []sseEvent{{name: "tool_call", data: string(data)}}
+	}
+
+	var events []sseEvent
+	if chunk.Reasoning != "" {
+		events = append(events, e.delta(chunk.index, map[string]any{"reasoning_content": chunk.Reasoning}, nil))
+	}
+	if chunk.Content != "" {
+		events = append(events, e.delta(chunk.index, map[string]any{"content": chunk.Content}, nil))
+	}
+	if chunk.Done {
+		events = append(events, e.delta(chunk.index, map[string]any{}, chunk.FinishReason))
+	}
+	return events
+}
+
+// close ends a completed stream.
+func (e *chunkEncoder) close(usage *provider.Usage) []sseEvent {
+	var events []sseEvent
+	if e.includeUsage {
+		events = append(events, e.event([]map[string]any{}, usage))
+	}
+	return append(events, sseEvent{data: "[DONE]"})
+}
+
+// streamError is the SSE data of a failure after streaming has started:
+// the upstream's JSON error body when there is one, else an OpenAI-style
+// error with a type and code derived from the status.
+func streamError(err error) string {
+	status := http.StatusInternalServerError
+	var se *provider.StatusError
+	if errors.As(err, &se) {
+		if len(se.Body) > 0 {
+			return secret.Redact(string(se.Body))
 		}
+		status = se.Status
+	}
+	typ, code := errorType(status)
+	data, _ := json.Marshal(map[string]any{
+		"error": map[string]any{
+			"message": secret.Redact(err.Error()),
+			"type":    typ,
+			"param":   nil,
+			"code":    code,
+		},
+	})
+	return string(data)
+}
+
+// errorType maps an HTTP status to OpenAI's error type and code.
+func errorType(status int) (typ, code string) {
+	switch {
+	case status == http.StatusUnauthorized:
+		return "authentication_error", "invalid_api_key"
+	case status == http.StatusForbidden:
+		return "permission_error", "permission_denied"
+	case status == http.StatusNotFound:
+		return "invalid_request_error", "not_found"
+	case status == http.StatusTooManyRequests:
+		return "rate_limit_error", "rate_limit_exceeded"
+	case status == http.StatusServiceUnavailable:
+		return "server_error", "service_unavailable"
+	case status == http.StatusGatewayTimeout:
+		return "server_error", "timeout"
+	case status >= 500:
+		return "server_error", "provider_error"
+	default:
+		return "invalid_request_error", "invalid_request"
 	}
+}
 
+func (s *Server) handleNonStreamingResponse(w http.ResponseWriter, stream <-chan choiceChunk, n int, p provider.Provider, appID, appName string, req *provider.ChatCompletionRequest, messagesJSON []byte, startTime time.Time) {
+	model := req.Model
+	full, usage, lastErr := collectChoices(stream, n)
 	if lastErr != nil {
-		jsonError(w, http.StatusInternalServerError, lastErr.Error())
-		s.logRequest(appID, appName, model, p.ID(), messagesJSON, "", nil, startTime, lastErr)
+		writeProviderError(w, lastErr)
+		// Keep only the tool calls made before the failure
+		for i := range full {
+			full[i].Content = ""
+		}
+		s.logRequest(appID, appName, model, p.ID(), messagesJSON, choicesHistory(full), nil, startTime, lastErr)
 		return
 	}
 
-	completionID := "chatcmpl-" + generateShortID()
-	resp := map[string]any{
-		"id":      completionID,
+	if usage == nil {
+		usage = estimateUsage(req.Messages, choicesHistory(full))
+	}
+	jsonOK(w, completionResponse("chatcmpl-"+generateShortID(), model, full, usage, startTime))
+	s.logRequest(appID, appName, model, p.ID(), messagesJSON, choicesHistory(full), usage, startTime, nil)
+}
+
+// completionResponse is the chat.completion object of a request's choices.
+func completionResponse(id, model string, full []historyResponse, usage *provider.Usage, startTime time.Time) map[string]any {
+	choices := make([]map[string]any, len(full))
+	for i, choice := range full {
+		message := map[string]any{
+			"role":    "assistant",
+			"content": choice.Content,
+		}
+		if choice.Reasoning != "" {
+			message["reasoning_content"] = choice.Reasoning
+		}
+		choices[i] = map[string]any{
+			"index":         i,
+			"message":       message,
+			"finish_reason": choice.FinishReason,
+		}
+	}
+
+	return map[string]any{
+		"id":      id,
 		"object":  "chat.completion",
 		"created": startTime.Unix(),
 		"model":   model,
-		"choices": []map[string]any{
-			{
-				"index": 0,
-				"message": map[string]any{
-					"role":    "assistant",
-					"content": fullContent,
-				},
-				"finish_reason": "stop",
-			},
-		},
+		"choices": choices,
+		"usage":   usage,
 	}
+}
 
-	if usage != nil {
-		resp["usage"] = usage
-	}
+// historyResponse is what a history entry records as the response.
+type historyResponse struct {
+	Content   string               `json:"content"`
+	Reasoning string               `json:"reasoning,omitempty"`  // the model's thinking, apart from the answer
+	ToolTrace []provider.ToolTrace `json:"tool_trace,omitempty"` // agent loop tool calls
 
-	jsonOK(w, resp)
-	s.logRequest(appID, appName, model, p.ID(), messagesJSON, fullContent, usage, startTime, nil)
+	// FinishReason is why generation ended: "stop", "length" (cut off by
+	// max_tokens or a CLI's limits), "content_filter", "tool_calls".
+	FinishReason string `json:"finish_reason,omitempty"`
+
+	// Choices holds every choice of an n > 1 request; Content, Reasoning
+	// and ToolTrace then repeat choice 0 for readers that expect one
+	// response, and FinishReason is the first that isn't "stop".
+	Choices []historyResponse `json:"choices,omitempty"`
 }
 
-func (s *Server) logRequest(appID, appName, model, providerID string, messagesJSON []byte, content string, usage *provider.Usage, startTime time.Time, reqErr error) {
-	respJSON, _ := json.Marshal(map[string]string{"content": content})
+// choicesHistory is the history record of a request's choices.
+func choicesHistory(choices []historyResponse) historyResponse {
+	if len(choices) == 1 {
+		return choices[0]
+	}
+	finish := choices[0].FinishReason
+	for _, c := range choices {
+		if c.FinishReason != "stop" {
+			finish = c.FinishReason
+			break
+		}
+	}
+	return historyResponse{Content: choices[0].Content, Reasoning: choices[0].Reasoning, ToolTrace: choices[0].ToolTrace, FinishReason: finish, Choices: choices}
+}
 
-	entry := &store.HistoryEntry{
-		ID:         generateShortID(),
-		AppID:      appID,
-		AppName:    appName,
-		Model:      model,
-		Provider:   providerID,
-		Messages:   messagesJSON,
-		Response:   respJSON,
-		DurationMS: time.Since(startTime).Milliseconds(),
-		Status:     "success",
+// estimateUsage counts the tokens of a request and its response for
+// providers that report no usage.
+func estimateUsage(messages []provider.Message, resp historyResponse) *provider.Usage {
+	if len(resp.Choices) == 0 {
+		return tokens.Estimate(messages, resp.Reasoning+resp.Content)
 	}
+	contents := make([]string, len(resp.Choices))
+	for i, c := range resp.Choices {
+		contents[i] = c.Reasoning + c.Content
+	}
+	return tokens.Estimate(messages, contents...)
+}
 
-	if usage != nil {
-		entry.TokensIn = usage.PromptTokens
-		entry.TokensOut = usage.CompletionTokens
+// collectChoices drains the merged stream of n choices, stopping at the
+// first error.
+func collectChoices(stream <-chan choiceChunk, n int) ([]historyResponse, *provider.Usage, error) {
+	full := make([]historyResponse, n)
+	var usage *provider.Usage
+	for chunk := range stream {
+		if chunk.Error != nil {
+			return full, usage, chunk.Error
+		}
+		if u := addChunk(full, chunk); u != nil {
+			usage = u
+		}
 	}
+	return full, usage, nil
+}
 
-	if reqErr != nil {
-		entry.Status = "error"
-		entry.ErrorMessage = reqErr.Error()
+// addChunk adds a chunk that isn't an error to its choice's response,
+// returning the usage it carries, if any.
+func addChunk(full []historyResponse, chunk choiceChunk) *provider.Usage {
+	resp := &full[chunk.index]
+	if chunk.Trace != nil {
+		resp.ToolTrace = append(resp.ToolTrace, *chunk.Trace)
+	}
+	resp.Content += chunk.Content
+	resp.Reasoning += chunk.Reasoning
+	if chunk.Done {
+		resp.FinishReason = chunk.FinishReason
 	}
+	return chunk.Usage
+}
 
+// collectStream drains a completion stream into its full response and
+// usage, stopping at the first error.
+func collectStream(stream <-chan provider.ChatCompletionChunk) (historyResponse, *provider.Usage, error) {
+	var resp historyResponse
+	var usage *provider.Usage
+	for chunk := range stream {
+		if chunk.Error != nil {
+			return resp, usage, chunk.Error
+		}
+		if chunk.Trace != nil {
+			resp.ToolTrace = append(resp.ToolTrace, *chunk.Trace)
+		}
+		resp.Content += chunk.Content
+		resp.Reasoning += chunk.Reasoning
+		if chunk.Done {
+			resp.FinishReason = chunk.FinishReason
+		}
+		if chunk.Usage != nil {
+			usage = chunk.Usage
+		}
+	}
+	return resp, usage, nil
+}
+
+func (s *Server) logRequest(appID, appName, model, providerID string, messagesJSON []byte, resp historyResponse, usage *provider.Usage, startTime time.Time, reqErr error) {
+	entry := historyEntry(appID, appName, model, providerID, messagesJSON, resp, usage, startTime, reqErr)
 	if err := s.store.LogRequest(entry); err != nil {
 		log.Printf("failed to log request: %v", err)
 	}
 }
 
+// historyEntry is the history record of a request, estimating its usage
+// if the provider reported none.
+func historyEntry(appID, appName, model, providerID string, messagesJSON []byte, resp historyResponse, usage *provider.Usage, startTime time.Time, reqErr error) *store.HistoryEntry {
+	respJSON, _ := json.Marshal(resp)
+
+	entry := &store.HistoryEntry{
+		ID:           generateShortID(),
+		AppID:        appID,
+		AppName:      appName,
+		Model:        model,
+		Provider:     providerID,
+		Messages:     messagesJSON,
+		Response:     respJSON,
+		FinishReason: resp.FinishReason,
+		DurationMS:   time.Since(startTime).Milliseconds(),
+		Status:       "success",
+	}
+
+	if usage == nil {
+		var messages []provider.Message
+		json.Unmarshal(messagesJSON, &messages)
+		usage = estimateUsage(messages, resp)
+	}
+	entry.TokensIn = usage.PromptTokens
+	entry.TokensOut = usage.CompletionTokens
+	entry.Estimated = usage.Estimated
+
+	if reqErr != nil {
+		entry.Status = "error"
+		entry.ErrorMessage = secret.Redact(reqErr.Error())
+	}
+	return entry
+}
+
 // --- Pairing Flow ---
 
 func (s *Server) handleConnect(w http.ResponseWriter, r *http.Request) {
 	var req struct {
-		AppName        string `json:"app_name"`
-		AppURL         string `json:"app_url"`
-		AppIcon        string `json:"app_icon"`         // optional favicon URL
-		RequestedScope string `json:"requested_scope"`   // "chat" (default) or "full"
+		AppName        string            `json:"app_name"`
+		AppURL         string            `json:"app_url"`
+		AppIcon        string            `json:"app_icon"`              // optional favicon URL
+		RequestedScope string            `json:"requested_scope"`       // "chat" (default) or "full"
+		RequestedTools *store.ToolPolicy `json:"requested_tools"`       // optional per-tool policy
+		RequestedMCP   []string          `json:"requested_mcp_servers"` // optional MCP server names
 	}
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		jsonError(w, http.StatusBadRequest, "invalid request body")
@@ -288,30 +688,68 @@ func (s *Server) handleConnect(w http.ResponseWriter, r *http.Request) {
 		jsonError(w, http.StatusBadRequest, "requested_scope must be 'chat' or 'full'")
 		return
 	}
+	if err := validateToolPolicy(req.RequestedTools); err != nil {
+		jsonError(w, http.StatusBadRequest, "requested_tools: "+err.Error())
+		return
+	}
+	if err := s.validateMCPServers(req.RequestedMCP); err != nil {
+		jsonError(w, http.StatusBadRequest, "requested_mcp_servers: "+err.Error())
+		return
+	}
 
 	reqID := generateShortID()
 	expiresAt := time.Now().Add(5 * time.Minute)
 
-	if err := s.store.CreateConnectRequest(reqID, req.AppName, req.AppURL, req.AppIcon, req.RequestedScope, expiresAt); err != nil {
+	if err := s.store.CreateConnectRequest(reqID, req.AppName, req.AppURL, req.AppIcon, req.RequestedScope, req.RequestedTools, req.RequestedMCP, expiresAt); err != nil {
 		jsonError(w, http.StatusInternalServerError, "failed to create connect request")
 		return
 	}
 
-	// Show native approval dialog (macOS) or open browser (other OS)
+	// Show native approval dialog (macOS) or open browser (other OS).
+	// The dialog only grants the "chat" scope: requested tools go through
+	// the dashboard's approve page, where the grant is reviewed in full.
 	approveURL := fmt.Sprintf("http://localhost:%d/#/approve?req=%s", s.cfg.Port, reqID)
-	showConnectDialog(req.AppName, approveURL,
+	var details string
+	if len(req.RequestedMCP) > 0 {
+		details = "MCP servers: " + strings.Join(req.RequestedMCP, ", ")
+	}
+	if req.RequestedTools != nil {
+		go openBrowser(approveURL)
+	} else {
+		s.showQuickConnectDialog(req.AppName, details, approveURL, reqID, req.AppURL, req.RequestedMCP)
+	}
+
+	jsonOK(w, map[string]any{
+		"request_id":  reqID,
+		"approve_url": approveURL,
+		"expires_at":  expiresAt.Format(time.RFC3339),
+		"poll_url":    fmt.Sprintf("http://localhost:%d/v1/connect/%s", s.cfg.Port, reqID),
+	})
+}
+
+// showQuickConnectDialog shows the native pairing dialog, whose Approve
+// creates the app with the "chat" scope and the requested MCP servers.
+func (s *Server) showQuickConnectDialog(appName, details, approveURL, reqID, appURL string, mcpServers []string) {
+	showConnectDialog(appName, details, approveURL,
 		func() {
-			// Approve callback — generate token and create app with "chat" scope (safe default)
+			// Approve callback — generate token and create app with "chat" scope (safe default).
+			// Requested MCP servers were listed in the dialog, so approving grants those.
 			token, err := config.GenerateAppToken()
 			if err != nil {
 				log.Printf("dialog approve: failed to generate token: %v", err)
 				return
 			}
 			appID := generateShortID()
-			if err := s.store.CreateApp(appID, req.AppName, req.AppURL, "chat", token); err != nil {
+			if err := s.store.CreateApp(appID, appName, appURL, "chat", token); err != nil {
 				log.Printf("dialog approve: failed to create app: %v", err)
 				return
 			}
+			if len(mcpServers) > 0 {
+				if err := s.store.SetAppMCPServers(appID, mcpServers); err != nil {
+					log.Printf("dialog approve: failed to set app MCP servers: %v", err)
+					return
+				}
+			}
 			// No provider restriction — unrestricted access
 			if err := s.store.ApproveConnectRequest(reqID, token); err != nil {
 				log.Printf("dialog approve: failed to approve request: %v", err)
@@ -324,13 +762,6 @@ func (s *Server) handleConnect(w http.ResponseWriter, r *http.Request) {
 			}
 		},
 	)
-
-	jsonOK(w, map[string]any{
-		"request_id":  reqID,
-		"approve_url": approveURL,
-		"expires_at":  expiresAt.Format(time.RFC3339),
-		"poll_url":    fmt.Sprintf("http://localhost:%d/v1/connect/%s", s.cfg.Port, reqID),
-	})
 }
 
 func (s *Server) handleConnectPoll(w http.ResponseWriter, r *http.Request) {
@@ -347,11 +778,13 @@ func (s *Server) handleConnectPoll(w http.ResponseWriter, r *http.Request) {
 	}
 
 	resp := map[string]any{
-		"status":          cr.Status,
-		"app_name":        cr.AppName,
-		"app_url":         cr.AppURL,
-		"app_icon":        cr.AppIcon,
-		"requested_scope": cr.RequestedScope,
+		"status":                cr.Status,
+		"app_name":              cr.AppName,
+		"app_url":               cr.AppURL,
+		"app_icon":              cr.AppIcon,
+		"requested_scope":       cr.RequestedScope,
+		"requested_tools":       cr.RequestedTools,
+		"requested_mcp_servers": cr.RequestedMCP,
 	}
 	if cr.Status == "approved" {
 		resp["token"] = cr.Token
@@ -377,8 +810,10 @@ func (s *Server) handleApprove(w http.ResponseWriter, r *http.Request) {
 
 	// Parse optional providers and scope from body
 	var body struct {
-		Providers []string `json:"providers"`
-		Scope     string   `json:"scope"`
+		Providers  []string          `json:"providers"`
+		Scope      string            `json:"scope"`
+		Tools      *store.ToolPolicy `json:"tools"`       // nil = derive tools from scope
+		MCPServers []string          `json:"mcp_servers"` // MCP servers to grant
 	}
 	// Body is optional — empty body means unrestricted providers + chat scope
 	if r.Body != nil {
@@ -391,6 +826,14 @@ func (s *Server) handleApprove(w http.ResponseWriter, r *http.Request) {
 		jsonError(w, http.StatusBadRequest, "scope must be 'chat' or 'full'")
 		return
 	}
+	if err := validateToolPolicy(body.Tools); err != nil {
+		jsonError(w, http.StatusBadRequest, "tools: "+err.Error())
+		return
+	}
+	if err := s.validateMCPServers(body.MCPServers); err != nil {
+		jsonError(w, http.StatusBadRequest, "mcp_servers: "+err.Error())
+		return
+	}
 
 	// Generate app token and create app
 	token, err := config.GenerateAppToken()
@@ -413,6 +856,20 @@ func (s *Server) handleApprove(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	if body.Tools != nil {
+		if err := s.store.SetAppTools(appID, body.Tools); err != nil {
+			jsonError(w, http.StatusInternalServerError, "failed to set app tools")
+			return
+		}
+	}
+
+	if len(body.MCPServers) > 0 {
+		if err := s.store.SetAppMCPServers(appID, body.MCPServers); err != nil {
+			jsonError(w, http.StatusInternalServerError, "failed to set app MCP servers")
+			return
+		}
+	}
+
 	if err := s.store.ApproveConnectRequest(id, token); err != nil {
 		jsonError(w, http.StatusInternalServerError, "failed to approve request")
 		return
@@ -453,8 +910,11 @@ func (s *Server) handleConnectProviders(w http.ResponseWriter, r *http.Request)
 		}
 	}
 	jsonOK(w, map[string]any{
-		"providers":       providers,
-		"requested_scope": cr.RequestedScope,
+		"providers":             providers,
+		"requested_scope":       cr.RequestedScope,
+		"requested_tools":       cr.RequestedTools,
+		"requested_mcp_servers": cr.RequestedMCP,
+		"mcp_servers":           s.mcpServerNames(),
 	})
 }
 
@@ -480,6 +940,7 @@ func (s *Server) handleListHistory(w http.ResponseWriter, r *http.Request) {
 		Limit:   limit,
 		Offset:  offset,
 		AppName: r.URL.Query().Get("app_name"),
+		BatchID: r.URL.Query().Get("batch_id"),
 		SortBy:  r.URL.Query().Get("sort"),
 	}
 
@@ -538,16 +999,175 @@ func (s *Server) handleListApps(w http.ResponseWriter, r *http.Request) {
 	if apps == nil {
 		apps = []store.App{}
 	}
-	// Strip tokens from response and ensure providers is never null
+	// Strip tokens from response and ensure providers/MCP servers are never null
 	for i := range apps {
 		apps[i].Token = apps[i].Token[:8] + "..."
 		if apps[i].Providers == nil {
 			apps[i].Providers = []string{}
 		}
+		if apps[i].MCPServers == nil {
+			apps[i].MCPServers = []string{}
+		}
 	}
 	jsonOK(w, apps)
 }
 
+// handleUpdateApp changes per-app settings. Only fields present in the body are updated.
+func (s *Server) handleUpdateApp(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	app, err := s.store.GetApp(id)
+	if err != nil || app == nil {
+		jsonError(w, http.StatusNotFound, "app not found")
+		return
+	}
+
+	var body struct {
+		Workspace       *string `json:"workspace"`        // "" resets to the default
+		Sandbox         *string `json:"sandbox"`          // runner name; "" disables
+		SandboxNetwork  *bool   `json:"sandbox_network"`  // defaults to the current setting
+		RequireApproval *bool   `json:"require_approval"` // ask before write/exec tool calls
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		jsonError(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+
+	// Validate everything first, so a rejected request changes nothing
+	runner, network, approval := app.Sandbox, app.SandboxNetwork, app.RequireApproval
+	if body.Sandbox != nil {
+		runner = *body.Sandbox
+	}
+	if body.SandboxNetwork != nil {
+		network = *body.SandboxNetwork
+	}
+	if body.RequireApproval != nil {
+		approval = *body.RequireApproval
+	}
+
+	var workspace string
+	if body.Workspace != nil {
+		if workspace, err = normalizeWorkspace(*body.Workspace); err != nil {
+			jsonError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+
+	if runner != "" && (body.Sandbox != nil || body.SandboxNetwork != nil) {
+		rn, ok := provider.LookupRunner(runner)
+		if !ok {
+			jsonError(w, http.StatusBadRequest, "unknown sandbox runner: "+runner)
+			return
+		}
+		if !rn.Available() {
+			jsonError(w, http.StatusBadRequest, "sandbox runner "+runner+" is not available on this system")
+			return
+		}
+	}
+
+	// The sandboxed CLIs call their model APIs (and the approval hook calls
+	// the daemon) over the network: without it every run would fail.
+	if runner != "" && !network {
+		jsonError(w, http.StatusBadRequest, "sandbox_network can't be turned off: the CLI couldn't reach its model API")
+		return
+	}
+
+	if body.Workspace != nil {
+		if err := s.store.SetAppWorkspace(id, workspace); err != nil {
+			jsonError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+	}
+	if body.Sandbox != nil || body.SandboxNetwork != nil {
+		if err := s.store.SetAppSandbox(id, runner, network); err != nil {
+			jsonError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+	}
+	if body.RequireApproval != nil {
+		if err := s.store.SetAppRequireApproval(id, approval); err != nil {
+			jsonError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+	}
+
+	jsonOK(w, map[string]any{"status": "updated"})
+}
+
+// handleSetAppTools replaces an app's tool policy.
+func (s *Server) handleSetAppTools(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	app, err := s.store.GetApp(id)
+	if err != nil || app == nil {
+		jsonError(w, http.StatusNotFound, "app not found")
+		return
+	}
+
+	var tp store.ToolPolicy
+	if err := json.NewDecoder(r.Body).Decode(&tp); err != nil {
+		jsonError(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+	if err := validateToolPolicy(&tp); err != nil {
+		jsonError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := s.store.SetAppTools(id, &tp); err != nil {
+		jsonError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	jsonOK(w, map[string]any{"status": "updated", "tools": tp})
+}
+
+// handleSetAppMCPServers replaces the MCP servers granted to an app.
+func (s *Server) handleSetAppMCPServers(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	app, err := s.store.GetApp(id)
+	if err != nil || app == nil {
+		jsonError(w, http.StatusNotFound, "app not found")
+		return
+	}
+
+	var body struct {
+		Servers []string `json:"servers"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		jsonError(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+	if err := s.validateMCPServers(body.Servers); err != nil {
+		jsonError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := s.store.SetAppMCPServers(id, body.Servers); err != nil {
+		jsonError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	jsonOK(w, map[string]any{"status": "updated"})
+}
+
+// handleListMCPServers lists the MCP servers defined in config.
+// Only names and transports are returned — definitions may hold credentials.
+func (s *Server) handleListMCPServers(w http.ResponseWriter, r *http.Request) {
+	data := []map[string]any{}
+	for _, name := range s.mcpServerNames() {
+		data = append(data, map[string]any{
+			"name":      name,
+			"transport": s.cfg.MCPServers[name].Transport(),
+		})
+	}
+	jsonOK(w, data)
+}
+
+// handleClearAppTools removes an app's tool policy so its scope applies again.
+func (s *Server) handleClearAppTools(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	if err := s.store.SetAppTools(id, nil); err != nil {
+		jsonError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	jsonOK(w, map[string]any{"status": "updated"})
+}
+
 func (s *Server) handleRevokeApp(w http.ResponseWriter, r *http.Request) {
 	id := r.PathValue("id")
 	if err := s.store.RevokeApp(id); err != nil {
@@ -557,6 +1177,127 @@ func (s *Server) handleRevokeApp(w http.ResponseWriter, r *http.Request) {
 	jsonOK(w, map[string]any{"status": "revoked"})
 }
 
+// --- Tool Approvals ---
+
+// approvalHook returns the hook a provider should install for a run
+// registered with s.approvals.startRun.
+func (s *Server) approvalHook(token string) (*provider.ApprovalHook, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return nil, fmt.Errorf("locating daemon executable: %w", err)
+	}
+	return &provider.ApprovalHook{
+		Executable: exe,
+		Args: []string{
+			"approval-hook",
+			"-url", fmt.Sprintf("http://localhost:%d/v1/approvals/hook", s.cfg.Port),
+			"-token", token,
+		},
+		Timeout: s.cfg.ApprovalTimeout(),
+	}, nil
+}
+
+// handleApprovalHook is called by the CLI's approval hook for each tool call
+// that needs a human decision. It parks the call, asks the user, and responds
+// with "allow" or "deny". No answer before the timeout means deny.
+func (s *Server) handleApprovalHook(w http.ResponseWriter, r *http.Request) {
+	run, ok := s.approvals.lookupRun(extractToken(r))
+	if !ok {
+		jsonError(w, http.StatusUnauthorized, "invalid or finished run token")
+		return
+	}
+
+	var body struct {
+		ToolName  string          `json:"tool_name"`
+		ToolInput json.RawMessage `json:"tool_input"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		jsonError(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+
+	approved, reason, err := s.awaitApproval(r.Context(), run, body.ToolName, body.ToolInput)
+	if err != nil {
+		return
+	}
+	decision := "deny"
+	if approved {
+		decision = "allow"
+	}
+	jsonOK(w, map[string]any{"decision": decision, "reason": reason})
+}
+
+// awaitApproval parks a tool call, asks the user, and blocks until they
+// decide. No answer before the approval timeout means deny. The error is
+// only set when ctx ends first.
+func (s *Server) awaitApproval(ctx context.Context, run approvalRun, tool string, input json.RawMessage) (bool, string, error) {
+	timeout := s.cfg.ApprovalTimeout()
+	pa := s.approvals.park(run, tool, input, timeout)
+	defer s.approvals.remove(pa.ID)
+
+	approveURL := fmt.Sprintf("http://localhost:%d/#/approve?tool=%s", s.cfg.Port, pa.ID)
+	showApprovalDialog(run.AppName, pa.Tool, summarizeToolInput(input), approveURL, timeout,
+		func() { s.approvals.resolve(pa.ID, true) },
+		func() { s.approvals.resolve(pa.ID, false) },
+	)
+
+	approved, reason := false, "no response from the user within "+timeout.String()
+	select {
+	case approved = <-pa.decision:
+		if approved {
+			reason = "approved by the user"
+		} else {
+			reason = "denied by the user"
+		}
+	case <-time.After(timeout):
+	case <-ctx.Done():
+		return false, "", ctx.Err()
+	}
+
+	decision := "deny"
+	if approved {
+		decision = "allow"
+	}
+	log.Printf("tool approval: %s %s → %s", run.AppName, pa.Tool, decision)
+	return approved, reason, nil
+}
+
+func (s *Server) handleListApprovals(w http.ResponseWriter, r *http.Request) {
+	jsonOK(w, s.approvals.list())
+}
+
+func (s *Server) handleResolveApproval(approved bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !s.approvals.resolve(r.PathValue("id"), approved) {
+			jsonError(w, http.StatusNotFound, "approval not found or already decided")
+			return
+		}
+		status := "denied"
+		if approved {
+			status = "approved"
+		}
+		jsonOK(w, map[string]any{"status": status})
+	}
+}
+
+// summarizeToolInput picks the most telling field of a tool call for the
+// approval dialog (the shell command, the file path, ...).
+func summarizeToolInput(input json.RawMessage) string {
+	var fields map[string]any
+	if err := json.Unmarshal(input, &fields); err != nil {
+		return ""
+	}
+	for _, key := range []string{"command", "file_path", "notebook_path", "url", "path"} {
+		if v, ok := fields[key].(string); ok && v != "" {
+			if r := []rune(v); len(r) > 300 {
+				v = string(r[:300]) + "…"
+			}
+			return v
+		}
+	}
+	return ""
+}
+
 // --- Onboarding ---
 
 func (s *Server) handleOnboardingStatus(w http.ResponseWriter, r *http.Request) {
@@ -615,7 +1356,7 @@ func (s *Server) handleOnboardingTestProvider(w http.ResponseWriter, r *http.Req
 	if err != nil {
 		jsonOK(w, map[string]any{
 			"success": false,
-			"error":   "Failed to start test: " + err.Error(),
+			"error":   "Failed to start test: " + secret.Redact(err.Error()),
 		})
 		return
 	}
@@ -632,7 +1373,7 @@ func (s *Server) handleOnboardingTestProvider(w http.ResponseWriter, r *http.Req
 	}
 
 	if lastErr != nil {
-		msg := lastErr.Error()
+		msg := secret.Redact(lastErr.Error())
 		if strings.Contains(msg, "auth") || strings.Contains(msg, "credential") || strings.Contains(msg, "login") {
 			msg += " — try running 'claude' in your terminal to authenticate"
 		}
@@ -675,6 +1416,98 @@ func providerAllowed(allowed []string, providerID string) bool {
 	return false
 }
 
+// toolNamePattern matches a tool name with an optional argument pattern,
+// e.g. "Read", "mcp__github__*" or "Bash(git log:*)". Names reach CLI
+// arguments and approval dialogs, and can come from unauthenticated
+// connect requests, so anything else is refused.
+var toolNamePattern = regexp.MustCompile(`^[A-Za-z0-9_.*-]+(\([^"\\,]*\))?$`)
+
+// validateToolPolicy checks tool names are usable as CLI arguments.
+// A nil policy is valid (no per-tool policy).
+func validateToolPolicy(tp *store.ToolPolicy) error {
+	if tp == nil {
+		return nil
+	}
+	for _, list := range [][]string{tp.Allow, tp.Deny} {
+		for _, t := range list {
+			if strings.TrimSpace(t) == "" {
+				return fmt.Errorf("tool names must not be empty")
+			}
+			if !toolNamePattern.MatchString(t) {
+				return fmt.Errorf("invalid tool name %q", t)
+			}
+		}
+	}
+	return nil
+}
+
+// validateMCPServers checks that every name refers to a configured MCP server.
+func (s *Server) validateMCPServers(names []string) error {
+	for _, name := range names {
+		if _, ok := s.cfg.MCPServers[name]; !ok {
+			return fmt.Errorf("unknown MCP server: %s", name)
+		}
+	}
+	return nil
+}
+
+// mcpServerNames returns the configured MCP server names, sorted.
+func (s *Server) mcpServerNames() []string {
+	names := make([]string, 0, len(s.cfg.MCPServers))
+	for name := range s.cfg.MCPServers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// grantedMCPServers resolves an app's MCP grants to their definitions,
+// with secret references resolved. The result is never nil: an app without
+// grants gets no MCP servers at all. Grants whose server was since removed
+// from config, or whose secrets couldn't be resolved, are skipped.
+func (s *Server) grantedMCPServers(names []string) map[string]mcp.ServerConfig {
+	servers := map[string]mcp.ServerConfig{}
+	for _, name := range names {
+		if sc, ok := s.mcpServers[name]; ok {
+			servers[name] = sc
+		}
+	}
+	return servers
+}
+
+// appWorkspace returns the directory agent CLIs run in for an app, creating it
+// if needed. Apps without a configured workspace get <data_dir>/workspaces/<app_id>.
+func (s *Server) appWorkspace(app *store.App, appID string) (string, error) {
+	dir := filepath.Join(s.cfg.DataDir, "workspaces", appID)
+	if app != nil && app.Workspace != "" {
+		dir = app.Workspace
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", fmt.Errorf("creating workspace: %w", err)
+	}
+	return dir, nil
+}
+
+// normalizeWorkspace validates a user-supplied workspace path, expanding a
+// leading "~/". The empty string is returned unchanged (use the default).
+func normalizeWorkspace(path string) (string, error) {
+	path = strings.TrimSpace(path)
+	if path == "" {
+		return "", nil
+	}
+	if rest, ok := strings.CutPrefix(path, "~/"); ok {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", fmt.Errorf("resolving home directory: %w", err)
+		}
+		path = filepath.Join(home, rest)
+	}
+	if !filepath.IsAbs(path) {
+		return "", fmt.Errorf("workspace must be an absolute path")
+	}
+	return filepath.Clean(path), nil
+}
+
 func generateShortID() string {
 	b := make([]byte, 8)
 	rand.Read(b)
@@ -0,0 +1,205 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"plugmyai/internal/provider"
+	"plugmyai/internal/store"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+// stubProvider names the provider in history; the streams under test are
+// fed to the handler directly.
+type stubProvider struct{ provider.Provider }
+
+func (stubProvider) ID() string { return "stub" }
+
+func intPtr(n int) *int { return &n }
+
+// TestStreamingGolden runs handleStreamingResponse over fixed chunk
+// sequences and diffs the SSE it writes against testdata/*.sse. Run with
+// -update to regenerate them after an intended format change.
+func TestStreamingGolden(t *testing.T) {
+	usage := &provider.Usage{PromptTokens: 5, CompletionTokens: 3, TotalTokens: 8}
+	tests := []struct {
+		golden string
+		req    provider.ChatCompletionRequest
+		chunks []choiceChunk
+	}{
+		{
+			// Role delta first, then content, finish_reason and [DONE]
+			golden: "role_delta.sse",
+			req:    provider.ChatCompletionRequest{},
+			chunks: []choiceChunk{
+				{0, provider.ChatCompletionChunk{Content: "Hel"}},
+				{0, provider.ChatCompletionChunk{Content: "lo"}},
+				{0, provider.ChatCompletionChunk{Done: true, FinishReason: "stop", Usage: usage}},
+			},
+		},
+		{
+			// "usage": null on every chunk, then a choiceless usage chunk
+			golden: "include_usage.sse",
+			req:    provider.ChatCompletionRequest{StreamOptions: &provider.StreamOptions{IncludeUsage: true}},
+			chunks: []choiceChunk{
+				{0, provider.ChatCompletionChunk{Reasoning: "Short answer."}},
+				{0, provider.ChatCompletionChunk{Content: "Hi"}},
+				{0, provider.ChatCompletionChunk{Done: true, FinishReason: "length", Usage: usage}},
+			},
+		},
+		{
+			// Each choice opens with its own role delta; chunks interleave
+			golden: "n2.sse",
+			req:    provider.ChatCompletionRequest{N: intPtr(2), StreamOptions: &provider.StreamOptions{IncludeUsage: true}},
+			chunks: []choiceChunk{
+				{1, provider.ChatCompletionChunk{Content: "B"}},
+				{0, provider.ChatCompletionChunk{Content: "A"}},
+				{1, provider.ChatCompletionChunk{Done: true, FinishReason: "stop"}},
+				{0, provider.ChatCompletionChunk{Done: true, FinishReason: "stop", Usage: usage}},
+			},
+		},
+		{
+			// An OpenAI-style error event, and no [DONE]
+			golden: "error.sse",
+			req:    provider.ChatCompletionRequest{},
+			chunks: []choiceChunk{
+				{0, provider.ChatCompletionChunk{Content: "Par"}},
+				{0, provider.ChatCompletionChunk{Error: &provider.StatusError{Status: http.StatusTooManyRequests, Message: "mock: rate limited"}}},
+				{0, provider.ChatCompletionChunk{Content: "never sent"}},
+			},
+		},
+		{
+			// Plain errors are server errors
+			golden: "error_plain.sse",
+			req:    provider.ChatCompletionRequest{},
+			chunks: []choiceChunk{
+				{0, provider.ChatCompletionChunk{Error: errors.New("claude CLI exited without a result")}},
+			},
+		},
+		{
+			// An upstream's own JSON error body is passed on as is
+			golden: "error_upstream.sse",
+			req:    provider.ChatCompletionRequest{},
+			chunks: []choiceChunk{
+				{0, provider.ChatCompletionChunk{Error: &provider.StatusError{
+					Status:  http.StatusBadRequest,
+					Message: "upstream API error 400",
+					Body:    []byte(`{"error":{"message":"context too long","type":"invalid_request_error","param":"messages","code":"context_length_exceeded"}}`),
+				}}},
+			},
+		},
+	}
+
+	st, err := store.New(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+	s := &Server{store: st}
+
+	chatID := regexp.MustCompile(`chatcmpl-[0-9a-f]+`)
+	for _, tt := range tests {
+		t.Run(tt.golden, func(t *testing.T) {
+			req := tt.req
+			req.Model = "mock-echo"
+			req.Stream = true
+			req.Messages = []provider.Message{{Role: "user", Content: "Hello"}}
+			n := 1
+			if req.N != nil {
+				n = *req.N
+			}
+
+			stream := make(chan choiceChunk, len(tt.chunks))
+			for _, c := range tt.chunks {
+				stream <- c
+			}
+			close(stream)
+
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", nil)
+			s.handleStreamingResponse(w, r, stream, n, stubProvider{}, "app", "App", &req, []byte(`[]`), time.Unix(1700000000, 0))
+
+			if ct := w.Header().Get("Content-Type"); ct != "text/event-stream" {
+				t.Errorf("Content-Type = %q", ct)
+			}
+			got := chatID.ReplaceAllString(w.Body.String(), "chatcmpl-ID")
+
+			path := filepath.Join("testdata", tt.golden)
+			if *update {
+				if err := os.WriteFile(path, []byte(got), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			want, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != string(want) {
+				t.Errorf("stream differs from %s:\n--- got\n%s--- want\n%s", path, got, want)
+			}
+		})
+	}
+}
+
+// stubRunner is a sandbox runner that is always available.
+type stubRunner struct{}
+
+func (stubRunner) Available() bool { return true }
+
+func (stubRunner) Command(ctx context.Context, spec provider.CommandSpec, policy provider.SandboxPolicy) (*exec.Cmd, error) {
+	return exec.CommandContext(ctx, spec.Path, spec.Args...), nil
+}
+
+// TestUpdateAppRejected checks that a PATCH failing validation on any field
+// leaves every field of the app as it was.
+func TestUpdateAppRejected(t *testing.T) {
+	provider.RegisterRunner("stub", stubRunner{})
+
+	st, err := store.New(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+	s := &Server{store: st}
+	if err := st.CreateApp("app_1", "App", "", "chat", "tok"); err != nil {
+		t.Fatal(err)
+	}
+	before, err := st.GetApp("app_1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, body := range []string{
+		`{"workspace": "/tmp/x", "sandbox": "nope"}`,
+		`{"workspace": "/tmp/x", "require_approval": true, "sandbox": "stub", "sandbox_network": false}`,
+		`{"workspace": "relative/path", "sandbox": "stub", "require_approval": true}`,
+	} {
+		r := httptest.NewRequest(http.MethodPatch, "/v1/apps/app_1", strings.NewReader(body))
+		r.SetPathValue("id", "app_1")
+		w := httptest.NewRecorder()
+		s.handleUpdateApp(w, r)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: status %d, want 400", body, w.Code)
+		}
+
+		after, err := st.GetApp("app_1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(before, after) {
+			t.Errorf("%s: app changed:\n%+v\nwas\n%+v", body, after, before)
+		}
+	}
+}
@@ -0,0 +1,359 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"plugmyai/internal/provider"
+	"plugmyai/internal/store"
+)
+
+// jobFlushInterval is how often a running job's new events are stored.
+const jobFlushInterval = time.Second
+
+// job is a background completion in progress. Its events are kept in
+// memory while it runs, for watchers, and stored in batches for restarts
+// and later reads.
+type job struct {
+	id     string
+	cancel context.CancelFunc
+	done   chan struct{} // closed once the job's outcome is stored
+
+	mu       sync.Mutex
+	events   []store.JobEvent
+	finished bool
+	wake     chan struct{} // closed and replaced on each change
+}
+
+// add appends events, numbering them.
+func (j *job) add(events ...sseEvent) {
+	if len(events) == 0 {
+		return
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	for _, e := range events {
+		j.events = append(j.events, store.JobEvent{Seq: len(j.events) + 1, Name: e.name, Data: e.data})
+	}
+	close(j.wake)
+	j.wake = make(chan struct{})
+}
+
+// since returns the events after seq, whether the job has finished, and a
+// channel closed on the next change.
+func (j *job) since(seq int) ([]store.JobEvent, bool, <-chan struct{}) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	var events []store.JobEvent
+	if seq < len(j.events) {
+		events = j.events[max(seq, 0):]
+	}
+	return events, j.finished, j.wake
+}
+
+func (j *job) finish() {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.finished = true
+	close(j.wake)
+	j.wake = make(chan struct{})
+}
+
+// jobRegistry tracks the jobs running in this process.
+type jobRegistry struct {
+	mu   sync.Mutex
+	jobs map[string]*job
+}
+
+func newJobRegistry() *jobRegistry {
+	return &jobRegistry{jobs: make(map[string]*job)}
+}
+
+func (r *jobRegistry) get(id string) *job {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.jobs[id]
+}
+
+func (r *jobRegistry) put(j *job) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.jobs[j.id] = j
+}
+
+func (r *jobRegistry) remove(id string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.jobs, id)
+}
+
+// startJob runs a chat completion in the background. The completion gets a
+// context of its own, keeping the request's values but not its deadline or
+// cancellation, so it outlives the HTTP request; cancelling the job
+// cancels it and kills the CLI process. release is called when it ends.
+func (s *Server) startJob(ctx context.Context, p provider.Provider, req *provider.ChatCompletionRequest, n int, release func()) (*store.Job, error) {
+	appID := ctx.Value(ctxAppID).(string)
+	appName := ctx.Value(ctxAppName).(string)
+	startTime := time.Now()
+
+	ctx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	stream, err := s.completeChoices(ctx, p, req, n)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	rec := &store.Job{
+		ID:       "job-" + generateShortID(),
+		AppID:    appID,
+		AppName:  appName,
+		Model:    req.Model,
+		Provider: p.ID(),
+		Status:   "in_progress",
+	}
+	if err := s.store.CreateJob(rec); err != nil {
+		cancel()
+		for range stream {
+		}
+		return nil, err
+	}
+	rec.CreatedAt = startTime.UTC()
+
+	j := &job{id: rec.ID, cancel: cancel, done: make(chan struct{}), wake: make(chan struct{})}
+	s.jobs.put(j)
+
+	go func() {
+		defer release()
+		defer cancel()
+		s.runJob(ctx, j, stream, n, p, req, appID, appName, startTime)
+	}()
+	return rec, nil
+}
+
+// runJob consumes a job's stream, storing its events as it goes, then
+// records the outcome and logs the request to history.
+func (s *Server) runJob(ctx context.Context, j *job, stream <-chan choiceChunk, n int, p provider.Provider, req *provider.ChatCompletionRequest, appID, appName string, startTime time.Time) {
+	defer close(j.done)
+	defer s.jobs.remove(j.id)
+	defer j.finish()
+
+	saved := 0
+	flush := func() {
+		events, _, _ := j.since(saved)
+		if len(events) == 0 {
+			return
+		}
+		if err := s.store.AddJobEvents(j.id, events); err != nil {
+			log.Printf("job %s: storing events: %v", j.id, err)
+			return
+		}
+		saved += len(events)
+	}
+
+	enc := newChunkEncoder(req, startTime)
+	full := make([]historyResponse, n)
+	var usage *provider.Usage
+	var jobErr error
+
+	j.add(enc.open(n)...)
+	lastFlush := time.Now()
+	for chunk := range stream {
+		if chunk.Error != nil {
+			jobErr = chunk.Error
+			break
+		}
+		if u := addChunk(full, chunk); u != nil {
+			usage = u
+		}
+		j.add(enc.chunk(chunk)...)
+		if time.Since(lastFlush) >= jobFlushInterval {
+			flush()
+			lastFlush = time.Now()
+		}
+	}
+
+	status := "completed"
+	var result []byte
+	switch {
+	case ctx.Err() != nil:
+		status = "cancelled"
+		jobErr = errors.New("job cancelled")
+		j.add(sseEvent{data: jobCancelledEvent})
+	case jobErr != nil:
+		status = "failed"
+		j.add(sseEvent{data: streamError(jobErr)})
+	default:
+		if usage == nil {
+			usage = estimateUsage(req.Messages, choicesHistory(full))
+		}
+		j.add(enc.close(usage)...)
+		result, _ = json.Marshal(completionResponse(enc.id, req.Model, full, usage, startTime))
+	}
+	flush()
+
+	errMsg := ""
+	if jobErr != nil {
+		errMsg = jobErr.Error()
+	}
+	if err := s.store.FinishJob(j.id, status, result, errMsg); err != nil {
+		log.Printf("job %s: storing outcome: %v", j.id, err)
+	}
+
+	messagesJSON, _ := json.Marshal(req.Messages)
+	s.logRequest(appID, appName, req.Model, p.ID(), messagesJSON, choicesHistory(full), usage, startTime, jobErr)
+}
+
+// jobCancelledEvent is the last event of a cancelled job.
+var jobCancelledEvent = func() string {
+	data, _ := json.Marshal(map[string]any{
+		"error": map[string]any{
+			"message": "job cancelled",
+			"type":    "invalid_request_error",
+			"param":   nil,
+			"code":    "cancelled",
+		},
+	})
+	return string(data)
+}()
+
+// failInterruptedJobs marks jobs a previous daemon left running as failed:
+// their CLI processes died with it, so they can't be resumed.
+func (s *Server) failInterruptedJobs() {
+	const msg = "interrupted by a daemon restart"
+	data, _ := json.Marshal(map[string]any{
+		"error": map[string]any{
+			"message": msg,
+			"type":    "server_error",
+			"param":   nil,
+			"code":    "job_interrupted",
+		},
+	})
+	n, err := s.store.FailRunningJobs(msg, string(data))
+	if err != nil {
+		log.Printf("failed to mark interrupted jobs: %v", err)
+	} else if n > 0 {
+		log.Printf("Marked %d interrupted job(s) as failed", n)
+	}
+}
+
+// --- Handlers ---
+
+// lookupJob returns the job named in the path if the caller may see it:
+// apps see their own jobs, the admin token all of them.
+func (s *Server) lookupJob(w http.ResponseWriter, r *http.Request) *store.Job {
+	rec, err := s.store.GetJob(r.PathValue("id"))
+	if err != nil {
+		jsonError(w, http.StatusInternalServerError, "failed to get job")
+		return nil
+	}
+	if rec == nil || !canAccess(r, rec.AppID) {
+		jsonError(w, http.StatusNotFound, "job not found")
+		return nil
+	}
+	if j := s.jobs.get(rec.ID); j != nil {
+		// Count the events not stored yet
+		events, _, _ := j.since(rec.LastEventID)
+		rec.LastEventID += len(events)
+	}
+	return rec
+}
+
+func (s *Server) handleGetJob(w http.ResponseWriter, r *http.Request) {
+	if rec := s.lookupJob(w, r); rec != nil {
+		jsonOK(w, rec)
+	}
+}
+
+// handleJobEvents streams a job's events as SSE, each with its sequence
+// number as the event ID. Watching resumes after ?after=N or the
+// Last-Event-ID header, and follows a running job until it ends.
+func (s *Server) handleJobEvents(w http.ResponseWriter, r *http.Request) {
+	rec := s.lookupJob(w, r)
+	if rec == nil {
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		jsonError(w, http.StatusInternalServerError, "streaming not supported")
+		return
+	}
+
+	after := 0
+	for _, v := range []string{r.URL.Query().Get("after"), r.Header.Get("Last-Event-ID")} {
+		if v == "" {
+			continue
+		}
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			jsonError(w, http.StatusBadRequest, "event offset must be a non-negative integer")
+			return
+		}
+		after = n
+		break
+	}
+
+	// Jobs can run far longer than the server's write timeout
+	http.NewResponseController(w).SetWriteDeadline(time.Time{})
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+
+	write := func(events []store.JobEvent) {
+		for _, e := range events {
+			sseEvent{id: e.Seq, name: e.Name, data: e.Data}.write(w)
+			after = e.Seq
+		}
+		flusher.Flush()
+	}
+
+	j := s.jobs.get(rec.ID)
+	if j == nil {
+		events, err := s.store.ListJobEvents(rec.ID, after)
+		if err != nil {
+			log.Printf("job %s: reading events: %v", rec.ID, err)
+		}
+		write(events)
+		return
+	}
+
+	for {
+		events, finished, wake := j.since(after)
+		write(events)
+		if finished {
+			return
+		}
+		select {
+		case <-wake:
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// handleCancelJob cancels a running job, killing its CLI process, and
+// returns the job once it has stopped.
+func (s *Server) handleCancelJob(w http.ResponseWriter, r *http.Request) {
+	rec := s.lookupJob(w, r)
+	if rec == nil {
+		return
+	}
+	j := s.jobs.get(rec.ID)
+	if j == nil {
+		jsonError(w, http.StatusConflict, "job is not running: "+rec.Status)
+		return
+	}
+
+	j.cancel()
+	select {
+	case <-j.done:
+	case <-time.After(10 * time.Second):
+	}
+	s.handleGetJob(w, r)
+}
@@ -0,0 +1,78 @@
+package server
+
+import (
+	"context"
+
+	"plugmyai/internal/provider"
+	"plugmyai/internal/tokens"
+)
+
+// applyMaxTokens ends a stream once its content reaches max tokens, for
+// providers that can't limit their output (the CLIs). Tokens are counted
+// with the local estimator. The chunk that crosses the limit is cut to fit,
+// then a Done chunk with finish_reason "length" is sent and cancel stops
+// the provider. Chunks are sent on ctx, which must outlive the provider's.
+func applyMaxTokens(ctx context.Context, stream <-chan provider.ChatCompletionChunk, max int, cancel context.CancelFunc) <-chan provider.ChatCompletionChunk {
+	ch := make(chan provider.ChatCompletionChunk, 32)
+
+	go func() {
+		defer close(ch)
+		defer cancel()
+
+		send := func(chunk provider.ChatCompletionChunk) bool {
+			select {
+			case ch <- chunk:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		}
+
+		used := 0
+		for chunk := range stream {
+			n := tokens.Count(chunk.Content)
+			if used+n <= max {
+				used += n
+				if !send(chunk) {
+					return
+				}
+				continue
+			}
+
+			head := provider.ChatCompletionChunk{Content: truncateTokens(chunk.Content, max-used), Reasoning: chunk.Reasoning}
+			if (head.Content != "" || head.Reasoning != "") && !send(head) {
+				return
+			}
+			send(provider.ChatCompletionChunk{Done: true, FinishReason: "length"})
+			cancel()
+			for range stream {
+				// let the provider wind down
+			}
+			return
+		}
+	}()
+
+	return ch
+}
+
+// truncateTokens returns the longest prefix of s within n tokens. Counts
+// only grow as a prefix grows, so the cut is found by bisection over the
+// rune boundaries.
+func truncateTokens(s string, n int) string {
+	cuts := make([]int, 0, len(s)+1)
+	for i := range s {
+		cuts = append(cuts, i)
+	}
+	cuts = append(cuts, len(s))
+
+	lo, hi := 0, len(cuts)-1
+	for lo < hi {
+		mid := (lo + hi + 1) / 2
+		if tokens.Count(s[:cuts[mid]]) <= n {
+			lo = mid
+		} else {
+			hi = mid - 1
+		}
+	}
+	return s[:cuts[lo]]
+}
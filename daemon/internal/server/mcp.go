@@ -0,0 +1,261 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"plugmyai/internal/mcp"
+	"plugmyai/internal/provider"
+	"plugmyai/internal/secret"
+	"plugmyai/internal/store"
+)
+
+// supportedMCPVersions are the protocol revisions a client may negotiate.
+// Anything else gets mcp.ProtocolVersion.
+var supportedMCPVersions = map[string]bool{
+	mcp.ProtocolVersion: true,
+	"2025-03-26":        true,
+	"2024-11-05":        true,
+}
+
+// mcpTools are the tools the daemon offers to MCP clients.
+var mcpTools = []mcp.Tool{
+	{
+		Name:        "chat",
+		Description: "Send a prompt or conversation to one of the models routed by PlugMyAI and return the reply.",
+		InputSchema: map[string]any{
+			"type": "object",
+			"properties": map[string]any{
+				"prompt": map[string]any{"type": "string", "description": "User message. Ignored when messages is set."},
+				"system": map[string]any{"type": "string", "description": "Optional system prompt."},
+				"messages": map[string]any{
+					"type":        "array",
+					"description": "Full conversation as OpenAI-style {role, content} messages.",
+					"items": map[string]any{
+						"type": "object",
+						"properties": map[string]any{
+							"role":    map[string]any{"type": "string"},
+							"content": map[string]any{"type": "string"},
+						},
+						"required": []string{"role", "content"},
+					},
+				},
+				"model":       map[string]any{"type": "string", "description": "Model ID from list_models. Defaults to the first available provider."},
+				"temperature": map[string]any{"type": "number"},
+				"max_tokens":  map[string]any{"type": "integer"},
+			},
+		},
+	},
+	{
+		Name:        "list_models",
+		Description: "List the models this app may use.",
+		InputSchema: map[string]any{"type": "object", "properties": map[string]any{}},
+	},
+	{
+		Name:        "list_history",
+		Description: "List this app's most recent requests, newest first.",
+		InputSchema: map[string]any{
+			"type": "object",
+			"properties": map[string]any{
+				"limit":  map[string]any{"type": "integer", "description": "Number of entries (default 10, max 50)."},
+				"offset": map[string]any{"type": "integer"},
+			},
+		},
+	},
+}
+
+// handleMCP serves the daemon as an MCP server over streamable HTTP.
+// Each POST carries one JSON-RPC message and gets a plain JSON response;
+// the server never opens an SSE stream. Tools run with the caller's app
+// token, so they see the same providers and policies as /v1/chat/completions.
+func (s *Server) handleMCP(w http.ResponseWriter, r *http.Request) {
+	var req mcp.Request
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeRPC(w, nil, nil, &mcp.RPCError{Code: mcp.CodeParseError, Message: "parse error: " + err.Error()})
+		return
+	}
+
+	// Notifications and responses to server requests need no reply
+	if req.IsNotification() || req.Method == "" {
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+
+	result, rpcErr := s.dispatchMCP(r.Context(), &req)
+	writeRPC(w, req.ID, result, rpcErr)
+}
+
+// handleMCPStream answers GET on the MCP endpoint: no server-initiated stream.
+func (s *Server) handleMCPStream(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Allow", "POST")
+	jsonError(w, http.StatusMethodNotAllowed, "this MCP endpoint does not offer an SSE stream")
+}
+
+func (s *Server) dispatchMCP(ctx context.Context, req *mcp.Request) (any, *mcp.RPCError) {
+	switch req.Method {
+	case "initialize":
+		var params struct {
+			ProtocolVersion string `json:"protocolVersion"`
+		}
+		json.Unmarshal(req.Params, &params)
+		version := params.ProtocolVersion
+		if !supportedMCPVersions[version] {
+			version = mcp.ProtocolVersion
+		}
+		return map[string]any{
+			"protocolVersion": version,
+			"capabilities":    map[string]any{"tools": map[string]any{}},
+			"serverInfo":      map[string]any{"name": "plug-my-ai", "version": Version},
+		}, nil
+
+	case "ping":
+		return map[string]any{}, nil
+
+	case "tools/list":
+		return map[string]any{"tools": mcpTools}, nil
+
+	case "tools/call":
+		var params mcp.CallToolParams
+		if err := json.Unmarshal(req.Params, &params); err != nil {
+			return nil, &mcp.RPCError{Code: mcp.CodeInvalidParams, Message: "invalid params: " + err.Error()}
+		}
+		switch params.Name {
+		case "chat":
+			return s.mcpChat(ctx, params.Arguments), nil
+		case "list_models":
+			return s.mcpListModels(ctx), nil
+		case "list_history":
+			return s.mcpListHistory(ctx, params.Arguments), nil
+		}
+		return nil, &mcp.RPCError{Code: mcp.CodeInvalidParams, Message: "unknown tool: " + params.Name}
+	}
+
+	return nil, &mcp.RPCError{Code: mcp.CodeMethodNotFound, Message: "method not found: " + req.Method}
+}
+
+// mcpChat runs a chat completion on behalf of the calling app, logging it to
+// history like any other request.
+func (s *Server) mcpChat(ctx context.Context, rawArgs json.RawMessage) *mcp.CallToolResult {
+	var args struct {
+		Prompt      string             `json:"prompt"`
+		System      string             `json:"system"`
+		Messages    []provider.Message `json:"messages"`
+		Model       string             `json:"model"`
+		Temperature *float64           `json:"temperature"`
+		MaxTokens   *int               `json:"max_tokens"`
+	}
+	if len(rawArgs) > 0 {
+		if err := json.Unmarshal(rawArgs, &args); err != nil {
+			return mcp.ErrorResult(fmt.Errorf("invalid arguments: %w", err))
+		}
+	}
+
+	req := provider.ChatCompletionRequest{
+		Model:       args.Model,
+		Messages:    args.Messages,
+		Temperature: args.Temperature,
+		MaxTokens:   args.MaxTokens,
+	}
+	if len(req.Messages) == 0 {
+		if args.Prompt == "" {
+			return mcp.ErrorResult(fmt.Errorf("prompt or messages is required"))
+		}
+		if args.System != "" {
+			req.Messages = append(req.Messages, provider.Message{Role: "system", Content: args.System})
+		}
+		req.Messages = append(req.Messages, provider.Message{Role: "user", Content: args.Prompt})
+	}
+
+	p, release, err := s.prepareCompletion(ctx, &req)
+	if err != nil {
+		return mcp.ErrorResult(err)
+	}
+	defer release()
+
+	appID := ctx.Value(ctxAppID).(string)
+	appName := ctx.Value(ctxAppName).(string)
+	startTime := time.Now()
+	messagesJSON, _ := json.Marshal(req.Messages)
+
+	stream, err := s.complete(ctx, p, &req)
+	if err != nil {
+		return mcp.ErrorResult(fmt.Errorf("provider error: %s", secret.Redact(err.Error())))
+	}
+
+	resp, usage, err := collectStream(stream)
+	if err != nil {
+		s.logRequest(appID, appName, req.Model, p.ID(), messagesJSON, historyResponse{ToolTrace: resp.ToolTrace}, nil, startTime, err)
+		return mcp.ErrorResult(fmt.Errorf("%s", secret.Redact(err.Error())))
+	}
+	s.logRequest(appID, appName, req.Model, p.ID(), messagesJSON, resp, usage, startTime, nil)
+	return mcp.TextResult(resp.Content)
+}
+
+// mcpListModels lists the models the calling app may use.
+func (s *Server) mcpListModels(ctx context.Context) *mcp.CallToolResult {
+	allowed := ctx.Value(ctxAllowedProviders).([]string)
+
+	models := []map[string]string{}
+	for _, m := range s.registry.AllModels() {
+		if !providerAllowed(allowed, m.Provider) {
+			continue
+		}
+		models = append(models, map[string]string{"id": m.ID, "name": m.Name, "provider": m.Provider})
+	}
+	return jsonResult(models)
+}
+
+// mcpListHistory lists the calling app's history. The admin token sees all apps.
+func (s *Server) mcpListHistory(ctx context.Context, rawArgs json.RawMessage) *mcp.CallToolResult {
+	var args struct {
+		Limit  int `json:"limit"`
+		Offset int `json:"offset"`
+	}
+	if len(rawArgs) > 0 {
+		if err := json.Unmarshal(rawArgs, &args); err != nil {
+			return mcp.ErrorResult(fmt.Errorf("invalid arguments: %w", err))
+		}
+	}
+	if args.Limit <= 0 {
+		args.Limit = 10
+	}
+	if args.Limit > 50 {
+		args.Limit = 50
+	}
+
+	filter := store.HistoryFilter{Limit: args.Limit, Offset: args.Offset}
+	if isAdmin, _ := ctx.Value(ctxIsAdmin).(bool); !isAdmin {
+		filter.AppID = ctx.Value(ctxAppID).(string)
+	}
+	entries, _, err := s.store.ListHistoryFiltered(filter)
+	if err != nil {
+		return mcp.ErrorResult(fmt.Errorf("listing history: %w", err))
+	}
+	if entries == nil {
+		entries = []store.HistoryEntry{}
+	}
+	return jsonResult(entries)
+}
+
+// jsonResult returns v as an indented JSON text tool result.
+func jsonResult(v any) *mcp.CallToolResult {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return mcp.ErrorResult(err)
+	}
+	return mcp.TextResult(string(data))
+}
+
+func writeRPC(w http.ResponseWriter, id json.RawMessage, result any, rpcErr *mcp.RPCError) {
+	if id == nil {
+		id = json.RawMessage("null")
+	}
+	resp := mcp.Response{JSONRPC: "2.0", ID: id, Result: result, Error: rpcErr}
+	if rpcErr == nil && result == nil {
+		resp.Result = map[string]any{}
+	}
+	jsonOK(w, resp)
+}
@@ -4,6 +4,8 @@ import (
 	"context"
 	"net/http"
 	"strings"
+
+	"plugmyai/internal/store"
 )
 
 // corsMiddleware adds CORS headers for localhost web apps.
@@ -18,8 +20,9 @@ func corsMiddleware(next http.Handler) http.Handler {
 			w.Header().Set("Access-Control-Allow-Origin", "*")
 		}
 
-		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type")
+		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, PATCH, DELETE, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type, Mcp-Protocol-Version, Mcp-Session-Id, X-PlugMyAI-Provider, X-PlugMyAI-Strict-Params")
+		w.Header().Set("Access-Control-Expose-Headers", "Retry-After, X-PlugMyAI-Ignored-Params")
 		w.Header().Set("Access-Control-Max-Age", "86400")
 
 		if r.Method == http.MethodOptions {
@@ -39,12 +42,13 @@ const (
 	ctxIsAdmin          contextKey = "is_admin"
 	ctxAllowedProviders contextKey = "allowed_providers"
 	ctxScope            contextKey = "scope"
+	ctxApp              contextKey = "app" // *store.App; nil for the admin token
 )
 
 // authMiddleware validates bearer tokens for API requests.
 type authMiddleware struct {
 	adminToken string
-	lookupApp  func(token string) (appID, appName, scope string, providers []string, ok bool)
+	lookupApp  func(token string) (*store.App, bool)
 }
 
 // requireApp validates that the request has a valid app token.
@@ -58,27 +62,42 @@ func (a *authMiddleware) requireApp(next http.HandlerFunc) http.HandlerFunc {
 
 		// Admin token also works for app endpoints — always unrestricted
 		if token == a.adminToken {
-			ctx := context.WithValue(r.Context(), ctxAppID, "admin")
-			ctx = context.WithValue(ctx, ctxAppName, "admin")
-			ctx = context.WithValue(ctx, ctxIsAdmin, true)
-			ctx = context.WithValue(ctx, ctxAllowedProviders, []string(nil))
-			ctx = context.WithValue(ctx, ctxScope, "full")
-			next.ServeHTTP(w, r.WithContext(ctx))
+			next.ServeHTTP(w, r.WithContext(appContext(r.Context(), nil)))
 			return
 		}
 
-		appID, appName, scope, providers, ok := a.lookupApp(token)
+		app, ok := a.lookupApp(token)
 		if !ok {
 			jsonError(w, http.StatusUnauthorized, "invalid or revoked token")
 			return
 		}
+		next.ServeHTTP(w, r.WithContext(appContext(r.Context(), app)))
+	}
+}
 
-		ctx := context.WithValue(r.Context(), ctxAppID, appID)
-		ctx = context.WithValue(ctx, ctxAppName, appName)
-		ctx = context.WithValue(ctx, ctxScope, scope)
-		ctx = context.WithValue(ctx, ctxAllowedProviders, providers)
-		next.ServeHTTP(w, r.WithContext(ctx))
+// canAccess reports whether the caller of r may see a resource owned by
+// appID: apps see their own, the admin token everything.
+func canAccess(r *http.Request, appID string) bool {
+	isAdmin, _ := r.Context().Value(ctxIsAdmin).(bool)
+	return isAdmin || r.Context().Value(ctxAppID) == appID
+}
+
+// appContext adds the calling app's identity and grants to ctx; a nil app
+// is the admin token, which is unrestricted.
+func appContext(ctx context.Context, app *store.App) context.Context {
+	if app == nil {
+		ctx = context.WithValue(ctx, ctxAppID, "admin")
+		ctx = context.WithValue(ctx, ctxAppName, "admin")
+		ctx = context.WithValue(ctx, ctxIsAdmin, true)
+		ctx = context.WithValue(ctx, ctxAllowedProviders, []string(nil))
+		ctx = context.WithValue(ctx, ctxScope, "full")
+		return context.WithValue(ctx, ctxApp, (*store.App)(nil))
 	}
+	ctx = context.WithValue(ctx, ctxAppID, app.ID)
+	ctx = context.WithValue(ctx, ctxAppName, app.Name)
+	ctx = context.WithValue(ctx, ctxScope, app.Scope)
+	ctx = context.WithValue(ctx, ctxAllowedProviders, app.Providers)
+	return context.WithValue(ctx, ctxApp, app)
 }
 
 // requireAdmin validates that the request has the admin token.
@@ -6,27 +6,26 @@ import (
 	"os/exec"
 	"runtime"
 	"strings"
+	"time"
 )
 
 // showConnectDialog shows a native macOS dialog for connection approval.
+// details is an optional extra line (e.g. the requested tools).
 // On non-macOS platforms, falls back to opening the browser approval page.
 // Runs asynchronously — returns immediately.
-func showConnectDialog(appName, approveURL string, onApprove, onDeny func()) {
+func showConnectDialog(appName, details, approveURL string, onApprove, onDeny func()) {
 	if runtime.GOOS != "darwin" {
 		go openBrowser(approveURL)
 		return
 	}
 
 	go func() {
-		escaped := strings.ReplaceAll(appName, `"`, `\"`)
-		script := fmt.Sprintf(
-			`display dialog "%s wants to connect to your AI" `+
-				`buttons {"Deny", "Open Dashboard", "Approve"} `+
-				`default button "Approve" with title "PlugMyAI"`,
-			escaped)
+		message := appName + " wants to connect to your AI"
+		if details != "" {
+			message += "\n\n" + details
+		}
 
-		cmd := exec.Command("osascript", "-e", script)
-		out, err := cmd.Output()
+		result, err := displayDialog(message, "Approve", 0)
 		if err != nil {
 			// User pressed Cancel or dialog failed — treat as deny
 			log.Printf("connect dialog error: %v", err)
@@ -34,7 +33,6 @@ func showConnectDialog(appName, approveURL string, onApprove, onDeny func()) {
 			return
 		}
 
-		result := string(out)
 		switch {
 		case strings.Contains(result, "Approve"):
 			onApprove()
@@ -47,6 +45,65 @@ func showConnectDialog(appName, approveURL string, onApprove, onDeny func()) {
 	}()
 }
 
+// showApprovalDialog asks the user to allow or deny a single agent tool call.
+// The dialog gives up after timeout, which counts as a deny.
+// On non-macOS platforms, falls back to opening the dashboard approval page.
+// Runs asynchronously — returns immediately.
+func showApprovalDialog(appName, tool, summary, approveURL string, timeout time.Duration, onApprove, onDeny func()) {
+	if runtime.GOOS != "darwin" {
+		go openBrowser(approveURL)
+		return
+	}
+
+	go func() {
+		message := appName + " wants to run " + tool
+		if summary != "" {
+			message += "\n\n" + summary
+		}
+
+		// Deny is the default: Return must not approve a tool call
+		result, err := displayDialog(message, "Deny", timeout)
+		if err != nil {
+			log.Printf("approval dialog error: %v", err)
+			onDeny()
+			return
+		}
+
+		switch {
+		case strings.Contains(result, "gave up:true"):
+			onDeny()
+		case strings.Contains(result, "Approve"):
+			onApprove()
+		case strings.Contains(result, "Open Dashboard"):
+			openBrowser(approveURL)
+		default:
+			onDeny()
+		}
+	}()
+}
+
+// displayDialog shows a Deny / Open Dashboard / Approve dialog via osascript
+// and returns its raw result (e.g. "button returned:Approve").
+// defaultButton is the button Return presses.
+// A non-zero giveUp closes the dialog automatically after that long.
+// The message is passed as a script argument, never spliced into the
+// script, since it can carry text from apps and agents.
+func displayDialog(message, defaultButton string, giveUp time.Duration) (string, error) {
+	dialog := `display dialog (item 1 of argv) ` +
+		`buttons {"Deny", "Open Dashboard", "Approve"} ` +
+		fmt.Sprintf(`default button %q with title "PlugMyAI"`, defaultButton)
+	if giveUp > 0 {
+		dialog += fmt.Sprintf(" giving up after %d", int(giveUp.Seconds()))
+	}
+
+	out, err := exec.Command("osascript",
+		"-e", "on run argv",
+		"-e", dialog,
+		"-e", "end run",
+		"--", message).Output()
+	return string(out), err
+}
+
 // openBrowser opens the given URL in the user's default browser.
 func openBrowser(url string) {
 	var cmd *exec.Cmd
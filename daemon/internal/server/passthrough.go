@@ -0,0 +1,239 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"strings"
+	"time"
+
+	"plugmyai/internal/provider"
+	"plugmyai/internal/secret"
+	"plugmyai/internal/store"
+)
+
+// passthroughPaths are the OpenAI endpoints relayed as is to a provider that
+// implements provider.Forwarder (openai-compat).
+var passthroughPaths = []string{
+	"/v1/audio/speech",
+	"/v1/audio/transcriptions",
+	"/v1/audio/translations",
+	"/v1/images/generations",
+	"/v1/images/edits",
+	"/v1/images/variations",
+	"/v1/moderations",
+}
+
+// providerHeader picks the provider for a passthrough request by ID.
+const providerHeader = "X-PlugMyAI-Provider"
+
+// maxLoggedBody is the most of a request or response body kept in history.
+const maxLoggedBody = 64 * 1024
+
+// passthroughHeaders are the upstream response headers passed to the client.
+var passthroughHeaders = []string{"Content-Type", "Content-Disposition", "Retry-After", "X-Request-Id"}
+
+func (s *Server) handlePassthrough(w http.ResponseWriter, r *http.Request) {
+	limit := s.cfg.PassthroughMaxBytes()
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, limit))
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			jsonError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("request body exceeds %d MB", limit>>20))
+			return
+		}
+		jsonError(w, http.StatusBadRequest, "reading request body: "+err.Error())
+		return
+	}
+
+	contentType := r.Header.Get("Content-Type")
+	summary, model := summarizeRequest(contentType, body)
+
+	p, fw, err := s.forwarderFor(r.Context(), r.URL.Path, r.Header.Get(providerHeader), model)
+	if err != nil {
+		writeCompletionError(w, err)
+		return
+	}
+
+	appID := r.Context().Value(ctxAppID).(string)
+	appName := r.Context().Value(ctxAppName).(string)
+	startTime := time.Now()
+	request, _ := json.Marshal(map[string]any{"endpoint": r.URL.Path, "request": summary})
+	entry := &store.HistoryEntry{
+		ID:       generateShortID(),
+		AppID:    appID,
+		AppName:  appName,
+		Model:    model,
+		Provider: p.ID(),
+		Messages: request,
+		Status:   "success",
+	}
+	defer func() {
+		entry.DurationMS = time.Since(startTime).Milliseconds()
+		if err := s.store.LogRequest(entry); err != nil {
+			log.Printf("failed to log request: %v", err)
+		}
+	}()
+
+	resp, err := fw.Forward(r.Context(), strings.TrimPrefix(r.URL.Path, "/v1"), model, contentType, body)
+	if err != nil {
+		entry.Status = "error"
+		entry.ErrorMessage = secret.Redact(err.Error())
+		entry.Response = json.RawMessage("{}")
+		writeProviderError(w, err)
+		return
+	}
+	defer resp.Body.Close()
+
+	for _, h := range passthroughHeaders {
+		if v := resp.Header.Get(h); v != "" {
+			w.Header().Set(h, v)
+		}
+	}
+	w.WriteHeader(resp.StatusCode)
+
+	// Keep the start of textual responses for history; binary ones are
+	// recorded by type and size only
+	respType := resp.Header.Get("Content-Type")
+	var kept bytes.Buffer
+	dst := io.Writer(w)
+	if isTextual(respType) {
+		dst = io.MultiWriter(w, &limitedWriter{buf: &kept, n: maxLoggedBody})
+	}
+	n, copyErr := io.Copy(dst, resp.Body)
+
+	logged := map[string]any{"content_type": respType, "bytes": n, "status": resp.StatusCode}
+	if kept.Len() > 0 {
+		logged["content"] = secret.Redact(kept.String())
+	}
+	entry.Response, _ = json.Marshal(logged)
+
+	switch {
+	case resp.StatusCode >= 400:
+		entry.Status = "error"
+		entry.ErrorMessage = fmt.Sprintf("upstream returned status %d", resp.StatusCode)
+	case copyErr != nil:
+		entry.Status = "error"
+		entry.ErrorMessage = "copying response: " + copyErr.Error()
+	}
+}
+
+// forwarderFor picks the provider for a passthrough request: the one named
+// by id, else the first that serves model, else the first available one that
+// can forward at all — among routable providers the app may use.
+func (s *Server) forwarderFor(ctx context.Context, path, id, model string) (provider.Provider, provider.Forwarder, error) {
+	allowed := ctx.Value(ctxAllowedProviders).([]string)
+
+	if id != "" {
+		p := s.registry.FindByID(id)
+		fw, ok := p.(provider.Forwarder)
+		if p == nil || !ok {
+			return nil, nil, &completionError{http.StatusBadRequest, "provider cannot serve " + path + ": " + id}
+		}
+		if !providerAllowed(allowed, id) {
+			return nil, nil, &completionError{http.StatusForbidden, "app is not allowed to use provider: " + id}
+		}
+		if !provider.Routable(p) {
+			return nil, nil, &completionError{http.StatusServiceUnavailable, "provider is unavailable: " + id}
+		}
+		return p, fw, nil
+	}
+
+	var candidates []provider.Provider
+	// Providers with an open circuit breaker stay candidates: Forward
+	// refuses with a 503 and Retry-After, which tells clients more than a 400
+	for _, p := range s.registry.Routable() {
+		if _, ok := p.(provider.Forwarder); ok && providerAllowed(allowed, p.ID()) {
+			candidates = append(candidates, p)
+		}
+	}
+	if len(candidates) == 0 {
+		return nil, nil, &completionError{http.StatusBadRequest, "no available provider can serve " + path}
+	}
+
+	if model != "" && len(candidates) > 1 {
+		for _, p := range candidates {
+			for _, m := range p.Models() {
+				if m.ID == model {
+					return p, p.(provider.Forwarder), nil
+				}
+			}
+		}
+	}
+	for _, p := range candidates {
+		if p.Available() {
+			return p, p.(provider.Forwarder), nil
+		}
+	}
+	return candidates[0], candidates[0].(provider.Forwarder), nil
+}
+
+// summarizeRequest describes a passthrough request body for history, without
+// binary payloads, and returns its model field if it has one.
+func summarizeRequest(contentType string, body []byte) (any, string) {
+	mediaType, params, _ := mime.ParseMediaType(contentType)
+
+	switch {
+	case mediaType == "application/json":
+		var fields map[string]any
+		if err := json.Unmarshal(body, &fields); err != nil {
+			return map[string]any{"content_type": contentType, "bytes": len(body)}, ""
+		}
+		model, _ := fields["model"].(string)
+		if len(body) > maxLoggedBody {
+			return map[string]any{"content_type": contentType, "bytes": len(body), "model": model}, model
+		}
+		return fields, model
+
+	case strings.HasPrefix(mediaType, "multipart/") && params["boundary"] != "":
+		fields := map[string]any{}
+		mr := multipart.NewReader(bytes.NewReader(body), params["boundary"])
+		for {
+			part, err := mr.NextPart()
+			if err != nil {
+				break
+			}
+			data, _ := io.ReadAll(part)
+			if part.FileName() != "" {
+				fields[part.FormName()] = map[string]any{
+					"filename":     part.FileName(),
+					"content_type": part.Header.Get("Content-Type"),
+					"bytes":        len(data),
+				}
+			} else if len(data) <= maxLoggedBody {
+				fields[part.FormName()] = string(data)
+			}
+		}
+		model, _ := fields["model"].(string)
+		return fields, model
+	}
+
+	return map[string]any{"content_type": contentType, "bytes": len(body)}, ""
+}
+
+// isTextual reports whether a response of this type is worth keeping in
+// history (JSON, text), as opposed to audio or images.
+func isTextual(contentType string) bool {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	return strings.HasPrefix(mediaType, "text/") || strings.HasSuffix(mediaType, "json")
+}
+
+// limitedWriter keeps the first n bytes written to it and discards the rest.
+type limitedWriter struct {
+	buf *bytes.Buffer
+	n   int
+}
+
+func (lw *limitedWriter) Write(p []byte) (int, error) {
+	if room := lw.n - lw.buf.Len(); room > 0 {
+		lw.buf.Write(p[:min(room, len(p))])
+	}
+	return len(p), nil
+}
@@ -10,7 +10,9 @@ import (
 	"time"
 
 	"plugmyai/internal/config"
+	"plugmyai/internal/mcp"
 	"plugmyai/internal/provider"
+	"plugmyai/internal/secret"
 	"plugmyai/internal/store"
 )
 
@@ -21,27 +23,46 @@ type Server struct {
 	store     *store.Store
 	registry  *provider.Registry
 	startTime time.Time
+
+	mcpServers map[string]mcp.ServerConfig // resolved cfg.MCPServers
+
 	httpSrv   *http.Server
+	approvals *approvalQueue
+	jobs      *jobRegistry
+
+	batches    *batchRegistry
+	batchSlots chan struct{} // caps batch requests running at once
 }
 
-func New(cfg *config.Config, st *store.Store, reg *provider.Registry) *Server {
+// New creates a server. mcpServers are cfg.MCPServers with their secret
+// references resolved; they are what runs get.
+func New(cfg *config.Config, st *store.Store, reg *provider.Registry, mcpServers map[string]mcp.ServerConfig) *Server {
 	return &Server{
-		cfg:       cfg,
-		store:     st,
-		registry:  reg,
-		startTime: time.Now(),
+		cfg:        cfg,
+		store:      st,
+		registry:   reg,
+		mcpServers: mcpServers,
+		startTime:  time.Now(),
+		approvals:  newApprovalQueue(),
+		jobs:       newJobRegistry(),
+
+		batches:    newBatchRegistry(),
+		batchSlots: make(chan struct{}, cfg.BatchRequests()),
 	}
 }
 
 func (s *Server) Start(dashboardFS fs.FS) error {
+	s.failInterruptedJobs()
+	s.resumeBatches()
+
 	auth := &authMiddleware{
-		adminToken: s.cfg.AdminToken,
-		lookupApp: func(token string) (string, string, string, []string, bool) {
+		adminToken: s.cfg.ResolvedAdminToken(),
+		lookupApp: func(token string) (*store.App, bool) {
 			app, err := s.store.GetAppByToken(token)
 			if err != nil || app == nil {
-				return "", "", "", nil, false
+				return nil, false
 			}
-			return app.ID, app.Name, app.Scope, app.Providers, true
+			return app, true
 		},
 	}
 
@@ -62,6 +83,28 @@ func (s *Server) Start(dashboardFS fs.FS) error {
 	// App endpoints (require app or admin token)
 	mux.HandleFunc("GET /v1/models", auth.requireApp(s.handleModels))
 	mux.HandleFunc("POST /v1/chat/completions", auth.requireApp(s.handleChatCompletions))
+	mux.HandleFunc("GET /v1/jobs/{id}", auth.requireApp(s.handleGetJob))
+	mux.HandleFunc("GET /v1/jobs/{id}/events", auth.requireApp(s.handleJobEvents))
+	mux.HandleFunc("POST /v1/jobs/{id}/cancel", auth.requireApp(s.handleCancelJob))
+	mux.HandleFunc("POST /v1/files", auth.requireApp(s.handleUploadFile))
+	mux.HandleFunc("GET /v1/files", auth.requireApp(s.handleListFiles))
+	mux.HandleFunc("GET /v1/files/{id}", auth.requireApp(s.handleGetFile))
+	mux.HandleFunc("GET /v1/files/{id}/content", auth.requireApp(s.handleFileContent))
+	mux.HandleFunc("DELETE /v1/files/{id}", auth.requireApp(s.handleDeleteFile))
+	mux.HandleFunc("POST /v1/batches", auth.requireApp(s.handleCreateBatch))
+	mux.HandleFunc("GET /v1/batches", auth.requireApp(s.handleListBatches))
+	mux.HandleFunc("GET /v1/batches/{id}", auth.requireApp(s.handleGetBatch))
+	mux.HandleFunc("POST /v1/batches/{id}/cancel", auth.requireApp(s.handleCancelBatch))
+	for _, path := range passthroughPaths {
+		mux.HandleFunc("POST "+path, auth.requireApp(s.handlePassthrough))
+	}
+
+	// MCP server over streamable HTTP (same app token and scoping as above)
+	mux.HandleFunc("POST /v1/mcp", auth.requireApp(s.handleMCP))
+	mux.HandleFunc("GET /v1/mcp", auth.requireApp(s.handleMCPStream))
+
+	// Tool approval hook (authenticated by a per-run token, not an app token)
+	mux.HandleFunc("POST /v1/approvals/hook", s.handleApprovalHook)
 
 	// Onboarding endpoints (require admin token)
 	mux.HandleFunc("GET /v1/onboarding/status", auth.requireAdmin(s.handleOnboardingStatus))
@@ -74,7 +117,15 @@ func (s *Server) Start(dashboardFS fs.FS) error {
 	mux.HandleFunc("GET /v1/history/{id}", auth.requireAdmin(s.handleGetHistory))
 	mux.HandleFunc("GET /v1/providers", auth.requireAdmin(s.handleProviders))
 	mux.HandleFunc("GET /v1/apps", auth.requireAdmin(s.handleListApps))
+	mux.HandleFunc("PATCH /v1/apps/{id}", auth.requireAdmin(s.handleUpdateApp))
 	mux.HandleFunc("DELETE /v1/apps/{id}", auth.requireAdmin(s.handleRevokeApp))
+	mux.HandleFunc("PUT /v1/apps/{id}/tools", auth.requireAdmin(s.handleSetAppTools))
+	mux.HandleFunc("DELETE /v1/apps/{id}/tools", auth.requireAdmin(s.handleClearAppTools))
+	mux.HandleFunc("PUT /v1/apps/{id}/mcp-servers", auth.requireAdmin(s.handleSetAppMCPServers))
+	mux.HandleFunc("GET /v1/mcp-servers", auth.requireAdmin(s.handleListMCPServers))
+	mux.HandleFunc("GET /v1/approvals", auth.requireAdmin(s.handleListApprovals))
+	mux.HandleFunc("POST /v1/approvals/{id}/approve", auth.requireAdmin(s.handleResolveApproval(true)))
+	mux.HandleFunc("POST /v1/approvals/{id}/deny", auth.requireAdmin(s.handleResolveApproval(false)))
 
 	// Dashboard SPA — serve static files, fallback to index.html
 	if dashboardFS != nil {
@@ -82,7 +133,7 @@ func (s *Server) Start(dashboardFS fs.FS) error {
 
 		// Read index.html once at startup, inject admin token
 		indexHTML, _ := fs.ReadFile(dashboardFS, "index.html")
-		injectedIndex := injectAdminToken(indexHTML, s.cfg.AdminToken)
+		injectedIndex := injectAdminToken(indexHTML, s.cfg.ResolvedAdminToken())
 
 		mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 			// Try serving the file directly (non-root paths)
@@ -112,7 +163,7 @@ func (s *Server) Start(dashboardFS fs.FS) error {
 
 	log.Printf("plug-my-ai v%s listening on http://localhost%s", Version, addr)
 	log.Printf("Dashboard: http://localhost%s", addr)
-	log.Printf("Admin token: %s", s.cfg.AdminToken)
+	log.Printf("Admin token: %s", s.cfg.ResolvedAdminToken())
 
 	return s.httpSrv.ListenAndServe()
 }
@@ -144,7 +195,7 @@ func jsonError(w http.ResponseWriter, status int, msg string) {
 	w.WriteHeader(status)
 	json.NewEncoder(w).Encode(map[string]any{
 		"error": map[string]any{
-			"message": msg,
+			"message": secret.Redact(msg),
 			"type":    "invalid_request_error",
 		},
 	})
@@ -0,0 +1,106 @@
+package server
+
+import (
+	"context"
+	"strings"
+
+	"plugmyai/internal/provider"
+)
+
+// applyStop ends a stream at the first of the stop sequences, for providers
+// without native stop support. Text that could be the start of a sequence
+// is held back until the next chunk decides it, so a sequence split across
+// chunks is still caught. On a match the text before it is sent, cancel
+// stops the provider, then a Done chunk with finish_reason "stop" carries
+// the usage the provider reported, if any.
+func applyStop(ctx context.Context, stream <-chan provider.ChatCompletionChunk, stops []string, cancel context.CancelFunc) <-chan provider.ChatCompletionChunk {
+	ch := make(chan provider.ChatCompletionChunk, 32)
+
+	go func() {
+		defer close(ch)
+		defer cancel()
+
+		send := func(chunk provider.ChatCompletionChunk) bool {
+			select {
+			case ch <- chunk:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		}
+
+		var pending string
+		for chunk := range stream {
+			pending += chunk.Content
+
+			if i := indexStop(pending, stops); i >= 0 {
+				before := provider.ChatCompletionChunk{Content: pending[:i], Reasoning: chunk.Reasoning, Trace: chunk.Trace}
+				if (before.Content != "" || before.Reasoning != "" || before.Trace != nil) && !send(before) {
+					return
+				}
+				done := provider.ChatCompletionChunk{Done: true, FinishReason: "stop", Usage: chunk.Usage}
+				if chunk.Done {
+					done.ToolCalls = chunk.ToolCalls
+				}
+				cancel()
+				for c := range stream {
+					// let the provider wind down, keeping usage it still reports
+					if c.Usage != nil {
+						done.Usage = c.Usage
+					}
+				}
+				send(done)
+				return
+			}
+
+			// Nothing follows a Done or error chunk, so hold nothing back there
+			hold := 0
+			if !chunk.Done && chunk.Error == nil {
+				hold = partialStop(pending, stops)
+			}
+			chunk.Content = pending[:len(pending)-hold]
+			pending = pending[len(pending)-hold:]
+
+			if chunk.Content == "" && chunk.Reasoning == "" && !chunk.Done && chunk.Error == nil && chunk.Trace == nil {
+				continue
+			}
+			if !send(chunk) {
+				return
+			}
+		}
+		if pending != "" {
+			send(provider.ChatCompletionChunk{Content: pending})
+		}
+	}()
+
+	return ch
+}
+
+// indexStop returns the position of the earliest stop sequence in s, or -1.
+func indexStop(s string, stops []string) int {
+	first := -1
+	for _, stop := range stops {
+		if stop == "" {
+			continue
+		}
+		if i := strings.Index(s, stop); i >= 0 && (first < 0 || i < first) {
+			first = i
+		}
+	}
+	return first
+}
+
+// partialStop returns the length of the longest suffix of s that is a
+// proper prefix of a stop sequence: text that must wait for more output.
+func partialStop(s string, stops []string) int {
+	longest := 0
+	for _, stop := range stops {
+		for n := min(len(stop)-1, len(s)); n > longest; n-- {
+			if strings.HasSuffix(s, stop[:n]) {
+				longest = n
+				break
+			}
+		}
+	}
+	return longest
+}
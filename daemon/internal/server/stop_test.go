@@ -0,0 +1,79 @@
+package server
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"plugmyai/internal/provider"
+)
+
+func TestApplyStop(t *testing.T) {
+	usage := &provider.Usage{PromptTokens: 5, CompletionTokens: 7, TotalTokens: 12}
+	trace := &provider.ToolTrace{Tool: "search"}
+	tests := []struct {
+		name  string
+		in    []provider.ChatCompletionChunk
+		stops []string
+		want  []provider.ChatCompletionChunk
+	}{
+		{
+			name: "no match",
+			in: []provider.ChatCompletionChunk{
+				{Content: "Hello"},
+				{Done: true, FinishReason: "length", Usage: usage},
+			},
+			stops: []string{"END"},
+			want: []provider.ChatCompletionChunk{
+				{Content: "Hello"},
+				{Done: true, FinishReason: "length", Usage: usage},
+			},
+		},
+		{
+			name: "split across chunks",
+			in: []provider.ChatCompletionChunk{
+				{Content: "one E"},
+				{Content: "ND two"},
+				{Done: true, FinishReason: "stop", Usage: usage},
+			},
+			stops: []string{"END"},
+			want: []provider.ChatCompletionChunk{
+				{Content: "one "},
+				{Done: true, FinishReason: "stop", Usage: usage},
+			},
+		},
+		{
+			// The matching chunk's usage, reasoning and tool calls survive
+			name: "match on the Done chunk",
+			in: []provider.ChatCompletionChunk{
+				{Content: "one "},
+				{Content: "END", Reasoning: "why", Trace: trace, Done: true, FinishReason: "tool_calls", Usage: usage,
+					ToolCalls: []provider.ToolCall{{ID: "call_1", Type: "function"}}},
+			},
+			stops: []string{"END"},
+			want: []provider.ChatCompletionChunk{
+				{Content: "one "},
+				{Reasoning: "why", Trace: trace},
+				{Done: true, FinishReason: "stop", Usage: usage, ToolCalls: []provider.ToolCall{{ID: "call_1", Type: "function"}}},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stream := make(chan provider.ChatCompletionChunk, len(tt.in))
+			for _, c := range tt.in {
+				stream <- c
+			}
+			close(stream)
+
+			var got []provider.ChatCompletionChunk
+			for c := range applyStop(context.Background(), stream, tt.stops, func() {}) {
+				got = append(got, c)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v\nwant %+v", got, tt.want)
+			}
+		})
+	}
+}
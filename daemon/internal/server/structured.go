@@ -0,0 +1,218 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"plugmyai/internal/jsonschema"
+	"plugmyai/internal/provider"
+)
+
+// wantsJSON reports whether req asks for JSON mode or a JSON Schema.
+func wantsJSON(req *provider.ChatCompletionRequest) bool {
+	rf := req.ResponseFormat
+	return rf != nil && (rf.Type == "json_object" || rf.Type == "json_schema")
+}
+
+// runStructured honours response_format for any provider. Providers that
+// support it natively get it passed through; the others are told the format
+// in a system message. Either way the answer is buffered and checked: it
+// must be JSON (an object, for json_object) that validates against the
+// schema. An answer that doesn't is sent back to the model with the
+// problems, up to structured_output_retries times, before the request fails
+// with a 422 listing them. The first attempt starts before returning, so
+// its errors reach the client with their HTTP status.
+func (s *Server) runStructured(ctx context.Context, p provider.Provider, req *provider.ChatCompletionRequest) (<-chan provider.ChatCompletionChunk, error) {
+	rf := req.ResponseFormat
+	var schema *jsonschema.Schema
+	if rf.Type == "json_schema" {
+		if rf.JSONSchema == nil || len(rf.JSONSchema.Schema) == 0 {
+			return nil, &provider.StatusError{Status: http.StatusBadRequest, Message: "response_format json_schema needs json_schema.schema"}
+		}
+		var err error
+		if schema, err = jsonschema.Compile(rf.JSONSchema.Schema); err != nil {
+			return nil, &provider.StatusError{Status: http.StatusBadRequest, Message: "invalid json_schema: " + err.Error()}
+		}
+	}
+
+	messages := append([]provider.Message(nil), req.Messages...)
+	if !provider.Supports(p, provider.ParamResponseFormat) {
+		messages = append(messages, provider.Message{Role: "system", Content: formatInstructions(rf)})
+	}
+
+	turn := *req
+	turn.Messages = messages
+	stream, err := s.withLimits(ctx, p, &turn)
+	if err != nil {
+		return nil, err
+	}
+
+	attempts := 1 + s.cfg.StructuredRetries()
+	ch := make(chan provider.ChatCompletionChunk, 32)
+
+	go func() {
+		defer close(ch)
+
+		send := func(chunk provider.ChatCompletionChunk) bool {
+			select {
+			case ch <- chunk:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		}
+
+		var usage *provider.Usage
+		for attempt := 1; ; attempt++ {
+			var content strings.Builder
+			var done provider.ChatCompletionChunk
+			for chunk := range stream {
+				switch {
+				case chunk.Error != nil:
+					send(chunk)
+					for range stream {
+					}
+					return
+				case chunk.Trace != nil:
+					if !send(chunk) {
+						return
+					}
+				case chunk.Reasoning != "":
+					if !send(provider.ChatCompletionChunk{Reasoning: chunk.Reasoning}) {
+						return
+					}
+				}
+				content.WriteString(chunk.Content)
+				if chunk.Done && !done.Done {
+					done = chunk
+				}
+			}
+			usage = addUsage(usage, done.Usage)
+
+			out, problems := checkStructured(content.String(), rf.Type, schema)
+			if problems == nil {
+				if !send(provider.ChatCompletionChunk{Content: out}) {
+					return
+				}
+				send(provider.ChatCompletionChunk{Done: true, FinishReason: done.FinishReason, Usage: usage})
+				return
+			}
+			if attempt >= attempts {
+				send(provider.ChatCompletionChunk{Error: structuredError(content.String(), problems, attempt)})
+				return
+			}
+
+			// Show the model what was wrong and ask again
+			messages = append(messages,
+				provider.Message{Role: "assistant", Content: content.String()},
+				provider.Message{Role: "user", Content: repairPrompt(problems)},
+			)
+			turn.Messages = messages
+			if stream, err = s.withLimits(ctx, p, &turn); err != nil {
+				send(provider.ChatCompletionChunk{Error: err})
+				return
+			}
+		}
+	}()
+
+	return ch, nil
+}
+
+// formatInstructions tells a model without native JSON mode what to answer.
+func formatInstructions(rf *provider.ResponseFormat) string {
+	if rf.Type == "json_object" {
+		return "Respond with a single JSON object and nothing else: no prose, no Markdown code fences."
+	}
+
+	var b strings.Builder
+	b.WriteString("Respond with a single JSON value and nothing else: no prose, no Markdown code fences. ")
+	b.WriteString("It must conform to this JSON Schema")
+	if rf.JSONSchema.Name != "" {
+		fmt.Fprintf(&b, " (%q", rf.JSONSchema.Name)
+		if rf.JSONSchema.Description != "" {
+			b.WriteString(": " + rf.JSONSchema.Description)
+		}
+		b.WriteString(")")
+	}
+	b.WriteString(":\n")
+	b.Write(rf.JSONSchema.Schema)
+	return b.String()
+}
+
+func repairPrompt(problems []jsonschema.Problem) string {
+	var b strings.Builder
+	b.WriteString("Your response was not valid:\n")
+	for _, p := range problems {
+		b.WriteString("- " + p.String() + "\n")
+	}
+	b.WriteString("Respond again with only the corrected JSON.")
+	return b.String()
+}
+
+// checkStructured extracts the JSON from a model's answer and checks it,
+// returning the JSON alone or what is wrong with it.
+func checkStructured(content, formatType string, schema *jsonschema.Schema) (string, []jsonschema.Problem) {
+	out := extractJSON(content)
+	var v any
+	if err := json.Unmarshal([]byte(out), &v); err != nil {
+		return "", []jsonschema.Problem{{Message: "not valid JSON: " + err.Error()}}
+	}
+	if formatType == "json_object" {
+		if _, ok := v.(map[string]any); !ok {
+			return "", []jsonschema.Problem{{Message: "expected a JSON object"}}
+		}
+		return out, nil
+	}
+	if err := schema.Validate(v); err != nil {
+		return "", err.(*jsonschema.Error).Problems
+	}
+	return out, nil
+}
+
+// extractJSON strips what models commonly wrap JSON in: whitespace, Markdown
+// code fences, and prose before or after the value.
+func extractJSON(content string) string {
+	s := strings.TrimSpace(content)
+	if strings.HasPrefix(s, "```") {
+		if nl := strings.IndexByte(s, '\n'); nl >= 0 {
+			s = s[nl+1:]
+		}
+		s = strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(s), "```"))
+	}
+	if json.Valid([]byte(s)) {
+		return s
+	}
+
+	// Fall back to the outermost object or array
+	start := strings.IndexAny(s, "{[")
+	if start < 0 {
+		return s
+	}
+	closer := "}"
+	if s[start] == '[' {
+		closer = "]"
+	}
+	if end := strings.LastIndex(s, closer); end > start {
+		return s[start : end+1]
+	}
+	return s
+}
+
+// structuredError is the 422 returned when no attempt validated. Its body
+// carries the problems and the last output alongside the usual message.
+func structuredError(output string, problems []jsonschema.Problem, attempts int) error {
+	msg := fmt.Sprintf("response did not match response_format after %d attempt(s): %s", attempts, (&jsonschema.Error{Problems: problems}).Error())
+	body, _ := json.Marshal(map[string]any{
+		"error": map[string]any{
+			"message":           msg,
+			"type":              "invalid_response_error",
+			"code":              "response_format_validation_failed",
+			"validation_errors": problems,
+			"output":            output,
+		},
+	})
+	return &provider.StatusError{Status: http.StatusUnprocessableEntity, Message: msg, Body: body}
+}
@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"path/filepath"
+	"strings"
 	"time"
 
 	_ "modernc.org/sqlite"
@@ -23,6 +24,22 @@ type App struct {
 	CreatedAt time.Time `json:"created_at"`
 	Revoked   bool      `json:"revoked"`
 	Providers []string  `json:"providers"` // allowed provider IDs; empty = unrestricted
+	Workspace string    `json:"workspace"` // agent working directory; empty = per-app default
+
+	Sandbox        string `json:"sandbox"`         // sandbox runner name (e.g. "bwrap"); empty = none
+	SandboxNetwork bool   `json:"sandbox_network"` // allow network inside the sandbox
+
+	Tools *ToolPolicy `json:"tools"` // per-tool policy; nil = derived from scope
+
+	RequireApproval bool `json:"require_approval"` // ask the user before write/exec tool calls
+
+	MCPServers []string `json:"mcp_servers"` // granted MCP server names (from config)
+}
+
+// ToolPolicy lists agent tools an app may or may not use (Claude Code tool names).
+type ToolPolicy struct {
+	Allow []string `json:"allow"`
+	Deny  []string `json:"deny"`
 }
 
 type HistoryEntry struct {
@@ -35,27 +52,106 @@ type HistoryEntry struct {
 	Response     json.RawMessage `json:"response"`
 	TokensIn     int             `json:"tokens_in"`
 	TokensOut    int             `json:"tokens_out"`
+	Estimated    bool            `json:"estimated"`               // tokens counted by the daemon, not reported by the provider
+	FinishReason string          `json:"finish_reason,omitempty"` // "stop", "length", "content_filter", "tool_calls"
 	DurationMS   int64           `json:"duration_ms"`
 	Status       string          `json:"status"` // "success", "error"
 	ErrorMessage string          `json:"error_message,omitempty"`
+	BatchID      string          `json:"batch_id,omitempty"` // the batch the request was part of
 	CreatedAt    time.Time       `json:"created_at"`
 }
 
+// Job is a chat completion run in the background (background: true).
+type Job struct {
+	ID           string          `json:"id"`
+	AppID        string          `json:"app_id"`
+	AppName      string          `json:"app_name"`
+	Model        string          `json:"model"`
+	Provider     string          `json:"provider"`
+	Status       string          `json:"status"`           // "in_progress", "completed", "failed", "cancelled"
+	Result       json.RawMessage `json:"result,omitempty"` // the chat.completion, once completed
+	ErrorMessage string          `json:"error_message,omitempty"`
+	LastEventID  int             `json:"last_event_id"` // seq of the latest stored event
+	CreatedAt    time.Time       `json:"created_at"`
+	CompletedAt  *time.Time      `json:"completed_at,omitempty"`
+}
+
+// JobEvent is one server-sent event of a job's output, numbered from 1.
+type JobEvent struct {
+	Seq  int    `json:"seq"`
+	Name string `json:"name,omitempty"` // SSE event name; empty for data-only events
+	Data string `json:"data"`
+}
+
+// File is an uploaded or generated file; its contents live on disk.
+type File struct {
+	ID        string    `json:"id"`
+	AppID     string    `json:"app_id"`
+	Filename  string    `json:"filename"`
+	Purpose   string    `json:"purpose"` // "batch", "batch_output"
+	Bytes     int64     `json:"bytes"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Batch is a set of requests from an input file, run in the background.
+type Batch struct {
+	ID               string
+	AppID            string
+	AppName          string
+	InputFileID      string
+	Endpoint         string
+	CompletionWindow string
+	Status           string // "failed", "in_progress", "finalizing", "completed", "expired", "cancelling", "cancelled"
+	OutputFileID     string
+	ErrorFileID      string
+	Errors           json.RawMessage // input validation errors, if it failed
+	Metadata         json.RawMessage
+	Total            int
+	Completed        int
+	Failed           int
+	CreatedAt        time.Time
+	ExpiresAt        time.Time
+
+	// When the batch entered each status; nil if it hasn't
+	InProgressAt *time.Time
+	FinalizingAt *time.Time
+	CompletedAt  *time.Time
+	FailedAt     *time.Time
+	ExpiredAt    *time.Time
+	CancellingAt *time.Time
+	CancelledAt  *time.Time
+}
+
+// BatchItem is one request of a batch, and its outcome once run.
+type BatchItem struct {
+	Line       int // position in the input file, from 0
+	CustomID   string
+	Body       json.RawMessage
+	Status     string // "pending", "completed", "failed"
+	StatusCode int
+	RequestID  string // history entry of the request
+	Response   json.RawMessage
+}
+
 type ConnectRequest struct {
-	ID             string    `json:"id"`
-	AppName        string    `json:"app_name"`
-	AppURL         string    `json:"app_url"`
-	AppIcon        string    `json:"app_icon,omitempty"`
-	RequestedScope string    `json:"requested_scope"` // "chat" or "full"
-	Status         string    `json:"status"`          // "pending", "approved", "denied"
-	Token          string    `json:"token,omitempty"`
-	CreatedAt      time.Time `json:"created_at"`
-	ExpiresAt      time.Time `json:"expires_at"`
+	ID             string      `json:"id"`
+	AppName        string      `json:"app_name"`
+	AppURL         string      `json:"app_url"`
+	AppIcon        string      `json:"app_icon,omitempty"`
+	RequestedScope string      `json:"requested_scope"` // "chat" or "full"
+	RequestedTools *ToolPolicy `json:"requested_tools,omitempty"`
+	RequestedMCP   []string    `json:"requested_mcp_servers,omitempty"`
+	Status         string      `json:"status"` // "pending", "approved", "denied"
+	Token          string      `json:"token,omitempty"`
+	CreatedAt      time.Time   `json:"created_at"`
+	ExpiresAt      time.Time   `json:"expires_at"`
 }
 
 func New(dataDir string) (*Store, error) {
+	// Writers wait for each other instead of failing with SQLITE_BUSY; as
+	// a DSN pragma it applies to every pooled connection
 	dbPath := filepath.Join(dataDir, "data.db")
-	db, err := sql.Open("sqlite", dbPath)
+	db, err := sql.Open("sqlite", dbPath+"?_pragma=busy_timeout(5000)")
 	if err != nil {
 		return nil, fmt.Errorf("opening database: %w", err)
 	}
@@ -123,6 +219,77 @@ func (s *Store) migrate() error {
 			PRIMARY KEY (app_id, provider_id),
 			FOREIGN KEY (app_id) REFERENCES apps(id)
 		)`,
+		`CREATE TABLE IF NOT EXISTS app_mcp_servers (
+			app_id TEXT NOT NULL,
+			server_name TEXT NOT NULL,
+			PRIMARY KEY (app_id, server_name),
+			FOREIGN KEY (app_id) REFERENCES apps(id)
+		)`,
+		`CREATE TABLE IF NOT EXISTS jobs (
+			id TEXT PRIMARY KEY,
+			app_id TEXT NOT NULL,
+			app_name TEXT NOT NULL,
+			model TEXT NOT NULL DEFAULT '',
+			provider TEXT NOT NULL DEFAULT '',
+			status TEXT NOT NULL DEFAULT 'in_progress',
+			result TEXT NOT NULL DEFAULT '',
+			error_message TEXT NOT NULL DEFAULT '',
+			created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+			completed_at DATETIME
+		)`,
+		`CREATE TABLE IF NOT EXISTS job_events (
+			job_id TEXT NOT NULL,
+			seq INTEGER NOT NULL,
+			name TEXT NOT NULL DEFAULT '',
+			data TEXT NOT NULL,
+			PRIMARY KEY (job_id, seq),
+			FOREIGN KEY (job_id) REFERENCES jobs(id)
+		)`,
+		`CREATE TABLE IF NOT EXISTS files (
+			id TEXT PRIMARY KEY,
+			app_id TEXT NOT NULL,
+			filename TEXT NOT NULL DEFAULT '',
+			purpose TEXT NOT NULL,
+			bytes INTEGER NOT NULL DEFAULT 0,
+			created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+		)`,
+		`CREATE TABLE IF NOT EXISTS batches (
+			id TEXT PRIMARY KEY,
+			app_id TEXT NOT NULL,
+			app_name TEXT NOT NULL,
+			input_file_id TEXT NOT NULL,
+			endpoint TEXT NOT NULL,
+			completion_window TEXT NOT NULL,
+			status TEXT NOT NULL,
+			output_file_id TEXT NOT NULL DEFAULT '',
+			error_file_id TEXT NOT NULL DEFAULT '',
+			errors TEXT NOT NULL DEFAULT '',
+			metadata TEXT NOT NULL DEFAULT '',
+			total INTEGER NOT NULL DEFAULT 0,
+			completed INTEGER NOT NULL DEFAULT 0,
+			failed INTEGER NOT NULL DEFAULT 0,
+			created_at DATETIME NOT NULL,
+			expires_at DATETIME NOT NULL,
+			in_progress_at DATETIME,
+			finalizing_at DATETIME,
+			completed_at DATETIME,
+			failed_at DATETIME,
+			expired_at DATETIME,
+			cancelling_at DATETIME,
+			cancelled_at DATETIME
+		)`,
+		`CREATE TABLE IF NOT EXISTS batch_items (
+			batch_id TEXT NOT NULL,
+			line INTEGER NOT NULL,
+			custom_id TEXT NOT NULL,
+			body TEXT NOT NULL,
+			status TEXT NOT NULL DEFAULT 'pending',
+			status_code INTEGER NOT NULL DEFAULT 0,
+			request_id TEXT NOT NULL DEFAULT '',
+			response TEXT NOT NULL DEFAULT '',
+			PRIMARY KEY (batch_id, line),
+			FOREIGN KEY (batch_id) REFERENCES batches(id)
+		)`,
 	}
 
 	for _, m := range migrations {
@@ -130,9 +297,54 @@ func (s *Store) migrate() error {
 			return fmt.Errorf("executing migration: %w", err)
 		}
 	}
+
+	// Columns added after the initial schema.
+	columns := []struct{ table, column, def string }{
+		{"apps", "workspace", "TEXT NOT NULL DEFAULT ''"},
+		{"apps", "sandbox", "TEXT NOT NULL DEFAULT ''"},
+		{"apps", "sandbox_network", "INTEGER NOT NULL DEFAULT 1"},
+		{"apps", "tool_policy", "TEXT NOT NULL DEFAULT ''"},
+		{"apps", "require_approval", "INTEGER NOT NULL DEFAULT 0"},
+		{"connect_requests", "requested_tools", "TEXT NOT NULL DEFAULT ''"},
+		{"connect_requests", "requested_mcp_servers", "TEXT NOT NULL DEFAULT ''"},
+		{"history", "tokens_estimated", "INTEGER NOT NULL DEFAULT 0"},
+		{"history", "finish_reason", "TEXT NOT NULL DEFAULT ''"},
+		{"history", "batch_id", "TEXT NOT NULL DEFAULT ''"},
+	}
+	for _, c := range columns {
+		if err := s.addColumn(c.table, c.column, c.def); err != nil {
+			return fmt.Errorf("adding column %s.%s: %w", c.table, c.column, err)
+		}
+	}
 	return nil
 }
 
+// addColumn adds a column to an existing table unless it is already present.
+// SQLite has no ADD COLUMN IF NOT EXISTS, so table_info is checked first.
+func (s *Store) addColumn(table, column, def string) error {
+	rows, err := s.db.Query("SELECT name FROM pragma_table_info(?)", table)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return err
+		}
+		if name == column {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	_, err = s.db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, def))
+	return err
+}
+
 // --- Apps ---
 
 func (s *Store) CreateApp(id, name, url, scope, token string) error {
@@ -146,28 +358,81 @@ func (s *Store) CreateApp(id, name, url, scope, token string) error {
 	return err
 }
 
-func (s *Store) GetAppByToken(token string) (*App, error) {
+const appColumns = "id, name, url, scope, token, created_at, revoked, workspace, sandbox, sandbox_network, tool_policy, require_approval"
+
+// rowScanner is satisfied by both *sql.Row and *sql.Rows.
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+func scanApp(row rowScanner) (*App, error) {
 	var a App
-	err := s.db.QueryRow(
-		"SELECT id, name, url, scope, token, created_at, revoked FROM apps WHERE token = ? AND revoked = 0",
+	var tools string
+	if err := row.Scan(&a.ID, &a.Name, &a.URL, &a.Scope, &a.Token, &a.CreatedAt, &a.Revoked, &a.Workspace, &a.Sandbox, &a.SandboxNetwork, &tools, &a.RequireApproval); err != nil {
+		return nil, err
+	}
+	var err error
+	if a.Tools, err = decodeToolPolicy(tools); err != nil {
+		return nil, err
+	}
+	return &a, nil
+}
+
+// encodeToolPolicy stores a nil policy as the empty string.
+func encodeToolPolicy(tp *ToolPolicy) (string, error) {
+	if tp == nil {
+		return "", nil
+	}
+	data, err := json.Marshal(tp)
+	return string(data), err
+}
+
+func decodeToolPolicy(s string) (*ToolPolicy, error) {
+	if s == "" {
+		return nil, nil
+	}
+	var tp ToolPolicy
+	if err := json.Unmarshal([]byte(s), &tp); err != nil {
+		return nil, fmt.Errorf("decoding tool policy: %w", err)
+	}
+	return &tp, nil
+}
+
+func (s *Store) GetAppByToken(token string) (*App, error) {
+	a, err := scanApp(s.db.QueryRow(
+		"SELECT "+appColumns+" FROM apps WHERE token = ? AND revoked = 0",
 		token,
-	).Scan(&a.ID, &a.Name, &a.URL, &a.Scope, &a.Token, &a.CreatedAt, &a.Revoked)
+	))
 	if err == sql.ErrNoRows {
 		return nil, nil
 	}
 	if err != nil {
 		return nil, err
 	}
-	a.Providers, err = s.GetAppProviders(a.ID)
+	if err := s.loadAppGrants(a); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// GetApp returns the app with the given ID (revoked or not), or nil if not found.
+func (s *Store) GetApp(id string) (*App, error) {
+	a, err := scanApp(s.db.QueryRow("SELECT "+appColumns+" FROM apps WHERE id = ?", id))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
 	if err != nil {
 		return nil, err
 	}
-	return &a, nil
+	if err := s.loadAppGrants(a); err != nil {
+		return nil, err
+	}
+	return a, nil
 }
 
 func (s *Store) ListApps() ([]App, error) {
 	rows, err := s.db.Query(
-		"SELECT id, name, url, scope, token, created_at, revoked FROM apps ORDER BY created_at DESC",
+		"SELECT " + appColumns + " FROM apps ORDER BY created_at DESC",
 	)
 	if err != nil {
 		return nil, err
@@ -176,16 +441,14 @@ func (s *Store) ListApps() ([]App, error) {
 
 	var apps []App
 	for rows.Next() {
-		var a App
-		if err := rows.Scan(&a.ID, &a.Name, &a.URL, &a.Scope, &a.Token, &a.CreatedAt, &a.Revoked); err != nil {
+		a, err := scanApp(rows)
+		if err != nil {
 			return nil, err
 		}
-		providers, err := s.GetAppProviders(a.ID)
-		if err != nil {
+		if err := s.loadAppGrants(a); err != nil {
 			return nil, err
 		}
-		a.Providers = providers
-		apps = append(apps, a)
+		apps = append(apps, *a)
 	}
 	return apps, rows.Err()
 }
@@ -195,6 +458,36 @@ func (s *Store) RevokeApp(id string) error {
 	return err
 }
 
+// SetAppWorkspace sets the directory agent CLIs run in for this app.
+// An empty string restores the per-app default under the data directory.
+func (s *Store) SetAppWorkspace(id, workspace string) error {
+	_, err := s.db.Exec("UPDATE apps SET workspace = ? WHERE id = ?", workspace, id)
+	return err
+}
+
+// SetAppTools sets the app's tool policy. A nil policy falls back to the app's scope.
+func (s *Store) SetAppTools(id string, tp *ToolPolicy) error {
+	tools, err := encodeToolPolicy(tp)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Exec("UPDATE apps SET tool_policy = ? WHERE id = ?", tools, id)
+	return err
+}
+
+// SetAppRequireApproval turns human approval of agent tool calls on or off.
+func (s *Store) SetAppRequireApproval(id string, require bool) error {
+	_, err := s.db.Exec("UPDATE apps SET require_approval = ? WHERE id = ?", require, id)
+	return err
+}
+
+// SetAppSandbox sets the sandbox runner for this app's agent CLIs.
+// An empty runner disables sandboxing.
+func (s *Store) SetAppSandbox(id, runner string, network bool) error {
+	_, err := s.db.Exec("UPDATE apps SET sandbox = ?, sandbox_network = ? WHERE id = ?", runner, network, id)
+	return err
+}
+
 // SetAppProviders replaces the allowed providers for an app.
 // An empty slice means unrestricted access.
 func (s *Store) SetAppProviders(appID string, providerIDs []string) error {
@@ -215,6 +508,54 @@ func (s *Store) SetAppProviders(appID string, providerIDs []string) error {
 	return tx.Commit()
 }
 
+// loadAppGrants fills in the app's provider and MCP server grants.
+func (s *Store) loadAppGrants(a *App) error {
+	var err error
+	if a.Providers, err = s.GetAppProviders(a.ID); err != nil {
+		return err
+	}
+	a.MCPServers, err = s.GetAppMCPServers(a.ID)
+	return err
+}
+
+// SetAppMCPServers replaces the MCP servers granted to an app.
+func (s *Store) SetAppMCPServers(appID string, names []string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM app_mcp_servers WHERE app_id = ?", appID); err != nil {
+		return err
+	}
+	for _, name := range names {
+		if _, err := tx.Exec("INSERT INTO app_mcp_servers (app_id, server_name) VALUES (?, ?)", appID, name); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// GetAppMCPServers returns the names of the MCP servers granted to an app.
+func (s *Store) GetAppMCPServers(appID string) ([]string, error) {
+	rows, err := s.db.Query("SELECT server_name FROM app_mcp_servers WHERE app_id = ? ORDER BY server_name", appID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var names []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+	}
+	return names, rows.Err()
+}
+
 // GetAppProviders returns the allowed provider IDs for an app.
 // An empty slice means unrestricted.
 func (s *Store) GetAppProviders(appID string) ([]string, error) {
@@ -239,19 +580,19 @@ func (s *Store) GetAppProviders(appID string) ([]string, error) {
 
 func (s *Store) LogRequest(entry *HistoryEntry) error {
 	_, err := s.db.Exec(
-		`INSERT INTO history (id, app_id, app_name, model, provider, messages, response, tokens_in, tokens_out, duration_ms, status, error_message)
-		 VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		`INSERT INTO history (id, app_id, app_name, model, provider, messages, response, tokens_in, tokens_out, tokens_estimated, duration_ms, status, error_message, finish_reason, batch_id)
+		 VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
 		entry.ID, entry.AppID, entry.AppName, entry.Model, entry.Provider,
 		string(entry.Messages), string(entry.Response),
-		entry.TokensIn, entry.TokensOut, entry.DurationMS,
-		entry.Status, entry.ErrorMessage,
+		entry.TokensIn, entry.TokensOut, entry.Estimated, entry.DurationMS,
+		entry.Status, entry.ErrorMessage, entry.FinishReason, entry.BatchID,
 	)
 	return err
 }
 
 func (s *Store) ListHistory(limit, offset int) ([]HistoryEntry, error) {
 	rows, err := s.db.Query(
-		`SELECT id, app_id, app_name, model, provider, messages, response, tokens_in, tokens_out, duration_ms, status, error_message, created_at
+		`SELECT id, app_id, app_name, model, provider, messages, response, tokens_in, tokens_out, tokens_estimated, duration_ms, status, error_message, finish_reason, batch_id, created_at
 		 FROM history ORDER BY created_at DESC LIMIT ? OFFSET ?`,
 		limit, offset,
 	)
@@ -264,7 +605,7 @@ func (s *Store) ListHistory(limit, offset int) ([]HistoryEntry, error) {
 	for rows.Next() {
 		var e HistoryEntry
 		var msgs, resp string
-		if err := rows.Scan(&e.ID, &e.AppID, &e.AppName, &e.Model, &e.Provider, &msgs, &resp, &e.TokensIn, &e.TokensOut, &e.DurationMS, &e.Status, &e.ErrorMessage, &e.CreatedAt); err != nil {
+		if err := rows.Scan(&e.ID, &e.AppID, &e.AppName, &e.Model, &e.Provider, &msgs, &resp, &e.TokensIn, &e.TokensOut, &e.Estimated, &e.DurationMS, &e.Status, &e.ErrorMessage, &e.FinishReason, &e.BatchID, &e.CreatedAt); err != nil {
 			return nil, err
 		}
 		e.Messages = json.RawMessage(msgs)
@@ -278,9 +619,9 @@ func (s *Store) GetHistoryEntry(id string) (*HistoryEntry, error) {
 	var e HistoryEntry
 	var msgs, resp string
 	err := s.db.QueryRow(
-		`SELECT id, app_id, app_name, model, provider, messages, response, tokens_in, tokens_out, duration_ms, status, error_message, created_at
+		`SELECT id, app_id, app_name, model, provider, messages, response, tokens_in, tokens_out, tokens_estimated, duration_ms, status, error_message, finish_reason, batch_id, created_at
 		 FROM history WHERE id = ?`, id,
-	).Scan(&e.ID, &e.AppID, &e.AppName, &e.Model, &e.Provider, &msgs, &resp, &e.TokensIn, &e.TokensOut, &e.DurationMS, &e.Status, &e.ErrorMessage, &e.CreatedAt)
+	).Scan(&e.ID, &e.AppID, &e.AppName, &e.Model, &e.Provider, &msgs, &resp, &e.TokensIn, &e.TokensOut, &e.Estimated, &e.DurationMS, &e.Status, &e.ErrorMessage, &e.FinishReason, &e.BatchID, &e.CreatedAt)
 	if err == sql.ErrNoRows {
 		return nil, nil
 	}
@@ -294,6 +635,8 @@ type HistoryFilter struct {
 	Limit   int
 	Offset  int
 	AppName string // SQL LIKE %value%
+	AppID   string // exact match; empty = all apps
+	BatchID string // exact match; empty = all requests
 	SortBy  string // "recent" (default) or "tokens"
 }
 
@@ -304,12 +647,24 @@ func (s *Store) ListHistoryFiltered(f HistoryFilter) ([]HistoryEntry, int, error
 		f.Limit = 20
 	}
 
-	where := ""
+	var conds []string
 	var args []any
 	if f.AppName != "" {
-		where = " WHERE app_name LIKE ?"
+		conds = append(conds, "app_name LIKE ?")
 		args = append(args, "%"+f.AppName+"%")
 	}
+	if f.AppID != "" {
+		conds = append(conds, "app_id = ?")
+		args = append(args, f.AppID)
+	}
+	if f.BatchID != "" {
+		conds = append(conds, "batch_id = ?")
+		args = append(args, f.BatchID)
+	}
+	where := ""
+	if len(conds) > 0 {
+		where = " WHERE " + strings.Join(conds, " AND ")
+	}
 
 	// Count total matching rows
 	var total int
@@ -323,7 +678,7 @@ func (s *Store) ListHistoryFiltered(f HistoryFilter) ([]HistoryEntry, int, error
 		orderBy = " ORDER BY (tokens_in + tokens_out) DESC"
 	}
 
-	query := `SELECT id, app_id, app_name, model, provider, messages, response, tokens_in, tokens_out, duration_ms, status, error_message, created_at
+	query := `SELECT id, app_id, app_name, model, provider, messages, response, tokens_in, tokens_out, tokens_estimated, duration_ms, status, error_message, finish_reason, batch_id, created_at
 		 FROM history` + where + orderBy + " LIMIT ? OFFSET ?"
 	queryArgs := append(args, f.Limit, f.Offset)
 
@@ -337,7 +692,7 @@ func (s *Store) ListHistoryFiltered(f HistoryFilter) ([]HistoryEntry, int, error
 	for rows.Next() {
 		var e HistoryEntry
 		var msgs, resp string
-		if err := rows.Scan(&e.ID, &e.AppID, &e.AppName, &e.Model, &e.Provider, &msgs, &resp, &e.TokensIn, &e.TokensOut, &e.DurationMS, &e.Status, &e.ErrorMessage, &e.CreatedAt); err != nil {
+		if err := rows.Scan(&e.ID, &e.AppID, &e.AppName, &e.Model, &e.Provider, &msgs, &resp, &e.TokensIn, &e.TokensOut, &e.Estimated, &e.DurationMS, &e.Status, &e.ErrorMessage, &e.FinishReason, &e.BatchID, &e.CreatedAt); err != nil {
 			return nil, 0, err
 		}
 		e.Messages = json.RawMessage(msgs)
@@ -353,29 +708,425 @@ func (s *Store) DeleteAllHistory() error {
 	return err
 }
 
+// --- Jobs ---
+
+func (s *Store) CreateJob(j *Job) error {
+	_, err := s.db.Exec(
+		"INSERT INTO jobs (id, app_id, app_name, model, provider, status) VALUES (?, ?, ?, ?, ?, 'in_progress')",
+		j.ID, j.AppID, j.AppName, j.Model, j.Provider,
+	)
+	return err
+}
+
+// GetJob returns the job with the given ID, or nil if not found.
+func (s *Store) GetJob(id string) (*Job, error) {
+	var j Job
+	var result string
+	var completedAt sql.NullTime
+	err := s.db.QueryRow(
+		`SELECT id, app_id, app_name, model, provider, status, result, error_message, created_at, completed_at,
+			(SELECT COALESCE(MAX(seq), 0) FROM job_events WHERE job_id = jobs.id)
+		 FROM jobs WHERE id = ?`, id,
+	).Scan(&j.ID, &j.AppID, &j.AppName, &j.Model, &j.Provider, &j.Status, &result, &j.ErrorMessage, &j.CreatedAt, &completedAt, &j.LastEventID)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if result != "" {
+		j.Result = json.RawMessage(result)
+	}
+	if completedAt.Valid {
+		j.CompletedAt = &completedAt.Time
+	}
+	return &j, nil
+}
+
+// AddJobEvents stores a job's events.
+func (s *Store) AddJobEvents(jobID string, events []JobEvent) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, e := range events {
+		if _, err := tx.Exec("INSERT INTO job_events (job_id, seq, name, data) VALUES (?, ?, ?, ?)", jobID, e.Seq, e.Name, e.Data); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// ListJobEvents returns a job's events after seq, in order.
+func (s *Store) ListJobEvents(jobID string, after int) ([]JobEvent, error) {
+	rows, err := s.db.Query("SELECT seq, name, data FROM job_events WHERE job_id = ? AND seq > ? ORDER BY seq", jobID, after)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var events []JobEvent
+	for rows.Next() {
+		var e JobEvent
+		if err := rows.Scan(&e.Seq, &e.Name, &e.Data); err != nil {
+			return nil, err
+		}
+		events = append(events, e)
+	}
+	return events, rows.Err()
+}
+
+// FinishJob records a job's final status, and its result or error.
+func (s *Store) FinishJob(id, status string, result json.RawMessage, errMsg string) error {
+	_, err := s.db.Exec(
+		"UPDATE jobs SET status = ?, result = ?, error_message = ?, completed_at = ? WHERE id = ?",
+		status, string(result), errMsg, time.Now().UTC(), id,
+	)
+	return err
+}
+
+// FailRunningJobs marks jobs still in progress as failed, ending each with
+// a last event of the given data. It returns how many there were.
+func (s *Store) FailRunningJobs(errMsg, eventData string) (int, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(
+		`INSERT INTO job_events (job_id, seq, name, data)
+		 SELECT id, (SELECT COALESCE(MAX(seq), 0) + 1 FROM job_events WHERE job_id = jobs.id), '', ?
+		 FROM jobs WHERE status = 'in_progress'`, eventData,
+	); err != nil {
+		return 0, err
+	}
+	res, err := tx.Exec(
+		"UPDATE jobs SET status = 'failed', error_message = ?, completed_at = ? WHERE status = 'in_progress'",
+		errMsg, time.Now().UTC(),
+	)
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	return int(n), tx.Commit()
+}
+
+// --- Files ---
+
+func (s *Store) CreateFile(f *File) error {
+	_, err := s.db.Exec(
+		"INSERT INTO files (id, app_id, filename, purpose, bytes, created_at) VALUES (?, ?, ?, ?, ?, ?)",
+		f.ID, f.AppID, f.Filename, f.Purpose, f.Bytes, f.CreatedAt,
+	)
+	return err
+}
+
+const fileColumns = "id, app_id, filename, purpose, bytes, created_at"
+
+func scanFile(row rowScanner) (*File, error) {
+	var f File
+	if err := row.Scan(&f.ID, &f.AppID, &f.Filename, &f.Purpose, &f.Bytes, &f.CreatedAt); err != nil {
+		return nil, err
+	}
+	return &f, nil
+}
+
+// GetFile returns the file with the given ID, or nil if not found.
+func (s *Store) GetFile(id string) (*File, error) {
+	f, err := scanFile(s.db.QueryRow("SELECT "+fileColumns+" FROM files WHERE id = ?", id))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return f, err
+}
+
+// ListFiles returns an app's files, newest first; an empty appID lists all.
+func (s *Store) ListFiles(appID string) ([]File, error) {
+	query := "SELECT " + fileColumns + " FROM files"
+	var args []any
+	if appID != "" {
+		query += " WHERE app_id = ?"
+		args = append(args, appID)
+	}
+	rows, err := s.db.Query(query+" ORDER BY created_at DESC", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var files []File
+	for rows.Next() {
+		f, err := scanFile(rows)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, *f)
+	}
+	return files, rows.Err()
+}
+
+func (s *Store) DeleteFile(id string) error {
+	_, err := s.db.Exec("DELETE FROM files WHERE id = ?", id)
+	return err
+}
+
+// --- Batches ---
+
+// CreateBatch stores a batch along with its requests.
+func (s *Store) CreateBatch(b *Batch, items []BatchItem) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(
+		`INSERT INTO batches (id, app_id, app_name, input_file_id, endpoint, completion_window, status, errors, metadata, total, created_at, expires_at, in_progress_at, failed_at)
+		 VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		b.ID, b.AppID, b.AppName, b.InputFileID, b.Endpoint, b.CompletionWindow, b.Status,
+		string(b.Errors), string(b.Metadata), b.Total, b.CreatedAt, b.ExpiresAt, b.InProgressAt, b.FailedAt,
+	); err != nil {
+		return err
+	}
+	for _, it := range items {
+		if _, err := tx.Exec(
+			"INSERT INTO batch_items (batch_id, line, custom_id, body) VALUES (?, ?, ?, ?)",
+			b.ID, it.Line, it.CustomID, string(it.Body),
+		); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+const batchColumns = `id, app_id, app_name, input_file_id, endpoint, completion_window, status, output_file_id, error_file_id, errors, metadata,
+	total, completed, failed, created_at, expires_at, in_progress_at, finalizing_at, completed_at, failed_at, expired_at, cancelling_at, cancelled_at`
+
+func scanBatch(row rowScanner) (*Batch, error) {
+	var b Batch
+	var errs, metadata string
+	var inProgress, finalizing, completed, failed, expired, cancelling, cancelled sql.NullTime
+	if err := row.Scan(&b.ID, &b.AppID, &b.AppName, &b.InputFileID, &b.Endpoint, &b.CompletionWindow, &b.Status, &b.OutputFileID, &b.ErrorFileID, &errs, &metadata,
+		&b.Total, &b.Completed, &b.Failed, &b.CreatedAt, &b.ExpiresAt, &inProgress, &finalizing, &completed, &failed, &expired, &cancelling, &cancelled); err != nil {
+		return nil, err
+	}
+	if errs != "" {
+		b.Errors = json.RawMessage(errs)
+	}
+	if metadata != "" {
+		b.Metadata = json.RawMessage(metadata)
+	}
+	for _, t := range []struct {
+		src sql.NullTime
+		dst **time.Time
+	}{
+		{inProgress, &b.InProgressAt}, {finalizing, &b.FinalizingAt}, {completed, &b.CompletedAt}, {failed, &b.FailedAt},
+		{expired, &b.ExpiredAt}, {cancelling, &b.CancellingAt}, {cancelled, &b.CancelledAt},
+	} {
+		if t.src.Valid {
+			*t.dst = &t.src.Time
+		}
+	}
+	return &b, nil
+}
+
+// GetBatch returns the batch with the given ID, or nil if not found.
+func (s *Store) GetBatch(id string) (*Batch, error) {
+	b, err := scanBatch(s.db.QueryRow("SELECT "+batchColumns+" FROM batches WHERE id = ?", id))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return b, err
+}
+
+// ListBatches returns an app's batches, newest first; an empty appID lists
+// all.
+func (s *Store) ListBatches(appID string, limit int) ([]Batch, error) {
+	return s.queryBatches("WHERE app_id = ? OR ? = '' ORDER BY created_at DESC LIMIT ?", appID, appID, limit)
+}
+
+// ListUnfinishedBatches returns the batches still to be run or finalized.
+func (s *Store) ListUnfinishedBatches() ([]Batch, error) {
+	return s.queryBatches("WHERE status IN ('in_progress', 'finalizing', 'cancelling') ORDER BY created_at")
+}
+
+func (s *Store) queryBatches(where string, args ...any) ([]Batch, error) {
+	rows, err := s.db.Query("SELECT "+batchColumns+" FROM batches "+where, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var batches []Batch
+	for rows.Next() {
+		b, err := scanBatch(rows)
+		if err != nil {
+			return nil, err
+		}
+		batches = append(batches, *b)
+	}
+	return batches, rows.Err()
+}
+
+// batchStatusTimes maps batch statuses to the column recording when the
+// batch entered them.
+var batchStatusTimes = map[string]string{
+	"in_progress": "in_progress_at",
+	"finalizing":  "finalizing_at",
+	"completed":   "completed_at",
+	"failed":      "failed_at",
+	"expired":     "expired_at",
+	"cancelling":  "cancelling_at",
+	"cancelled":   "cancelled_at",
+}
+
+// SetBatchStatus moves a batch to a status, recording when.
+func (s *Store) SetBatchStatus(id, status string) error {
+	column, ok := batchStatusTimes[status]
+	if !ok {
+		return fmt.Errorf("unknown batch status: %s", status)
+	}
+	_, err := s.db.Exec("UPDATE batches SET status = ?, "+column+" = ? WHERE id = ?", status, time.Now().UTC(), id)
+	return err
+}
+
+// SetBatchFiles records a finished batch's output and error files.
+func (s *Store) SetBatchFiles(id, outputFileID, errorFileID string) error {
+	_, err := s.db.Exec("UPDATE batches SET output_file_id = ?, error_file_id = ? WHERE id = ?", outputFileID, errorFileID, id)
+	return err
+}
+
+// PendingBatchItems returns the requests of a batch that haven't run yet.
+func (s *Store) PendingBatchItems(batchID string) ([]BatchItem, error) {
+	rows, err := s.db.Query("SELECT line, custom_id, body FROM batch_items WHERE batch_id = ? AND status = 'pending' ORDER BY line", batchID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var items []BatchItem
+	for rows.Next() {
+		it := BatchItem{Status: "pending"}
+		var body string
+		if err := rows.Scan(&it.Line, &it.CustomID, &body); err != nil {
+			return nil, err
+		}
+		it.Body = json.RawMessage(body)
+		items = append(items, it)
+	}
+	return items, rows.Err()
+}
+
+// FinishedBatchItems returns the outcomes of a batch's requests that have
+// run, in input order, without their bodies.
+func (s *Store) FinishedBatchItems(batchID string) ([]BatchItem, error) {
+	rows, err := s.db.Query(
+		"SELECT line, custom_id, status, status_code, request_id, response FROM batch_items WHERE batch_id = ? AND status != 'pending' ORDER BY line",
+		batchID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var items []BatchItem
+	for rows.Next() {
+		var it BatchItem
+		var resp string
+		if err := rows.Scan(&it.Line, &it.CustomID, &it.Status, &it.StatusCode, &it.RequestID, &resp); err != nil {
+			return nil, err
+		}
+		it.Response = json.RawMessage(resp)
+		items = append(items, it)
+	}
+	return items, rows.Err()
+}
+
+// FinishBatchItem records the outcome of a batch request ("completed" or
+// "failed") and counts it in the batch's totals.
+func (s *Store) FinishBatchItem(batchID string, it *BatchItem) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(
+		"UPDATE batch_items SET status = ?, status_code = ?, request_id = ?, response = ? WHERE batch_id = ? AND line = ?",
+		it.Status, it.StatusCode, it.RequestID, string(it.Response), batchID, it.Line,
+	); err != nil {
+		return err
+	}
+	counter := "completed"
+	if it.Status == "failed" {
+		counter = "failed"
+	}
+	if _, err := tx.Exec("UPDATE batches SET "+counter+" = "+counter+" + 1 WHERE id = ?", batchID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
 // --- Connect Requests ---
 
-func (s *Store) CreateConnectRequest(id, appName, appURL, appIcon, requestedScope string, expiresAt time.Time) error {
+func (s *Store) CreateConnectRequest(id, appName, appURL, appIcon, requestedScope string, requestedTools *ToolPolicy, requestedMCP []string, expiresAt time.Time) error {
 	if requestedScope == "" {
 		requestedScope = "chat"
 	}
-	_, err := s.db.Exec(
-		"INSERT INTO connect_requests (id, app_name, app_url, app_icon, requested_scope, expires_at) VALUES (?, ?, ?, ?, ?, ?)",
-		id, appName, appURL, appIcon, requestedScope, expiresAt,
+	tools, err := encodeToolPolicy(requestedTools)
+	if err != nil {
+		return err
+	}
+	mcpServers := ""
+	if len(requestedMCP) > 0 {
+		data, err := json.Marshal(requestedMCP)
+		if err != nil {
+			return err
+		}
+		mcpServers = string(data)
+	}
+	_, err = s.db.Exec(
+		"INSERT INTO connect_requests (id, app_name, app_url, app_icon, requested_scope, requested_tools, requested_mcp_servers, expires_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
+		id, appName, appURL, appIcon, requestedScope, tools, mcpServers, expiresAt,
 	)
 	return err
 }
 
-func (s *Store) GetConnectRequest(id string) (*ConnectRequest, error) {
+const connectRequestColumns = "id, app_name, app_url, app_icon, requested_scope, requested_tools, requested_mcp_servers, status, token, created_at, expires_at"
+
+func scanConnectRequest(row rowScanner) (*ConnectRequest, error) {
 	var cr ConnectRequest
-	err := s.db.QueryRow(
-		"SELECT id, app_name, app_url, app_icon, requested_scope, status, token, created_at, expires_at FROM connect_requests WHERE id = ?",
+	var tools, mcpServers string
+	if err := row.Scan(&cr.ID, &cr.AppName, &cr.AppURL, &cr.AppIcon, &cr.RequestedScope, &tools, &mcpServers, &cr.Status, &cr.Token, &cr.CreatedAt, &cr.ExpiresAt); err != nil {
+		return nil, err
+	}
+	var err error
+	if cr.RequestedTools, err = decodeToolPolicy(tools); err != nil {
+		return nil, err
+	}
+	if mcpServers != "" {
+		if err := json.Unmarshal([]byte(mcpServers), &cr.RequestedMCP); err != nil {
+			return nil, fmt.Errorf("decoding requested MCP servers: %w", err)
+		}
+	}
+	return &cr, nil
+}
+
+func (s *Store) GetConnectRequest(id string) (*ConnectRequest, error) {
+	cr, err := scanConnectRequest(s.db.QueryRow(
+		"SELECT "+connectRequestColumns+" FROM connect_requests WHERE id = ?",
 		id,
-	).Scan(&cr.ID, &cr.AppName, &cr.AppURL, &cr.AppIcon, &cr.RequestedScope, &cr.Status, &cr.Token, &cr.CreatedAt, &cr.ExpiresAt)
+	))
 	if err == sql.ErrNoRows {
 		return nil, nil
 	}
-	return &cr, err
+	return cr, err
 }
 
 func (s *Store) ApproveConnectRequest(id, token string) error {
@@ -396,7 +1147,7 @@ func (s *Store) DenyConnectRequest(id string) error {
 
 func (s *Store) ListPendingConnectRequests() ([]ConnectRequest, error) {
 	rows, err := s.db.Query(
-		"SELECT id, app_name, app_url, app_icon, requested_scope, status, token, created_at, expires_at FROM connect_requests WHERE status = 'pending' AND expires_at > CURRENT_TIMESTAMP ORDER BY created_at DESC",
+		"SELECT " + connectRequestColumns + " FROM connect_requests WHERE status = 'pending' AND expires_at > CURRENT_TIMESTAMP ORDER BY created_at DESC",
 	)
 	if err != nil {
 		return nil, err
@@ -405,11 +1156,11 @@ func (s *Store) ListPendingConnectRequests() ([]ConnectRequest, error) {
 
 	var requests []ConnectRequest
 	for rows.Next() {
-		var cr ConnectRequest
-		if err := rows.Scan(&cr.ID, &cr.AppName, &cr.AppURL, &cr.AppIcon, &cr.RequestedScope, &cr.Status, &cr.Token, &cr.CreatedAt, &cr.ExpiresAt); err != nil {
+		cr, err := scanConnectRequest(rows)
+		if err != nil {
 			return nil, err
 		}
-		requests = append(requests, cr)
+		requests = append(requests, *cr)
 	}
 	return requests, rows.Err()
 }